@@ -0,0 +1,89 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// With --append-mode a destination file that differs from its source but is
+// equal to the start of it, like a log file that grew since the last run,
+// only gets the new bytes appended instead of being replaced. When the
+// destination is not a prefix of the source the usual rules for different
+// files apply: bail out, or replace it with --overwrite. A destination with
+// other hard links to it (like those --dedupe makes) is replaced like an
+// overwrite instead, appending in place would grow the other links too.
+
+// appendable returns the size of dst when dst holds the first bytes of src,
+// or -1 when it doesn't.
+func appendable(src string, dst string) (int64, error) {
+	sfi, err := cached_stat(src)
+	if err != nil {
+		return -1, err
+	}
+	dfi, err := cached_stat(dst)
+	if err != nil {
+		return -1, err
+	}
+	if !dfi.Mode().IsRegular() || dfi.Size() >= sfi.Size() {
+		return -1, nil
+	}
+	prefix, err := hash_prefix_md5(src, dfi.Size())
+	if err != nil {
+		return -1, err
+	}
+	hash_dst, err := hash_file(dst, "md5")
+	if err != nil || prefix != hash_dst {
+		return -1, err
+	}
+	return dfi.Size(), nil
+}
+
+// append_file appends everything after the first offset bytes of src to dst,
+// which must still be offset bytes long.
+func append_file(src string, dst string, offset int64) (err error) {
+	dfi, err := os.Stat(dst)
+	if err != nil {
+		return
+	}
+	if _, _, links, ok := file_inode(dfi); ok && links > 1 {
+		if dfi.Size() != offset {
+			return fmt.Errorf("%s changed since planning, it is %d bytes instead of %d", dst, dfi.Size(), offset)
+		}
+		return overwrite_file(src, dst)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return
+	}
+	defer func() {
+		cerr := out.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	fi, err := out.Stat()
+	if err != nil {
+		return
+	}
+	if fi.Size() != offset {
+		return fmt.Errorf("%s changed since planning, it is %d bytes instead of %d", dst, fi.Size(), offset)
+	}
+	if _, err = in.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	if _, err = copy_data(out, in); err != nil {
+		return
+	}
+	return out.Sync()
+}
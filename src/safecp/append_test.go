@@ -0,0 +1,85 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAppendable(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src": "line 1\nline 2\n", "grown": "line 1\n", "other": "LINE 1\n", "same": "line 1\nline 2\n"})
+	cases := map[string]int64{"grown": 7, "other": -1, "same": -1}
+	for name, want := range cases {
+		if got, err := appendable(filepath.Join(dir, "src"), filepath.Join(dir, name)); err != nil || got != want {
+			t.Errorf("appendable(%s) = %d (%v), want %d", name, got, err, want)
+		}
+	}
+}
+
+func TestAppendFile(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src": "line 1\nline 2\n", "dst": "line 1\n"})
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	before, _ := os.Stat(dst)
+	if err := append_file(src, dst, 7); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(dst)
+	if got := read_tree(t, dir)["dst"]; got != "line 1\nline 2\n" || !os.SameFile(before, after) {
+		t.Errorf("destination has %q, appended in place: %v", got, os.SameFile(before, after))
+	}
+	if err := append_file(src, dst, 7); err == nil || !strings.Contains(err.Error(), "changed since planning") {
+		t.Errorf("appending to a file that changed gave %v", err)
+	}
+}
+
+func must_stat(t *testing.T, path string) os.FileInfo {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi
+}
+
+func TestAppendFileWithHardLinks(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src": "line 1\nline 2\n", "dst": "line 1\n"})
+	src, dst, other := filepath.Join(dir, "src"), filepath.Join(dir, "dst"), filepath.Join(dir, "other")
+	if err := os.Link(dst, other); err != nil {
+		t.Skip("cannot make hard links:", err)
+	}
+	if _, _, links, ok := file_inode(must_stat(t, dst)); !ok || links != 2 {
+		t.Skip("no link counts on this platform")
+	}
+	if err := append_file(src, dst, 7); err != nil {
+		t.Fatal(err)
+	}
+	got := read_tree(t, dir)
+	if got["dst"] != "line 1\nline 2\n" || got["other"] != "line 1\n" {
+		t.Errorf("the other hard link grew too: %q", got)
+	}
+}
+
+func TestAppendModeRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"log": "one\ntwo\n", "other": "new"})
+	write_tree(t, filepath.Join(dir, "dst"), map[string]string{"log": "one\n", "other": "old"})
+	if _, stderr, status := run_safecp(t, dir, "src", "dst", "--append-mode", "--commit"); status == 0 || !strings.Contains(stderr, "Hashes are NOT the same") {
+		t.Errorf("a file that isn't a prefix didn't bail out: %d\n%s", status, stderr)
+	}
+	must_run(t, dir, "src", "dst", "--append-mode", "--overwrite", "--commit")
+	if got := read_tree(t, filepath.Join(dir, "dst")); got["log"] != "one\ntwo\n" || got["other"] != "new" {
+		t.Errorf("destination has %v", got)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With --autotune-jobs the number of parallel copies is not fixed but found
+// while copying: it starts at 1, and after every window in which copies
+// finished the throughput of that window is compared to the one before.
+// While one more worker makes it at least autotune_gain faster another one
+// is added, up to --jobs (or autotune_max_jobs without it). Once adding
+// doesn't help anymore the last one added is taken away again and the count
+// stays there. When copies fail in a window the count is halved instead,
+// overloaded storage (or a server behind a mount) tends to do that.
+const (
+	autotune_window   = 2 * time.Second
+	autotune_gain     = 0.05
+	autotune_max_jobs = 8
+)
+
+// worker_pool limits how many copies run at the same time, unlike a channel
+// of slots the limit can change while it is in use.
+type worker_pool struct {
+	sync.Mutex
+	cond    *sync.Cond
+	running int
+	limit   int
+}
+
+func new_worker_pool(limit int) *worker_pool {
+	p := &worker_pool{limit: limit}
+	p.cond = sync.NewCond(&p.Mutex)
+	return p
+}
+
+func (p *worker_pool) acquire() {
+	p.Lock()
+	for p.running >= p.limit {
+		p.cond.Wait()
+	}
+	p.running++
+	p.Unlock()
+}
+
+func (p *worker_pool) release() {
+	p.Lock()
+	p.running--
+	p.Unlock()
+	p.cond.Broadcast()
+}
+
+func (p *worker_pool) resize(limit int) {
+	p.Lock()
+	p.limit = limit
+	p.Unlock()
+	p.cond.Broadcast()
+}
+
+// autotuner decides on the number of workers from the throughput of one
+// window after the other.
+type autotuner struct {
+	max     int
+	workers int
+	last    float64
+	settled bool
+}
+
+// next returns the number of workers for the next window. throughput is
+// that of the window before, in which failures copies failed.
+func (t *autotuner) next(throughput float64, failures int) int {
+	switch {
+	case failures > 0:
+		t.workers = max(1, t.workers/2)
+		t.settled = true
+	case t.settled:
+	case t.last == 0 || throughput >= t.last*(1+autotune_gain):
+		t.last = throughput
+		if t.workers < t.max {
+			t.workers++
+		} else {
+			t.settled = true
+		}
+	default:
+		t.workers--
+		t.settled = true
+	}
+	return t.workers
+}
+
+// copied counts the bytes of finished copies while autotuning.
+var copied atomic.Int64
+
+// autotune resizes pool every window until done is closed.
+func autotune(pool *worker_pool, max_jobs int, done chan struct{}) {
+	tuner := autotuner{max: max_jobs, workers: 1}
+	ticker := time.NewTicker(autotune_window)
+	defer ticker.Stop()
+	started := time.Now()
+	bytes := copied.Load()
+	failed := failed_count()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		now := copied.Load()
+		if now == bytes {
+			// nothing finished yet, like while a large file is copied
+			continue
+		}
+		throughput := float64(now-bytes) / time.Since(started).Seconds()
+		workers := tuner.workers
+		if tuner.next(throughput, failed_count()-failed) != workers {
+			notice("Autotune:  %d jobs, was %d at %.1f MB/s\n", tuner.workers, workers, throughput/1e6)
+			pool.resize(tuner.workers)
+		}
+		started, bytes, failed = time.Now(), now, failed_count()
+	}
+}
+
+func failed_count() int {
+	stats.Lock()
+	defer stats.Unlock()
+	return len(stats.failed)
+}
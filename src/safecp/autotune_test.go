@@ -0,0 +1,98 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAutotunerGrowsWhileItHelps(t *testing.T) {
+	tuner := autotuner{max: 8, workers: 1}
+	steps := []struct {
+		throughput float64
+		failures   int
+		want       int
+	}{
+		{100, 0, 2},
+		{200, 0, 3},
+		{260, 0, 4},
+		// less than autotune_gain more, the last one is taken away
+		{265, 0, 3},
+		// settled
+		{1000, 0, 3},
+		{10, 0, 3},
+		{10, 2, 1},
+	}
+	for i, step := range steps {
+		if got := tuner.next(step.throughput, step.failures); got != step.want {
+			t.Errorf("step %d: %d workers, want %d", i, got, step.want)
+		}
+	}
+}
+
+func TestAutotunerStopsAtMax(t *testing.T) {
+	tuner := autotuner{max: 2, workers: 1}
+	for i, want := range []int{2, 2, 2} {
+		if got := tuner.next(float64(100*(i+1)), 0); got != want {
+			t.Errorf("step %d: %d workers, want %d", i, got, want)
+		}
+	}
+	if !tuner.settled {
+		t.Error("not settled at the maximum")
+	}
+}
+
+func TestWorkerPoolResize(t *testing.T) {
+	pool := new_worker_pool(1)
+	var running, most atomic.Int32
+	var wg sync.WaitGroup
+	work := func() {
+		defer wg.Done()
+		defer pool.release()
+		n := running.Add(1)
+		for {
+			m := most.Load()
+			if n <= m || most.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		running.Add(-1)
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		pool.acquire()
+		go work()
+	}
+	wg.Wait()
+	if most.Load() != 1 {
+		t.Errorf("%d workers ran at the same time with a limit of 1", most.Load())
+	}
+	pool.resize(3)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		pool.acquire()
+		go work()
+	}
+	wg.Wait()
+	if got := most.Load(); got < 2 || got > 3 {
+		t.Errorf("%d workers ran at the same time with a limit of 3", got)
+	}
+}
+
+func TestAutotuneJobsRun(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"a": "a", "b": "b", "c": "c", "sub/d": "d"}
+	write_tree(t, filepath.Join(dir, "src"), files)
+	must_run(t, dir, "src", "dst", "--autotune-jobs", "--commit")
+	if got := read_tree(t, filepath.Join(dir, "dst")); len(got) != len(files) {
+		t.Errorf("destination has %v", got)
+	}
+}
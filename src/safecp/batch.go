@@ -0,0 +1,133 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Copied files are synced one by one already, but hard links, renames (of
+// overwrites and moves) and new directories only last through a crash once
+// the directories they are in are synced too. With --commit-batch-size=N
+// and/or --commit-batch-bytes=SIZE, after every N jobs or SIZE bytes of
+// copied data, everything the batch wrote is synced: the files and the
+// directories holding them. A crash then loses at most the last batch, and
+// the next run plans just that again. The rest of the run is synced at the
+// end. Windows can't sync directories, there only the files are. With
+// --verbose the time every batch took is printed.
+
+var batch struct {
+	sync.Mutex
+	jobs    int
+	bytes   int64
+	files   map[string]bool
+	dirs    map[string]bool
+	batches int
+}
+
+// sync_path is a variable so that the syncs can be counted.
+var sync_path = fsync_path
+
+// fsync_path syncs the file or directory path. Windows only flushes a file
+// that is open for writing.
+func fsync_path(path string) error {
+	flag := os.O_RDONLY
+	if runtime.GOOS == "windows" {
+		flag = os.O_WRONLY
+	}
+	file, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+func batching() bool {
+	return opts.commit_batch_size > 0 || opts.commit_batch_bytes > 0
+}
+
+// batch_done adds an executed job to the batch, and syncs the batch when it
+// is complete.
+func batch_done(j job) {
+	if !batching() {
+		return
+	}
+	batch.Lock()
+	defer batch.Unlock()
+	if batch.files == nil {
+		batch.files = make(map[string]bool)
+		batch.dirs = make(map[string]bool)
+	}
+	switch j.operation {
+	case "mkdir":
+		batch.dirs[j.destination] = true
+	case "remove":
+		batch.dirs[filepath.Dir(j.source)] = true
+	default:
+		batch.files[j.destination] = true
+	}
+	batch.dirs[filepath.Dir(j.destination)] = true
+	batch.jobs++
+	if transfers(j) {
+		if fi, err := os.Stat(j.destination); err == nil {
+			batch.bytes += fi.Size()
+		}
+	}
+	if (opts.commit_batch_size > 0 && batch.jobs >= opts.commit_batch_size) ||
+		(opts.commit_batch_bytes > 0 && batch.bytes >= opts.commit_batch_bytes) {
+		sync_batch()
+	}
+}
+
+// finish_batch syncs what is left after the last complete batch.
+func finish_batch() {
+	if !batching() {
+		return
+	}
+	batch.Lock()
+	defer batch.Unlock()
+	if batch.jobs > 0 {
+		sync_batch()
+	}
+}
+
+// sync_batch syncs the batch, with batch locked. A failed sync is reported
+// but doesn't stop the run, the data is there, only not as safe.
+func sync_batch() {
+	started := time.Now()
+	paths := make([]string, 0, len(batch.files)+len(batch.dirs))
+	for path := range batch.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	dirs := make([]string, 0, len(batch.dirs))
+	if runtime.GOOS != "windows" {
+		for dir := range batch.dirs {
+			dirs = append(dirs, dir)
+		}
+		// deepest first, a new directory is synced before the one it is in
+		sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	}
+	for _, path := range append(paths, dirs...) {
+		if err := sync_path(path); err != nil && !os.IsNotExist(err) {
+			warning("cannot sync %s: %v", path, err)
+		}
+	}
+	batch.batches++
+	if opts.verbose {
+		info("Synced:    batch %d, %d jobs, %d files and %d directories in %v\n",
+			batch.batches, batch.jobs, len(paths), len(dirs), time.Since(started).Round(time.Millisecond))
+	}
+	batch.jobs, batch.bytes = 0, 0
+	batch.files = make(map[string]bool)
+	batch.dirs = make(map[string]bool)
+}
@@ -0,0 +1,149 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fake_sync records the paths synced, relative to dir, and starts a new
+// batch.
+func fake_sync(t *testing.T, dir string) *[]string {
+	synced := new([]string)
+	sync_path = func(path string) error {
+		rel, _ := filepath.Rel(dir, path)
+		*synced = append(*synced, filepath.ToSlash(rel))
+		return nil
+	}
+	t.Cleanup(func() {
+		sync_path = fsync_path
+		batch.jobs, batch.bytes, batch.batches = 0, 0, 0
+		batch.files, batch.dirs = nil, nil
+	})
+	return synced
+}
+
+// without_dirs leaves the directories out of want on Windows, which cannot
+// sync them.
+func without_dirs(want string, dirs ...string) string {
+	if runtime.GOOS != "windows" {
+		return want
+	}
+	for _, dir := range dirs {
+		want = strings.ReplaceAll(want, " "+dir, "")
+	}
+	return strings.TrimSpace(want)
+}
+
+func TestNoBatchesByDefault(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	synced := fake_sync(t, dir)
+	write_tree(t, dir, map[string]string{"dst/a": "a"})
+	batch_done(copy_jobs(filepath.Join(dir, "src"), filepath.Join(dir, "dst"), "a")[0])
+	finish_batch()
+	if len(*synced) != 0 || batch.jobs != 0 {
+		t.Errorf("synced %q without batches", *synced)
+	}
+}
+
+func TestCommitBatchSize(t *testing.T) {
+	reset(t)
+	opts.commit_batch_size = 2
+	dir := t.TempDir()
+	synced := fake_sync(t, dir)
+	write_tree(t, dir, map[string]string{"dst/a": "a", "dst/b": "b", "dst/c": "c"})
+	jobs := copy_jobs(filepath.Join(dir, "src"), filepath.Join(dir, "dst"), "b", "a", "c")
+	batch_done(jobs[0])
+	if len(*synced) != 0 {
+		t.Fatalf("synced %q before the batch was complete", *synced)
+	}
+	batch_done(jobs[1])
+	if got, want := strings.Join(*synced, " "), without_dirs("dst/a dst/b dst", "dst"); got != want {
+		t.Errorf("the first batch synced %q, want %q", got, want)
+	}
+	batch_done(jobs[2])
+	finish_batch()
+	if got, want := strings.Join(*synced, " "), without_dirs("dst/a dst/b dst dst/c dst", "dst", "dst"); got != want {
+		t.Errorf("synced %q, want %q", got, want)
+	}
+	if batch.batches != 2 {
+		t.Errorf("synced %d batches", batch.batches)
+	}
+	// nothing left
+	finish_batch()
+	if batch.batches != 2 {
+		t.Error("an empty batch was synced")
+	}
+}
+
+func TestCommitBatchBytes(t *testing.T) {
+	reset(t)
+	opts.commit_batch_bytes = 10
+	dir := t.TempDir()
+	synced := fake_sync(t, dir)
+	write_tree(t, dir, map[string]string{"dst/a": "123456", "dst/b": "123456", "dst/sub/": ""})
+	mkdir := job{operation: "mkdir", destination: filepath.Join(dir, "dst", "sub"), rel: "sub"}
+	batch_done(mkdir)
+	jobs := copy_jobs(filepath.Join(dir, "src"), filepath.Join(dir, "dst"), "a", "b")
+	batch_done(jobs[0])
+	if len(*synced) != 0 {
+		t.Fatalf("synced %q after 6 bytes", *synced)
+	}
+	batch_done(jobs[1])
+	// a new directory is synced before the one it is in
+	if got, want := strings.Join(*synced, " "), without_dirs("dst/a dst/b dst/sub dst", "dst/sub", "dst"); got != want {
+		t.Errorf("synced %q, want %q", got, want)
+	}
+}
+
+func TestFsyncPath(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"a": "a"})
+	if err := fsync_path(filepath.Join(dir, "a")); err != nil {
+		t.Error(err)
+	}
+	if runtime.GOOS != "windows" {
+		if err := fsync_path(dir); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := fsync_path(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("syncing a missing file gave %v", err)
+	}
+}
+
+func TestCommitBatchRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a", "b": "b", "sub/c": "c"})
+	out := must_run(t, dir, "src", "dst", "--commit-batch-size=2", "--commit")
+	if strings.Contains(out, "Synced:") {
+		t.Errorf("batch timings without --verbose:\n%s", out)
+	}
+	if got := read_tree(t, filepath.Join(dir, "dst")); got["a"] != "a" || got["b"] != "b" || got["sub/c"] != "c" {
+		t.Errorf("destination has %v", got)
+	}
+	out = must_run(t, dir, "src", "dst2", "--commit-batch-size=2", "--verbose", "--commit")
+	// mkdir ., mkdir sub and three copies
+	if n := strings.Count(out, "Synced:    batch"); n != 3 || !strings.Contains(out, "Synced:    batch 3, 1 jobs") {
+		t.Errorf("got %d batches:\n%s", n, out)
+	}
+}
+
+func TestCommitBatchOptions(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a"})
+	if _, stderr, status := run_safecp(t, dir, "src", "dst", "--commit-batch-size=-1"); status == 0 || !strings.Contains(stderr, "cannot be negative") {
+		t.Errorf("a negative batch size gave status %d\n%s", status, stderr)
+	}
+	if _, stderr, status := run_safecp(t, dir, "src", "dst", "--commit-batch-bytes=1M", "--to-http=http://localhost:1/"); status == 0 || !strings.Contains(stderr, "cannot be combined with --to-http") {
+		t.Errorf("batches with --to-http gave status %d\n%s", status, stderr)
+	}
+}
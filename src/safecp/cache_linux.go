@@ -0,0 +1,25 @@
+//go:build linux && (amd64 || arm64 || loong64 || riscv64)
+
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const posix_fadv_dontneed = 4
+
+// fadvise_dontneed tells the kernel the cached pages of file won't be
+// needed again, an offset and length of 0 cover the whole file.
+func fadvise_dontneed(file *os.File) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, file.Fd(), 0, 0, posix_fadv_dontneed, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
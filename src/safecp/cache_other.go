@@ -0,0 +1,15 @@
+//go:build !linux || !(amd64 || arm64 || loong64 || riscv64)
+
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import "os"
+
+// fadvise_dontneed does nothing, there is no posix_fadvise here.
+func fadvise_dontneed(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,58 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// safecp --check-case-collisions <source_dir> copies nothing, it lists the
+// paths in source_dir that are the same when case is ignored (README and
+// readme), which end up as one file on a case-insensitive destination. Only
+// entries of the same directory are compared: when two directories collide,
+// that is reported once, and their contents get merged on such a
+// destination. The exit status is 1 when there are collisions.
+
+// check_case_collisions returns the exit status.
+func check_case_collisions(src_dir string) int {
+	names := make(map[string][]string)
+	err := filepath.Walk(src_dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return tolerate(err, path)
+		}
+		rel := relative(path[len(src_dir):])
+		if rel == "" {
+			return nil
+		}
+		key := filepath.Join(filepath.Dir(rel), strings.ToLower(filepath.Base(rel)))
+		names[key] = append(names[key], portable(rel))
+		return nil
+	})
+	if err != nil {
+		log_error("Error: %v. Bailing out!\n", err)
+		os.Exit(1)
+	}
+	groups := make([]string, 0)
+	for _, group := range names {
+		if len(group) > 1 {
+			sort.Strings(group)
+			groups = append(groups, strings.Join(group, ", "))
+		}
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		info("Case collision: %s\n", group)
+	}
+	collisions := len(groups)
+	notice("Found %d case collisions in %s\n", collisions, src_dir)
+	if collisions > 0 {
+		return 1
+	}
+	return 0
+}
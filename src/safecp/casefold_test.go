@@ -0,0 +1,53 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// case_tree makes paths that differ only in case, or skips the test on a
+// case-insensitive filesystem.
+func case_tree(t *testing.T) string {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"README": "a", "Docs/x": "x", "docs/y": "y", "sub/A": "a", "other/a": "a"})
+	if err := os.WriteFile(filepath.Join(dir, "src", "readme"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "src", "README")); string(got) != "a" {
+		t.Skip("the test directory is on a case-insensitive filesystem")
+	}
+	return dir
+}
+
+func TestCheckCaseCollisions(t *testing.T) {
+	dir := case_tree(t)
+	stdout, _, status := run_safecp(t, dir, "--check-case-collisions", "src")
+	if status != 1 {
+		t.Errorf("exit status %d with collisions", status)
+	}
+	// only entries of the same directory collide, colliding directories once
+	want := "Case collision: Docs, docs\nCase collision: README, readme\nFound 2 case collisions in src\n"
+	if stdout != want {
+		t.Errorf("got\n%swant\n%s", stdout, want)
+	}
+	os.Remove(filepath.Join(dir, "src", "readme"))
+	os.RemoveAll(filepath.Join(dir, "src", "docs"))
+	if stdout, _, status := run_safecp(t, dir, "--check-case-collisions", "src"); status != 0 || !strings.Contains(stdout, "Found 0 case collisions") {
+		t.Errorf("exit status %d without collisions\n%s", status, stdout)
+	}
+}
+
+func TestCheckCaseCollisionsTakesOnlyTheSource(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a"})
+	if _, stderr, status := run_safecp(t, dir, "--check-case-collisions", "src", "dst"); status == 0 || !strings.Contains(stderr, "takes only the source directory") {
+		t.Errorf("a target directory gave status %d\n%s", status, stderr)
+	}
+}
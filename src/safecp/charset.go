@@ -0,0 +1,87 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// With --dest-charset=NAME destination names are written in another charset
+// than the UTF-8 of the source, for old shares that expect Latin-1 names.
+// Source names are compared with the destination in that charset too.
+//
+// This can lose information: a character the charset doesn't have is an
+// error, or with --dest-charset-substitute becomes '_', and then different
+// source names can end up as the same destination name. That is an error as
+// well, otherwise one file would silently replace the other. Names are not
+// converted back, a destination listed on the original host shows them as
+// invalid UTF-8.
+
+// charsets are the supported --dest-charset names, with the highest code
+// point they can store. Both are single byte charsets in which the code
+// points up to that are the byte values. Any other charset is refused:
+// safecp only uses the standard library, which has no tables for the
+// others (golang.org/x/text/encoding has).
+var charsets = map[string]rune{
+	"ascii":      0x7f,
+	"latin1":     0xff,
+	"iso-8859-1": 0xff,
+}
+
+func charset_names() string {
+	names := make([]string, 0, len(charsets))
+	for name := range charsets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// dest_names remembers which source path every converted name came from.
+var dest_names struct {
+	sync.Mutex
+	from map[string]string
+}
+
+// dest_name converts path_part (the part of a source path after
+// source_dir) to --dest-charset.
+func dest_name(path_part string) (string, error) {
+	if opts.dest_charset == "" {
+		return path_part, nil
+	}
+	limit := charsets[opts.dest_charset]
+	converted := make([]byte, 0, len(path_part))
+	for i, r := range path_part {
+		if r == utf8.RuneError {
+			if _, size := utf8.DecodeRuneInString(path_part[i:]); size == 1 {
+				return "", fmt.Errorf("%s is not valid UTF-8, it can't be converted to %s", path_part, opts.dest_charset)
+			}
+		}
+		switch {
+		case r <= limit:
+			converted = append(converted, byte(r))
+		case opts.dest_charset_substitute:
+			converted = append(converted, '_')
+		default:
+			return "", fmt.Errorf("%s has %q, which %s doesn't have (see --dest-charset-substitute)", path_part, r, opts.dest_charset)
+		}
+	}
+	name := string(converted)
+	dest_names.Lock()
+	defer dest_names.Unlock()
+	if dest_names.from == nil {
+		dest_names.from = make(map[string]string)
+	}
+	if other, ok := dest_names.from[name]; ok && other != path_part {
+		return "", fmt.Errorf("%s and %s both become %q in %s", other, path_part, name, opts.dest_charset)
+	}
+	dest_names.from[name] = path_part
+	return name, nil
+}
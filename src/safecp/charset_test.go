@@ -0,0 +1,84 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func forget_dest_names(t *testing.T) {
+	t.Cleanup(func() { dest_names.from = nil })
+}
+
+// latin1_string decodes latin1 bytes, every byte is the code point.
+func latin1_string(name string) string {
+	runes := make([]rune, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		runes = append(runes, rune(name[i]))
+	}
+	return string(runes)
+}
+
+func TestDestNameLatin1(t *testing.T) {
+	reset(t)
+	forget_dest_names(t)
+	opts.dest_charset = "latin1"
+	for _, name := range []string{"/café", "/Größe/naïve.txt", "/plain"} {
+		got, err := dest_name(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len([]rune(name)) || latin1_string(got) != name {
+			t.Errorf("dest_name(%s) = %q, which is %s in latin1", name, got, latin1_string(got))
+		}
+	}
+	if _, err := dest_name("/€uro"); err == nil || !strings.Contains(err.Error(), "--dest-charset-substitute") {
+		t.Errorf("a character latin1 doesn't have gave %v", err)
+	}
+	if _, err := dest_name("/bad\xff"); err == nil || !strings.Contains(err.Error(), "not valid UTF-8") {
+		t.Errorf("invalid UTF-8 gave %v", err)
+	}
+}
+
+func TestDestNameSubstituteCollisions(t *testing.T) {
+	reset(t)
+	forget_dest_names(t)
+	opts.dest_charset = "ascii"
+	opts.dest_charset_substitute = true
+	if got, err := dest_name("/café"); err != nil || got != "/caf_" {
+		t.Fatalf("dest_name(/café) = %q (%v)", got, err)
+	}
+	// the same name again is fine, another one that becomes the same isn't
+	if _, err := dest_name("/café"); err != nil {
+		t.Error(err)
+	}
+	if _, err := dest_name("/cafè"); err == nil || !strings.Contains(err.Error(), "both become") {
+		t.Errorf("a collision gave %v", err)
+	}
+}
+
+func TestDestCharsetRun(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		t.Skip("the filesystem only takes UTF-8 names")
+	}
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"café/crème": "x"})
+	must_run(t, dir, "src", "dst", "--dest-charset=latin1", "--commit")
+	if data, err := os.ReadFile(filepath.Join(dir, "dst", "caf\xe9", "cr\xe8me")); err != nil || string(data) != "x" {
+		t.Errorf("the latin1 name has %q (%v)", data, err)
+	}
+	// a second run compares the names in latin1 and has nothing to do
+	if out := must_run(t, dir, "src", "dst", "--dest-charset=latin1", "--itemize"); strings.Contains(out, ">f") {
+		t.Errorf("the second run copies again:\n%s", out)
+	}
+	if _, stderr, status := run_safecp(t, dir, "src", "dst", "--dest-charset=utf-16"); status == 0 || !strings.Contains(stderr, "ascii, iso-8859-1, latin1") {
+		t.Errorf("an unknown charset gave status %d\n%s", status, stderr)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// With --plan-checkpoint=FILE the plan for every top level entry of the
+// source is written to FILE as soon as that entry is planned completely. When
+// planning is interrupted, the next run with the same FILE takes the plan of
+// the entries in it from there and only walks the others. FILE is removed
+// once the whole source is planned.
+//
+// A saved entry is only used again when the modification times of it and of
+// all directories below it are still the same, which is cheap to check and
+// catches files being added, removed or renamed anywhere in it (but not
+// files being rewritten in place), and when nothing appeared in the
+// destination where the plan creates something.
+
+type plan_checkpoint struct {
+	Source      string                      `json:"source"`
+	Destination string                      `json:"destination"`
+	Entries     map[string]checkpoint_entry `json:"entries"`
+}
+
+type checkpoint_entry struct {
+	Mtimes map[string]int64 `json:"mtimes"` // of the entry and its directories
+	Jobs   []job_record     `json:"jobs"`
+}
+
+// job_record is a job as it is saved to a file.
+type job_record struct {
+	Operation   string     `json:"operation"`
+	Source      string     `json:"source"`
+	Destination string     `json:"destination"`
+	Rel         string     `json:"rel"`
+	Mode        uint32     `json:"mode,omitempty"`
+	Metadata    []bool     `json:"metadata,omitempty"` // mode, owner, times, xattrs
+	Target      string     `json:"target,omitempty"`
+	Offset      int64      `json:"offset,omitempty"`
+	Size        int64      `json:"size,omitempty"`
+	Before      file_state `json:"before"`
+}
+
+func record_job(j job) job_record {
+	r := job_record{j.operation, j.source, j.destination, j.rel, uint32(j.mode), nil, j.target, j.offset, j.size, j.before}
+	if j.metadata.any() {
+		r.Metadata = []bool{j.metadata.mode, j.metadata.owner, j.metadata.times, j.metadata.xattrs}
+	}
+	return r
+}
+
+func (r job_record) job() job {
+	j := job{operation: r.Operation, source: r.Source, destination: r.Destination, rel: r.Rel,
+		mode: os.FileMode(r.Mode), target: r.Target, offset: r.Offset, size: r.Size, before: r.Before}
+	if len(r.Metadata) == 4 {
+		j.metadata = metadata_diff{r.Metadata[0], r.Metadata[1], r.Metadata[2], r.Metadata[3]}
+	}
+	return j
+}
+
+// load_plan_checkpoint reads file, giving an empty checkpoint when it is
+// missing, unreadable or made for other directories.
+func load_plan_checkpoint(file string, src_dir string, dest_dir string) *plan_checkpoint {
+	cp := &plan_checkpoint{Source: src_dir, Destination: dest_dir, Entries: make(map[string]checkpoint_entry)}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return cp
+	}
+	saved := &plan_checkpoint{}
+	if err == nil {
+		err = json.Unmarshal(data, saved)
+	}
+	switch {
+	case err != nil || saved.Entries == nil:
+		warning("plan checkpoint %s is unreadable, planning everything again", file)
+	case saved.Source != src_dir || saved.Destination != dest_dir:
+		warning("plan checkpoint %s is for %s and %s, planning everything again", file, saved.Source, saved.Destination)
+	default:
+		cp.Entries = saved.Entries
+	}
+	return cp
+}
+
+func (cp *plan_checkpoint) save(file string) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Clean(file))
+}
+
+// still_valid tells whether a saved entry can be used as it is.
+func (e checkpoint_entry) still_valid(src_dir string) bool {
+	for rel, mtime := range e.Mtimes {
+		fi, err := os.Lstat(filepath.Join(src_dir, rel))
+		if err != nil || fi.ModTime().UnixNano() != mtime {
+			return false
+		}
+	}
+	for _, r := range e.Jobs {
+		if r.Operation == "mkdir" || r.Operation == "copy" || r.Operation == "link" {
+			if _, err := os.Lstat(r.Destination); !os.IsNotExist(err) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// walk_checkpointed makes the same plan as a sequential filepath.Walk over
+// src_dir, see above. The paths of resumed entries are still walked for
+// account, only planning them is skipped.
+func walk_checkpointed(src_dir string, jobs *[]job, plan planner, account func(path string, f os.FileInfo), file string, dest_dir string) error {
+	root, err := os.Lstat(src_dir)
+	if err != nil {
+		return err
+	}
+	if err := plan(src_dir, root, nil, jobs); err != nil || !root.IsDir() {
+		return err
+	}
+	entries, err := os.ReadDir(src_dir)
+	if err != nil {
+		return err
+	}
+	cp := load_plan_checkpoint(file, src_dir, dest_dir)
+	resumed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if saved, ok := cp.Entries[name]; ok && saved.still_valid(src_dir) {
+			err := filepath.Walk(filepath.Join(src_dir, name), func(path string, f os.FileInfo, err error) error {
+				if err != nil {
+					return tolerate(err, path)
+				}
+				account(path, f)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, r := range saved.Jobs {
+				*jobs = append(*jobs, r.job())
+			}
+			resumed++
+			continue
+		}
+		planned := make([]job, 0)
+		mtimes := make(map[string]int64)
+		err := filepath.Walk(filepath.Join(src_dir, name), func(path string, f os.FileInfo, err error) error {
+			if err == nil && (f.IsDir() || len(mtimes) == 0) {
+				mtimes[relative(path[len(src_dir):])] = f.ModTime().UnixNano()
+			}
+			return plan(path, f, err, &planned)
+		})
+		if err != nil {
+			return err
+		}
+		*jobs = append(*jobs, planned...)
+		saved := checkpoint_entry{mtimes, make([]job_record, 0, len(planned))}
+		for _, j := range planned {
+			saved.Jobs = append(saved.Jobs, record_job(j))
+		}
+		cp.Entries[name] = saved
+		if err := cp.save(file); err != nil {
+			return err
+		}
+	}
+	if resumed > 0 {
+		notice("Resumed the plan for %d of %d entries from %s\n", resumed, len(entries), file)
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// interrupted_walk plans src with a checkpoint in file, stopping at the
+// entry called stop.
+func interrupted_walk(t *testing.T, src string, file string, stop string) {
+	t.Helper()
+	plan := func(path string, f os.FileInfo, err error, jobs *[]job) error {
+		if filepath.Base(path) == stop {
+			return errors.New("interrupted")
+		}
+		return path_planner(path, f, err, jobs)
+	}
+	jobs := make([]job, 0)
+	if err := walk_checkpointed(src, &jobs, plan, func(string, os.FileInfo) {}, file, "dst"); err == nil {
+		t.Fatal("the walk wasn't interrupted")
+	}
+}
+
+func TestPlanCheckpointResumes(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	file := filepath.Join(dir, "checkpoint")
+	write_tree(t, src, map[string]string{"a/1": "", "a/2": "", "b/1": "", "c": ""})
+	full := make([]job, 0)
+	filepath.Walk(src, func(path string, f os.FileInfo, err error) error {
+		return path_planner(path, f, err, &full)
+	})
+	interrupted_walk(t, src, file, "c")
+	if _, err := os.Stat(file); err != nil {
+		t.Fatal("no checkpoint was saved:", err)
+	}
+	planned := make([]string, 0)
+	accounted := 0
+	plan := func(path string, f os.FileInfo, err error, jobs *[]job) error {
+		planned = append(planned, path[len(src):])
+		return path_planner(path, f, err, jobs)
+	}
+	jobs := make([]job, 0)
+	if err := walk_checkpointed(src, &jobs, plan, func(string, os.FileInfo) { accounted++ }, file, "dst"); err != nil {
+		t.Fatal(err)
+	}
+	if planned_sources(jobs) != planned_sources(full) {
+		t.Errorf("resuming planned\n%s\ninstead of\n%s", planned_sources(jobs), planned_sources(full))
+	}
+	if got := filepath.ToSlash(strings.Join(planned, " ")); got != " /c" {
+		t.Errorf("planned %q again, want only the root and c", got)
+	}
+	// a, a/1, a/2, b, b/1 are still seen for the summary
+	if accounted != 5 {
+		t.Errorf("accounted for %d resumed paths, want 5", accounted)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Error("the checkpoint is left after planning everything")
+	}
+}
+
+func TestPlanCheckpointNoticesChanges(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	file := filepath.Join(dir, "checkpoint")
+	write_tree(t, src, map[string]string{"a/sub/1": "", "b": "", "c": ""})
+	interrupted_walk(t, src, file, "c")
+	write_tree(t, src, map[string]string{"a/sub/new": ""})
+	// mtimes may not change within the resolution of the filesystem
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(src, "a", "sub"), later, later)
+	cp := load_plan_checkpoint(file, src, "dst")
+	if cp.Entries["a"].still_valid(src) {
+		t.Error("a is still valid after adding a file in a/sub")
+	}
+	if !cp.Entries["b"].still_valid(src) {
+		t.Error("b is not valid anymore")
+	}
+	write_tree(t, dir, map[string]string{"dst-b": ""})
+	b := cp.Entries["b"]
+	b.Jobs = append(b.Jobs, job_record{Operation: "copy", Destination: filepath.Join(dir, "dst-b")})
+	if b.still_valid(src) {
+		t.Error("b is still valid with its destination created since")
+	}
+}
+
+func TestPlanCheckpointForOtherDirectories(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	file := filepath.Join(dir, "checkpoint")
+	write_tree(t, src, map[string]string{"a": "", "c": ""})
+	interrupted_walk(t, src, file, "c")
+	if cp := load_plan_checkpoint(file, src, "dst"); len(cp.Entries) != 1 {
+		t.Errorf("loaded %d entries, want 1", len(cp.Entries))
+	}
+	if cp := load_plan_checkpoint(file, src, "elsewhere"); len(cp.Entries) != 0 {
+		t.Errorf("loaded %d entries for another destination", len(cp.Entries))
+	}
+	os.WriteFile(file, []byte("{"), 0644)
+	if cp := load_plan_checkpoint(file, src, "dst"); len(cp.Entries) != 0 {
+		t.Errorf("loaded %d entries from a broken file", len(cp.Entries))
+	}
+}
+
+func TestPlanCheckpointRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a/1": "1", "b": "b"})
+	must_run(t, dir, "src", "dst", "--plan-checkpoint=checkpoint", "--commit")
+	if got := read_tree(t, filepath.Join(dir, "dst")); got["a/1"] != "1" || got["b"] != "b" {
+		t.Errorf("destination has %v", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "checkpoint")); !os.IsNotExist(err) {
+		t.Error("the checkpoint is left after the run")
+	}
+}
@@ -0,0 +1,432 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With --chunk-store=DIR copied and overwritten files are not written to the
+// destination as they are. Their content is cut into chunks at boundaries
+// found by a rolling hash over the content itself, so an insertion or a
+// change somewhere in a large file only changes the chunks around it. Every
+// chunk is stored once in DIR, and the destination file becomes a chunk
+// list naming the chunks to put together:
+//
+//	safecp-chunks 1
+//	size <total size>
+//	<sha256 of chunk> <size of chunk>
+//	...
+//
+// A chunk is stored as DIR/<first two hex digits>/<sha256 in hex>. Chunks
+// are written to a temporary file and renamed into place, so one that is in
+// the store is always complete, and copies running at the same time can
+// store the same chunk without harm. When comparing, a chunk list in the
+// destination counts as the content it describes.
+//
+// safecp --chunk-store=DIR --restore-chunks <tree> <target_dir> writes the
+// real files for the chunk lists in tree to target_dir, checking every chunk
+// against its hash on the way.
+//
+// Nothing is ever removed from the store by a copy. safecp --chunk-store=DIR
+// --chunk-gc <tree>... lists the chunks no chunk list in any of the trees
+// refers to, and removes them with --commit. Every tree made with the store
+// must be given, and nothing may be copying into the store at the same time,
+// otherwise chunks that are still needed are removed.
+
+const chunk_list_header = "safecp-chunks 1"
+
+// The chunk sizes: no boundary is looked for in the first chunk_min bytes,
+// one is forced at chunk_max, and in between a boundary is found on average
+// every chunk_mask+1 bytes.
+const (
+	chunk_min  = 64 * 1024
+	chunk_max  = 8 * 1024 * 1024
+	chunk_mask = 1<<20 - 1
+)
+
+// gear is the table of the rolling hash. It must never change, or files
+// stored before are cut differently and share no chunks with new copies.
+var gear = func() (table [256]uint64) {
+	x := uint64(0x736166656370)
+	for i := range table {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+	return
+}()
+
+// chunk_boundary returns the length of the chunk at the start of data,
+// which holds all that is left of the file or at least chunk_max bytes.
+func chunk_boundary(data []byte) int {
+	if len(data) <= chunk_min {
+		return len(data)
+	}
+	var h uint64
+	for i := chunk_min; i < len(data) && i < chunk_max; i++ {
+		h = h<<1 + gear[data[i]]
+		if h&chunk_mask == 0 {
+			return i + 1
+		}
+	}
+	return min(len(data), chunk_max)
+}
+
+// chunker cuts what it reads from r into chunks.
+type chunker struct {
+	r     io.Reader
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+}
+
+func new_chunker(r io.Reader) *chunker {
+	return &chunker{r: r, buf: make([]byte, 2*chunk_max)}
+}
+
+// next returns the next chunk, which is only valid until the next call, or
+// io.EOF after the last one.
+func (c *chunker) next() ([]byte, error) {
+	if c.start >= chunk_max {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+	}
+	for !c.eof && c.end-c.start < chunk_max {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := chunk_boundary(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+type chunk_ref struct {
+	hash string
+	size int64
+}
+
+type chunk_list struct {
+	size   int64
+	chunks []chunk_ref
+}
+
+func chunk_path(hash string) string {
+	return filepath.Join(opts.chunk_store, hash[:2], hash)
+}
+
+// store_chunk puts data in the store unless it is there already.
+func store_chunk(hash string, data []byte) error {
+	path := chunk_path(hash)
+	if _, err := os.Stat(path); err == nil {
+		stats.Lock()
+		stats.chunks_reused++
+		stats.Unlock()
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), temp_prefix+"*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	stats.Lock()
+	stats.chunks_stored++
+	stats.chunk_bytes += int64(len(data))
+	stats.Unlock()
+	return nil
+}
+
+// write_chunk_list stores the chunks of src and writes the chunk list for
+// them to dst.
+func write_chunk_list(src string, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	list := chunk_list{}
+	c := new_chunker(throttled(in))
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(chunk)
+		hash := hex.EncodeToString(sum[:])
+		if err := store_chunk(hash, chunk); err != nil {
+			return err
+		}
+		list.chunks = append(list.chunks, chunk_ref{hash, int64(len(chunk))})
+		list.size += int64(len(chunk))
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return
+	}
+	defer func() {
+		cerr := out.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	w := bufio.NewWriter(out)
+	fmt.Fprintf(w, "%s\nsize %d\n", chunk_list_header, list.size)
+	for _, ref := range list.chunks {
+		fmt.Fprintf(w, "%s %d\n", ref.hash, ref.size)
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	err = out.Sync()
+	return
+}
+
+// read_chunk_list reads the chunk list at path, ok is false when path is
+// some other file.
+func read_chunk_list(path string) (list chunk_list, ok bool, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() || scanner.Text() != chunk_list_header {
+		return list, false, scanner.Err()
+	}
+	bad := fmt.Errorf("%s is not a valid chunk list", path)
+	if !scanner.Scan() {
+		return list, true, bad
+	}
+	size, found := strings.CutPrefix(scanner.Text(), "size ")
+	if list.size, err = strconv.ParseInt(size, 10, 64); !found || err != nil {
+		return list, true, bad
+	}
+	total := int64(0)
+	for scanner.Scan() {
+		hash, size, _ := strings.Cut(scanner.Text(), " ")
+		n, err := strconv.ParseInt(size, 10, 64)
+		if len(hash) != 2*sha256.Size || err != nil {
+			return list, true, bad
+		}
+		list.chunks = append(list.chunks, chunk_ref{hash, n})
+		total += n
+	}
+	if err = scanner.Err(); err == nil && total != list.size {
+		err = bad
+	}
+	return list, true, err
+}
+
+// chunk_reader reads the content described by a chunk list, failing when a
+// chunk doesn't match its hash.
+type chunk_reader struct {
+	chunks []chunk_ref
+	data   []byte
+}
+
+func (r *chunk_reader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		ref := r.chunks[0]
+		r.chunks = r.chunks[1:]
+		data, err := os.ReadFile(chunk_path(ref.hash))
+		if err != nil {
+			return 0, err
+		}
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != ref.hash || int64(len(data)) != ref.size {
+			return 0, fmt.Errorf("chunk %s in the store is damaged", ref.hash)
+		}
+		r.data = data
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// hash_dest_file hashes a destination file, for a chunk list that is the
+// hash of the content it describes.
+func hash_dest_file(path string, algorithm string) (string, error) {
+	if opts.chunk_store == "" {
+		return hash_file(path, algorithm)
+	}
+	list, ok, err := read_chunk_list(path)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return hash_file(path, algorithm)
+	}
+	hash := hashers[algorithm]()
+	if _, err := io.Copy(hash, &chunk_reader{chunks: list.chunks}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// restore_chunks puts the files described by the chunk lists in src_dir
+// back together in dest_dir, other files are copied as they are.
+func restore_chunks(src_dir string, dest_dir string, commit bool) {
+	restored := 0
+	err := filepath.Walk(src_dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return tolerate(err, path)
+		}
+		target := dest_dir + path[len(src_dir):]
+		switch {
+		case f.IsDir():
+			if fi, err := os.Stat(target); err == nil && fi.IsDir() {
+				return nil
+			}
+			info("Make dir:  %s\n", target)
+			if commit {
+				return os.Mkdir(target, f.Mode()&mode_bits|0700)
+			}
+			return nil
+		case !f.Mode().IsRegular():
+			warning("not restoring %s, it is not a regular file", path)
+			return nil
+		}
+		if _, err := os.Lstat(target); err == nil {
+			return fmt.Errorf("%s exists, not overwriting it", target)
+		}
+		list, ok, err := read_chunk_list(path)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			info("Copy file: %s -> %s\n", path, target)
+			if commit {
+				return copyFileContents(path, target)
+			}
+			return nil
+		}
+		info("Restore:   %s -> %s (%d chunks)\n", path, target, len(list.chunks))
+		restored++
+		if !commit {
+			return nil
+		}
+		if err := restore_file(list, target); err != nil {
+			return err
+		}
+		if err := os.Chmod(target, f.Mode()&mode_bits); err != nil {
+			return err
+		}
+		return os.Chtimes(target, time.Time{}, f.ModTime())
+	})
+	if err != nil {
+		log_error("Error: %v. Bailing out!\n", err)
+		os.Exit(1)
+	}
+	notice("Restored %d files from %s\n", restored, opts.chunk_store)
+}
+
+func restore_file(list chunk_list, target string) (err error) {
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return
+	}
+	defer func() {
+		cerr := out.Close()
+		if err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(target)
+		}
+	}()
+	if _, err = io.Copy(out, &chunk_reader{chunks: list.chunks}); err != nil {
+		return
+	}
+	err = out.Sync()
+	return
+}
+
+// collect_chunks garbage collects the store, trees are all the trees with
+// chunk lists that refer to it.
+func collect_chunks(trees []string, commit bool) {
+	used := make(map[string]bool)
+	for _, tree := range trees {
+		err := filepath.Walk(tree, func(path string, f os.FileInfo, err error) error {
+			if err != nil || !f.Mode().IsRegular() {
+				return err
+			}
+			list, _, err := read_chunk_list(path)
+			for _, ref := range list.chunks {
+				used[ref.hash] = true
+			}
+			return err
+		})
+		if err != nil {
+			log_error("Error: %v. Not removing anything!\n", err)
+			os.Exit(1)
+		}
+	}
+	unused, bytes := 0, int64(0)
+	err := filepath.Walk(opts.chunk_store, func(path string, f os.FileInfo, err error) error {
+		if err != nil || f.IsDir() || used[f.Name()] {
+			return err
+		}
+		info("Unused chunk: %s\n", path)
+		unused++
+		bytes += f.Size()
+		if commit {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		log_error("Error: %v. Bailing out!\n", err)
+		os.Exit(1)
+	}
+	if commit {
+		notice("Removed %d unused chunks, %d bytes\n", unused, bytes)
+	} else {
+		notice("Found %d unused chunks, %d bytes\n", unused, bytes)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// random_data returns n bytes that are the same on every run.
+func random_data(n int, seed int64) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// chunk_hashes cuts data into chunks and returns their hashes.
+func chunk_hashes(t *testing.T, data []byte) []string {
+	t.Helper()
+	c := new_chunker(bytes.NewReader(data))
+	hashes := make([]string, 0)
+	total := 0
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunk) > chunk_max || (len(chunk) < chunk_min && total+len(chunk) != len(data)) {
+			t.Errorf("chunk of %d bytes", len(chunk))
+		}
+		total += len(chunk)
+		sum := sha256.Sum256(chunk)
+		hashes = append(hashes, hex.EncodeToString(sum[:]))
+	}
+	if total != len(data) {
+		t.Errorf("the chunks have %d bytes, the data %d", total, len(data))
+	}
+	return hashes
+}
+
+func TestChunkBoundary(t *testing.T) {
+	if got := chunk_boundary(make([]byte, chunk_min)); got != chunk_min {
+		t.Errorf("chunk_boundary of chunk_min bytes = %d", got)
+	}
+	// zeros never hit a boundary of the rolling hash
+	if got := chunk_boundary(make([]byte, chunk_max+1)); got != chunk_max {
+		t.Errorf("chunk_boundary of zeros = %d, want chunk_max", got)
+	}
+}
+
+func TestChunksSurviveAnInsertion(t *testing.T) {
+	data := random_data(12<<20, 1)
+	changed := append(append(append([]byte{}, data[:6<<20]...), "inserted"...), data[6<<20:]...)
+	before, after := chunk_hashes(t, data), chunk_hashes(t, changed)
+	if len(before) < 4 {
+		t.Fatalf("only %d chunks in 12 MB", len(before))
+	}
+	known := make(map[string]bool)
+	for _, hash := range before {
+		known[hash] = true
+	}
+	shared := 0
+	for _, hash := range after {
+		if known[hash] {
+			shared++
+		}
+	}
+	// only the chunk with the insertion, maybe the one after it, differ
+	if shared < len(after)-2 {
+		t.Errorf("%d of %d chunks are shared after an insertion", shared, len(after))
+	}
+}
+
+func TestChunkStoreRun(t *testing.T) {
+	dir := t.TempDir()
+	big := string(random_data(3<<20, 2))
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"big": big, "sub/small": "small", "empty": ""})
+	must_run(t, dir, "src", "dst", "--chunk-store=store", "--commit")
+	list, err := os.ReadFile(filepath.Join(dir, "dst", "big"))
+	if err != nil || !strings.HasPrefix(string(list), chunk_list_header+"\nsize 3145728\n") {
+		t.Fatalf("the destination isn't a chunk list: %.60q (%v)", list, err)
+	}
+	// a chunk list counts as its content
+	if out := must_run(t, dir, "src", "dst", "--chunk-store=store", "--itemize"); strings.Contains(out, ">f") {
+		t.Errorf("the second run copies again:\n%s", out)
+	}
+	must_run(t, dir, "dst", "restored", "--chunk-store=store", "--restore-chunks", "--commit")
+	if got := read_tree(t, filepath.Join(dir, "restored")); got["big"] != big || got["sub/small"] != "small" || got["empty"] != "" {
+		t.Errorf("restored %d files, big has %d bytes", len(got), len(got["big"]))
+	}
+}
+
+func TestRestoreChecksChunks(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "content"})
+	must_run(t, dir, "src", "dst", "--chunk-store=store", "--commit")
+	sum := sha256.Sum256([]byte("content"))
+	hash := hex.EncodeToString(sum[:])
+	os.WriteFile(filepath.Join(dir, "store", hash[:2], hash), []byte("CONTENT"), 0644)
+	if _, stderr, status := run_safecp(t, dir, "dst", "restored", "--chunk-store=store", "--restore-chunks", "--commit"); status == 0 {
+		t.Errorf("a corrupt chunk was restored\n%s", stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "restored", "a")); !os.IsNotExist(err) {
+		t.Error("a partly restored file was left")
+	}
+}
+
+func TestChunkGC(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a", "b": "b"})
+	must_run(t, dir, "src", "dst", "--chunk-store=store", "--commit")
+	os.Remove(filepath.Join(dir, "dst", "b"))
+	out := must_run(t, dir, "dst", "--chunk-store=store", "--chunk-gc")
+	if !strings.Contains(out, "Found 1 unused chunks, 1 bytes") {
+		t.Errorf("--chunk-gc printed:\n%s", out)
+	}
+	must_run(t, dir, "dst", "--chunk-store=store", "--chunk-gc", "--commit")
+	must_run(t, dir, "dst", "restored", "--chunk-store=store", "--restore-chunks", "--commit")
+	if got := read_tree(t, filepath.Join(dir, "restored")); got["a"] != "a" {
+		t.Errorf("a chunk that is still used was removed: %v", got)
+	}
+}
+
+func TestRestoreChunksTakesTwoDirectories(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "dst"), map[string]string{"a": "a"})
+	_, stderr, status := run_safecp(t, dir, "dst", "--chunk-store=store", "--restore-chunks", "--commit")
+	if status == 0 || !strings.Contains(stderr, "--restore-chunks takes the directory with chunk lists and the target directory") {
+		t.Errorf("one directory gave status %d\n%s", status, stderr)
+	}
+}
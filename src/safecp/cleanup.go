@@ -0,0 +1,62 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Before executing the jobs (and after the --backup-dest snapshot), the
+// destination (and the --chunk-store) is searched for temporary files left
+// behind by an earlier run that was killed halfway an overwrite, and those
+// are removed, or only listed in a dry run. Only regular files whose name
+// starts with temp_prefix are touched, and only when they haven't been
+// written to for temp_cleanup_age, so that the temporary files of another
+// run still going on are left alone. Partial files in a --partial-dir are no
+// leftovers, they are resumed instead. --no-temp-cleanup skips the search.
+const temp_cleanup_age = time.Hour
+
+// leftover_temp tells whether f is a temporary file safecp left behind.
+func leftover_temp(f os.FileInfo) bool {
+	return f.Mode().IsRegular() && strings.HasPrefix(f.Name(), temp_prefix) &&
+		time.Since(f.ModTime()) > temp_cleanup_age
+}
+
+// clean_temps removes the leftover temporary files below dir.
+func clean_temps(dir string, commit bool) {
+	if _, err := os.Lstat(dir); os.IsNotExist(err) {
+		return
+	}
+	found := 0
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return tolerate(err, path)
+		}
+		if !leftover_temp(f) {
+			return nil
+		}
+		found++
+		info("Remove temporary file: %s\n", path)
+		if commit {
+			return tolerate(os.Remove(path), path)
+		}
+		return nil
+	})
+	if err != nil {
+		log_error("Error: %v. Bailing out!\n", err)
+		os.Exit(1)
+	}
+	switch {
+	case found == 0:
+	case commit:
+		notice("Removed %d temporary files left behind by an earlier run in %s\n", found, dir)
+	default:
+		notice("Found %d temporary files left behind by an earlier run in %s, they are removed with --commit\n", found, dir)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// temps_tree has a destination with an old and a fresh temporary file.
+func temps_tree(t *testing.T) string {
+	dir := t.TempDir()
+	old := "dst/sub/" + temp_prefix + "a-123"
+	write_tree(t, dir, map[string]string{"src/a": "a", old: "half", "dst/" + temp_prefix + "b-456": "busy", "dst/old": "x"})
+	long_ago := time.Now().Add(-2 * temp_cleanup_age)
+	os.Chtimes(filepath.Join(dir, filepath.FromSlash(old)), long_ago, long_ago)
+	os.Chtimes(filepath.Join(dir, "dst", "old"), long_ago, long_ago)
+	return dir
+}
+
+func TestCleanTemps(t *testing.T) {
+	dir := temps_tree(t)
+	out := must_run(t, dir, "src", "dst")
+	if !strings.Contains(out, "Found 1 temporary files left behind by an earlier run in dst") {
+		t.Errorf("the dry run printed:\n%s", out)
+	}
+	if got := read_tree(t, filepath.Join(dir, "dst")); len(got) != 3 {
+		t.Errorf("the dry run removed files, left %v", got)
+	}
+	must_run(t, dir, "src", "dst", "--commit")
+	// the fresh one may belong to a run that is still going on
+	same_names(t, read_tree(t, filepath.Join(dir, "dst")), "a", temp_prefix+"b-456", "old")
+}
+
+func TestNoTempCleanup(t *testing.T) {
+	dir := temps_tree(t)
+	out := must_run(t, dir, "src", "dst", "--no-temp-cleanup", "--commit")
+	if strings.Contains(out, "temporary files") {
+		t.Errorf("--no-temp-cleanup still looks for them:\n%s", out)
+	}
+	if got := read_tree(t, filepath.Join(dir, "dst")); len(got) != 4 {
+		t.Errorf("destination has %v", got)
+	}
+}
+
+func TestSnapshotBeforeTempCleanup(t *testing.T) {
+	dir := temps_tree(t)
+	must_run(t, dir, "src", "dst", "--backup-dest=dir", "--commit")
+	old := "sub/" + temp_prefix + "a-123"
+	backups, _ := filepath.Glob(filepath.Join(dir, "dst.backup-*"))
+	if len(backups) != 1 {
+		t.Fatalf("got backups %q", backups)
+	}
+	if got := read_tree(t, backups[0]); got[old] != "half" {
+		t.Errorf("the leftover temporary file was removed before the snapshot: %v", got)
+	}
+	if _, ok := read_tree(t, filepath.Join(dir, "dst"))[old]; ok {
+		t.Error("the leftover temporary file was not removed")
+	}
+}
@@ -0,0 +1,202 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// With --dedupe, files that are going to be copied and have the same content
+// are copied only once, the others become hard links to that canonical
+// copy. Which of them is the canonical one is decided by
+// --dedupe-canonical and never by the order in which the source was walked,
+// so repeated runs over the same tree give the same links:
+//
+//	first-path     the lexicographically smallest relative path (default)
+//	shortest-path  the shortest relative path, ties go to the smallest
+//
+// Content is compared with sha256 no matter what --hash says, a collision
+// here would link two different files together. All link jobs are moved to
+// the end of the plan so the canonical copy and every directory exist when
+// they run.
+
+// dedupe_jobs rewrites the copy jobs in the plan as described above.
+func dedupe_jobs(jobs *[]job) error {
+	copies := make([]int, 0)
+	sources := make([]string, 0)
+	for i, j := range *jobs {
+		if j.operation == "copy" {
+			copies = append(copies, i)
+			sources = append(sources, j.source)
+		}
+	}
+	found, _, err := duplicate_groups(sources)
+	if err != nil {
+		return err
+	}
+	groups := make([][]int, 0, len(found))
+	for _, group := range found {
+		for k, i := range group {
+			group[k] = copies[i]
+		}
+		groups = append(groups, group)
+	}
+	links := make(map[int]job)
+	for _, group := range groups {
+		canonical := canonical_copy(*jobs, group)
+		for _, i := range group {
+			if i == canonical {
+				continue
+			}
+			j := (*jobs)[i]
+			links[i] = job{operation: "link", source: (*jobs)[canonical].destination, destination: j.destination,
+				rel: j.rel, target: (*jobs)[canonical].rel, before: j.before}
+		}
+	}
+	if len(links) == 0 {
+		return nil
+	}
+	planned := make([]job, 0, len(*jobs))
+	moved := make([]job, 0, len(links))
+	for i, j := range *jobs {
+		if link, ok := links[i]; ok {
+			moved = append(moved, link)
+		} else {
+			planned = append(planned, j)
+		}
+	}
+	sort.Slice(moved, func(a, b int) bool { return moved[a].rel < moved[b].rel })
+	*jobs = append(planned, moved...)
+	return nil
+}
+
+// duplicate_groups returns the groups of paths with the same content, as
+// indexes into paths, and the size of the files in each group. Only files
+// of the same size are hashed.
+func duplicate_groups(paths []string) ([][]int, []int64, error) {
+	by_size := make(map[int64][]int)
+	for i, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			if err = tolerate(err, path); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		by_size[fi.Size()] = append(by_size[fi.Size()], i)
+	}
+	groups := make([][]int, 0)
+	sizes := make([]int64, 0)
+	for size, candidates := range by_size {
+		if len(candidates) < 2 {
+			continue
+		}
+		by_hash := make(map[string][]int)
+		for _, i := range candidates {
+			hash, err := hash_file(paths[i], "sha256")
+			if err != nil {
+				if err = tolerate(err, paths[i]); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			by_hash[hash] = append(by_hash[hash], i)
+		}
+		for _, group := range by_hash {
+			if len(group) > 1 {
+				groups = append(groups, group)
+				sizes = append(sizes, size)
+			}
+		}
+	}
+	return groups, sizes, nil
+}
+
+// canonical_copy returns which of the given copy jobs is kept as a copy,
+// according to --dedupe-canonical.
+func canonical_copy(jobs []job, group []int) int {
+	best := group[0]
+	for _, i := range group[1:] {
+		a, b := filepath.ToSlash(jobs[i].rel), filepath.ToSlash(jobs[best].rel)
+		if opts.dedupe_canonical == "shortest-path" && len(a) != len(b) {
+			if len(a) < len(b) {
+				best = i
+			}
+			continue
+		}
+		if a < b {
+			best = i
+		}
+	}
+	return best
+}
+
+// safecp --analyze-dedup <dir> copies nothing, it reports how much space
+// --dedupe (or any other deduplication) would save in dir: the size of all
+// regular files together minus that of their distinct contents, and the
+// groups of identical files that waste the most. Files that are hard links
+// of each other already share their space and count once.
+
+// dedupe_top_groups is how many of the groups are listed.
+const dedupe_top_groups = 10
+
+func analyze_dedup(dir string) {
+	paths := make([]string, 0)
+	seen := make(map[inode_key]bool)
+	total := int64(0)
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return tolerate(err, path)
+		}
+		if !f.Mode().IsRegular() {
+			return nil
+		}
+		if device, inode, _, ok := file_inode(f); ok {
+			if seen[inode_key{device, inode}] {
+				return nil
+			}
+			seen[inode_key{device, inode}] = true
+		}
+		paths = append(paths, path)
+		total += f.Size()
+		return nil
+	})
+	var groups [][]int
+	var sizes []int64
+	if err == nil {
+		groups, sizes, err = duplicate_groups(paths)
+	}
+	if err != nil {
+		log_error("Error: %v. Bailing out!\n", err)
+		os.Exit(1)
+	}
+	order := make([]int, len(groups))
+	saved := int64(0)
+	for g, group := range groups {
+		order[g] = g
+		saved += sizes[g] * int64(len(group)-1)
+		sort.Slice(group, func(a, b int) bool { return paths[group[a]] < paths[group[b]] })
+	}
+	wasted := func(g int) int64 { return sizes[g] * int64(len(groups[g])-1) }
+	sort.Slice(order, func(a, b int) bool {
+		if wasted(order[a]) != wasted(order[b]) {
+			return wasted(order[a]) > wasted(order[b])
+		}
+		return paths[groups[order[a]][0]] < paths[groups[order[b]][0]]
+	})
+	for _, g := range order[:min(len(order), dedupe_top_groups)] {
+		info("Duplicates: %d bytes in %d copies of %s\n", wasted(g), len(groups[g]), paths[groups[g][0]])
+	}
+	percent := 0.0
+	if total > 0 {
+		percent = 100 * float64(saved) / float64(total)
+	}
+	notice("Files: %d, %d bytes, %d bytes of them (%.1f%%) are duplicates, in %d groups\n",
+		len(paths), total, saved, percent, len(groups))
+	notice("Deduplicating would leave %d bytes\n", total-saved)
+}
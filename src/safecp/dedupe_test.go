@@ -0,0 +1,133 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// copy_jobs plans copying each of rels from src to dst, in that order.
+func copy_jobs(src string, dst string, rels ...string) []job {
+	jobs := make([]job, 0, len(rels))
+	for _, rel := range rels {
+		rel = filepath.FromSlash(rel)
+		jobs = append(jobs, job{operation: "copy", source: filepath.Join(src, rel), destination: filepath.Join(dst, rel), rel: rel})
+	}
+	return jobs
+}
+
+// describe_jobs returns "operation rel[ => target]" for every job.
+func describe_jobs(jobs []job) string {
+	lines := make([]string, 0, len(jobs))
+	for _, j := range jobs {
+		line := j.operation + " " + filepath.ToSlash(j.rel)
+		if j.target != "" {
+			line += " => " + filepath.ToSlash(j.target)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, ", ")
+}
+
+func TestDedupeJobs(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	write_tree(t, src, map[string]string{"z/long/copy": "same", "b": "same", "a": "other", "c": "same!"})
+	// the walk order doesn't decide which one is copied, links go last
+	cases := map[string]string{
+		"z/long/copy b a c": "copy b, copy a, copy c, link z/long/copy => b",
+		"a b c z/long/copy": "copy a, copy b, copy c, link z/long/copy => b",
+	}
+	for order, want := range cases {
+		jobs := copy_jobs(src, filepath.Join(dir, "dst"), strings.Fields(order)...)
+		if err := dedupe_jobs(&jobs); err != nil {
+			t.Fatal(err)
+		}
+		if got := describe_jobs(jobs); got != want {
+			t.Errorf("walking %s planned %s, want %s", order, got, want)
+		}
+	}
+}
+
+func TestDedupeShortestPath(t *testing.T) {
+	reset(t)
+	opts.dedupe_canonical = "shortest-path"
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	write_tree(t, src, map[string]string{"aaa/x": "same", "zz": "same"})
+	jobs := copy_jobs(src, filepath.Join(dir, "dst"), "aaa/x", "zz")
+	if err := dedupe_jobs(&jobs); err != nil {
+		t.Fatal(err)
+	}
+	if got := describe_jobs(jobs); got != "copy zz, link aaa/x => zz" {
+		t.Errorf("planned %s", got)
+	}
+	opts.dedupe_canonical = "first-path"
+	jobs = copy_jobs(src, filepath.Join(dir, "dst"), "aaa/x", "zz")
+	if err := dedupe_jobs(&jobs); err != nil {
+		t.Fatal(err)
+	}
+	if got := describe_jobs(jobs); got != "copy aaa/x, link zz => aaa/x" {
+		t.Errorf("planned %s", got)
+	}
+}
+
+func TestDedupeRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "same", "sub/b": "same", "c": "other"})
+	must_run(t, dir, "src", "dst", "--dedupe", "--commit")
+	dst := filepath.Join(dir, "dst")
+	if got := read_tree(t, dst); got["a"] != "same" || got["sub/b"] != "same" || got["c"] != "other" {
+		t.Fatalf("destination has %v", got)
+	}
+	a, _ := os.Stat(filepath.Join(dst, "a"))
+	b, _ := os.Stat(filepath.Join(dst, "sub", "b"))
+	c, _ := os.Stat(filepath.Join(dst, "c"))
+	if !os.SameFile(a, b) || os.SameFile(a, c) {
+		t.Error("identical files weren't linked, or different ones were")
+	}
+}
+
+func TestDedupeCanonicalNeedsDedupe(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a"})
+	if _, stderr, status := run_safecp(t, dir, "src", "dst", "--dedupe-canonical=shortest-path"); status == 0 || !strings.Contains(stderr, "only makes sense with --dedupe") {
+		t.Errorf("--dedupe-canonical without --dedupe gave status %d\n%s", status, stderr)
+	}
+}
+
+func TestAnalyzeDedup(t *testing.T) {
+	dir := t.TempDir()
+	big := "0123456789"
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"big1": big, "sub/big2": big, "big3": big, "small1": "ab", "small2": "ab", "unique": "u"})
+	// hard links already share their space
+	if err := os.Link(filepath.Join(dir, "src", "big1"), filepath.Join(dir, "src", "link")); err != nil {
+		t.Skip("cannot make hard links:", err)
+	}
+	out := must_run(t, dir, "--analyze-dedup", "src")
+	want := "Duplicates: 20 bytes in 3 copies of " + filepath.Join("src", "big1") + "\n" +
+		"Duplicates: 2 bytes in 2 copies of " + filepath.Join("src", "small1") + "\n" +
+		"Files: 6, 35 bytes, 22 bytes of them (62.9%) are duplicates, in 2 groups\n" +
+		"Deduplicating would leave 13 bytes\n"
+	if out != want {
+		t.Errorf("got\n%swant\n%s", out, want)
+	}
+}
+
+func TestAnalyzeDedupTakesOnlyTheDirectory(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a"})
+	if _, stderr, status := run_safecp(t, dir, "--analyze-dedup", "src", "dst"); status == 0 || !strings.Contains(stderr, "takes only the directory to analyze") {
+		t.Errorf("a target directory gave status %d\n%s", status, stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dst")); err == nil {
+		t.Error("the target directory was written")
+	}
+}
@@ -0,0 +1,158 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// With --diff nothing is copied, the source and destination trees are only
+// compared and every regular file that is not the same in both is listed:
+//
+//	Differs:             same path, other content
+//	Only in source:      not in the destination, maybe with the content of
+//	                     a destination file at another path
+//	Only in destination: the other way around
+//
+// Files can only have the same content when they have the same size, so all
+// files of both trees are first grouped by size, and only files in a size
+// group with files from both trees get hashed. In most trees that leaves
+// most files unhashed. The exit status is 1 when there are differences.
+
+type tree_file struct {
+	path      string
+	path_part string // path after the tree's directory, like in plan_path
+	size      int64
+}
+
+// list_tree returns the regular files under dir by relative path.
+func list_tree(dir string) (map[string]tree_file, error) {
+	files := make(map[string]tree_file)
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return tolerate(err, path)
+		}
+		if !f.Mode().IsRegular() || skip_by_size(f) {
+			return nil
+		}
+		path_part := path[len(dir):]
+		files[relative(path_part)] = tree_file{path, path_part, f.Size()}
+		return nil
+	})
+	return files, err
+}
+
+// diff_trees runs --diff and returns the exit status.
+func diff_trees(src_dir string, dest_dir string) int {
+	src, err := list_tree(src_dir)
+	if err == nil {
+		var dst map[string]tree_file
+		dst, err = list_tree(dest_dir)
+		if err == nil {
+			return compare_trees(src, dst)
+		}
+	}
+	log_error("Error: %v. Bailing out!\n", err)
+	return 1
+}
+
+func compare_trees(src map[string]tree_file, dst map[string]tree_file) int {
+	sides := make(map[int64][2]int)
+	for _, f := range src {
+		n := sides[f.size]
+		n[0]++
+		sides[f.size] = n
+	}
+	for _, f := range dst {
+		n := sides[f.size]
+		n[1]++
+		sides[f.size] = n
+	}
+	hashed := 0
+	hash := func(rel string, f tree_file, in_dest bool) string {
+		if n := sides[f.size]; n[0] == 0 || n[1] == 0 {
+			return ""
+		}
+		var h string
+		var err error
+		algorithm := hash_algorithm_for(rel)
+		if in_dest {
+			h, err = hash_dest(f.path, f.path_part, algorithm)
+		} else {
+			h, err = hash_file(f.path, algorithm)
+		}
+		if err = tolerate(err, f.path); err != nil {
+			log_error("Error: %v. Bailing out!\n", err)
+			os.Exit(1)
+		}
+		hashed++
+		return h
+	}
+	src_hashes := make(map[string]string)
+	dst_hashes := make(map[string]string)
+	src_by_hash := make(map[string]string)
+	dst_by_hash := make(map[string]string)
+	for _, rel := range sorted_keys(src) {
+		if h := hash(rel, src[rel], false); h != "" {
+			src_hashes[rel] = h
+			if _, ok := src_by_hash[h]; !ok {
+				src_by_hash[h] = rel
+			}
+		}
+	}
+	for _, rel := range sorted_keys(dst) {
+		if h := hash(rel, dst[rel], true); h != "" {
+			dst_hashes[rel] = h
+			if _, ok := dst_by_hash[h]; !ok {
+				dst_by_hash[h] = rel
+			}
+		}
+	}
+	differ, only_src, only_dst := 0, 0, 0
+	for _, rel := range sorted_keys(src) {
+		d, ok := dst[rel]
+		switch {
+		case ok && (d.size != src[rel].size || src_hashes[rel] != dst_hashes[rel]):
+			differ++
+			info("Differs:             %s\n", portable(rel))
+		case !ok:
+			only_src++
+			if other, found := dst_by_hash[src_hashes[rel]]; found && src_hashes[rel] != "" {
+				info("Only in source:      %s (same content as %s in the destination)\n", portable(rel), portable(other))
+			} else {
+				info("Only in source:      %s\n", portable(rel))
+			}
+		}
+	}
+	for _, rel := range sorted_keys(dst) {
+		if _, ok := src[rel]; ok {
+			continue
+		}
+		only_dst++
+		if other, found := src_by_hash[dst_hashes[rel]]; found && dst_hashes[rel] != "" {
+			info("Only in destination: %s (same content as %s in the source)\n", portable(rel), portable(other))
+		} else {
+			info("Only in destination: %s\n", portable(rel))
+		}
+	}
+	notice("Compared %d source and %d destination files, hashed %d of them\n", len(src), len(dst), hashed)
+	notice("%d differ, %d only in the source, %d only in the destination\n", differ, only_src, only_dst)
+	if differ+only_src+only_dst > 0 {
+		return 1
+	}
+	return 0
+}
+
+func sorted_keys(files map[string]tree_file) []string {
+	keys := make([]string, 0, len(files))
+	for rel := range files {
+		keys = append(keys, rel)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,98 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"same": "same", "differs": "one", "moved/new": "moved", "only_src": "only in source!"})
+	write_tree(t, filepath.Join(dir, "dst"), map[string]string{"same": "same", "differs": "two", "old": "moved", "only_dst": "only in the destination"})
+	stdout, stderr, status := run_safecp(t, dir, "src", "dst", "--diff")
+	if status != 1 {
+		t.Fatalf("exit status %d with differences\n%s%s", status, stdout, stderr)
+	}
+	for _, line := range []string{
+		"Differs:             differs\n",
+		"Only in source:      moved/new (same content as old in the destination)\n",
+		"Only in source:      only_src\n",
+		"Only in destination: old (same content as moved/new in the source)\n",
+		"Only in destination: only_dst\n",
+		"1 differ, 2 only in the source, 2 only in the destination\n",
+	} {
+		if !strings.Contains(stdout, line) {
+			t.Errorf("output has no %q:\n%s", line, stdout)
+		}
+	}
+	if strings.Contains(stdout, " same\n") {
+		t.Errorf("identical files are listed:\n%s", stdout)
+	}
+}
+
+func TestDiffHashesOnlyMatchingSizes(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a", "b": "longer"})
+	write_tree(t, filepath.Join(dir, "dst"), map[string]string{"a": "a", "c": "even longer"})
+	stdout, _, _ := run_safecp(t, dir, "src", "dst", "--diff")
+	if !strings.Contains(stdout, "Compared 2 source and 2 destination files, hashed 2 of them") {
+		t.Errorf("files without a size match were hashed:\n%s", stdout)
+	}
+}
+
+func TestDiffSameTrees(t *testing.T) {
+	dir := t.TempDir()
+	tree := map[string]string{"a": "a", "sub/b": "b"}
+	write_tree(t, filepath.Join(dir, "src"), tree)
+	write_tree(t, filepath.Join(dir, "dst"), tree)
+	out := must_run(t, dir, "src", "dst", "--diff")
+	if !strings.Contains(out, "0 differ, 0 only in the source, 0 only in the destination") {
+		t.Errorf("identical trees gave:\n%s", out)
+	}
+	if _, stderr, status := run_safecp(t, dir, "src", "dst", "--diff", "--commit"); status == 0 || !strings.Contains(stderr, "--diff only compares") {
+		t.Errorf("--diff --commit gave status %d\n%s", status, stderr)
+	}
+}
+
+// BenchmarkCompareTrees compares trees in which nearly every file has a size
+// of its own, so that hardly anything needs to be hashed.
+func BenchmarkCompareTrees(b *testing.B) {
+	reset(b)
+	dir := b.TempDir()
+	const files = 1000
+	src_files, dst_files := make(map[string]string), make(map[string]string)
+	for i := 0; i < files; i++ {
+		rel := fmt.Sprintf("d%02d/f%04d", i%50, i)
+		src_files[rel] = strings.Repeat("x", i+1)
+		dst_files[rel] = strings.Repeat("y", files+i+1)
+		if i%10 == 0 {
+			dst_files[rel] = src_files[rel]
+		}
+	}
+	write_tree(b, filepath.Join(dir, "src"), src_files)
+	write_tree(b, filepath.Join(dir, "dst"), dst_files)
+	src, err := list_tree(filepath.Join(dir, "src"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	dst, err := list_tree(filepath.Join(dir, "dst"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	// the lines about every file are not what is measured
+	stdout := os.Stdout
+	os.Stdout, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	b.Cleanup(func() { os.Stdout.Close(); os.Stdout = stdout })
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		compare_trees(src, dst)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tolerate returns err unless it matches one of the --ignore-error
+// patterns, in which case it is printed as a warning, recorded for the
+// summary and nil is returned. A pattern matches when the error message
+// contains it, or when it is a glob matching one of the given paths (or
+// their base name). Paths are matched relative to source_dir or target_dir,
+// whichever they are in, with / as separator.
+func tolerate(err error, paths ...string) error {
+	if err == nil || !ignorable(err, paths) {
+		return err
+	}
+	warning("ignoring error: %v", err)
+	stats.Lock()
+	stats.ignored_errors = append(stats.ignored_errors, err.Error())
+	stats.Unlock()
+	return nil
+}
+
+// fail handles an error that executing a job ran into (after tolerate()).
+// Without --keep-going it stops the run right away. With it the error is
+// printed and counted and the run continues, until --max-errors errors have
+// happened: something systemic like a destination that became read-only is
+// assumed then and the run is aborted.
+func fail(err error) {
+	if !opts.keep_going {
+		panic(err)
+	}
+	log_error("Error: %v\n", err)
+	stats.Lock()
+	stats.failed = append(stats.failed, err.Error())
+	n := len(stats.failed)
+	stats.Unlock()
+	if opts.max_errors > 0 && n >= opts.max_errors {
+		log_error("Aborting: %d errors, the --max-errors threshold was reached\n", n)
+		print_summary()
+		os.Exit(1)
+	}
+}
+
+// vanished returns nil for an error caused by source having been deleted
+// since the walk found it, when --tolerate-vanished is used. It prints a
+// warning and counts it then. A missing destination directory gives the
+// same error, which is why source itself is checked.
+func vanished(err error, source string) error {
+	if err == nil || !opts.tolerate_vanished || !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if _, serr := os.Lstat(source); !os.IsNotExist(serr) {
+		return err
+	}
+	warning("file has vanished: %s", source)
+	stats.Lock()
+	stats.vanished++
+	stats.Unlock()
+	return nil
+}
+
+// error_roots are the directories the paths of errors are relative to for
+// --ignore-error: source_dir, target_dir and the staging tree of
+// --atomic-swap.
+var error_roots []string
+
+// error_path returns path relative to the error root it is in, or path
+// itself when it is in none of them.
+func error_path(path string) string {
+	for _, root := range error_roots {
+		rel, err := filepath.Rel(root, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return path
+}
+
+func ignorable(err error, paths []string) bool {
+	for _, pattern := range opts.ignore_errors {
+		if strings.Contains(err.Error(), pattern) {
+			return true
+		}
+		for _, path := range paths {
+			if match_glob(pattern, error_path(path)) || match_glob(pattern, filepath.Base(path)) {
+				return true
+			}
+		}
+	}
+	return false
+}
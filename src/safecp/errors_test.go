@@ -0,0 +1,172 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTolerate(t *testing.T) {
+	reset(t)
+	src := filepath.Join("data", "src")
+	error_roots = []string{src}
+	t.Cleanup(func() { error_roots = nil })
+	opts.ignore_errors = []string{"private/*", "device busy"}
+	denied := func(rel string) error {
+		return &os.PathError{Op: "open", Path: filepath.Join(src, rel), Err: os.ErrPermission}
+	}
+	cases := []struct {
+		err     error
+		path    string
+		ignored bool
+	}{
+		{denied("private/key"), "private/key", true},
+		{denied("public/key"), "public/key", false},
+		{denied("private/sub/key"), "private/sub/key", false},
+		{os.ErrNotExist, "anything", false},
+		{&os.PathError{Op: "rename", Path: "x", Err: os.ErrExist}, "x", false},
+		{&os.PathError{Op: "remove", Path: "x", Err: errors.New("device busy")}, "x", true},
+	}
+	for _, c := range cases {
+		err := tolerate(c.err, filepath.Join(src, filepath.FromSlash(c.path)))
+		if (err == nil) != c.ignored {
+			t.Errorf("tolerate(%v) = %v, ignored should be %v", c.err, err, c.ignored)
+		}
+	}
+	if len(stats.ignored_errors) != 2 {
+		t.Errorf("recorded %d ignored errors, want 2: %q", len(stats.ignored_errors), stats.ignored_errors)
+	}
+}
+
+func TestIgnoreErrorMatchesBaseName(t *testing.T) {
+	reset(t)
+	opts.ignore_errors = []string{"*.tmp"}
+	if tolerate(os.ErrPermission, filepath.Join("src", "sub", "x.tmp")) != nil {
+		t.Error("*.tmp doesn't match sub/x.tmp by its base name")
+	}
+}
+
+func TestIgnoreErrorKeepsOtherErrorsFatal(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"ok": "x", "skip/": "", "keep/": ""})
+	if err := os.Symlink("missing", filepath.Join(dir, "src", "skip", "link")); err != nil {
+		t.Skip("cannot make symlinks:", err)
+	}
+	must_run(t, dir, "src", "dst", "--links=follow", "--ignore-error=skip/link")
+	if err := os.Symlink("missing", filepath.Join(dir, "src", "keep", "link")); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, status := run_safecp(t, dir, "src", "dst", "--links=follow", "--ignore-error=skip/link")
+	if status == 0 || !strings.Contains(stderr, "Bailing out") {
+		t.Errorf("an error outside the pattern didn't stop the run: %d\n%s%s", status, stdout, stderr)
+	}
+}
+
+func TestIgnoredErrorsAreSummarized(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"sub/": ""})
+	if err := os.Symlink("missing", filepath.Join(dir, "src", "sub", "link")); err != nil {
+		t.Skip("cannot make symlinks:", err)
+	}
+	out := must_run(t, dir, "src", "dst", "--links=follow", "--ignore-error=no such file")
+	if !strings.Contains(out, "Ignored 1 errors:") {
+		t.Errorf("the summary doesn't list the ignored error:\n%s", out)
+	}
+}
+
+func TestFailWithoutKeepGoingPanics(t *testing.T) {
+	reset(t)
+	defer func() {
+		if recover() == nil {
+			t.Error("fail() returned without --keep-going")
+		}
+	}()
+	fail(errors.New("disk on fire"))
+}
+
+func TestFailWithKeepGoingCounts(t *testing.T) {
+	reset(t)
+	opts.keep_going = true
+	fail(errors.New("one"))
+	fail(errors.New("two"))
+	if strings.Join(stats.failed, " ") != "one two" {
+		t.Errorf("recorded failures %q", stats.failed)
+	}
+}
+
+func TestKeepGoingRun(t *testing.T) {
+	store, url := new_object_store(t)
+	store.refuse = "bad"
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a", "bad1": "x", "bad2": "y", "c": "c"})
+	stdout, stderr, status := run_safecp(t, dir, "src", "--to-http="+url, "--http-jobs=1", "--commit")
+	if status == 0 || !strings.Contains(stderr, "403") {
+		t.Errorf("a refused upload without --keep-going gave status %d\n%s%s", status, stdout, stderr)
+	}
+	store.reset()
+	stdout, stderr, status = run_safecp(t, dir, "src", "--to-http="+url, "--keep-going", "--commit")
+	if status != 1 || !strings.Contains(stdout, "Failed 2 jobs:") {
+		t.Errorf("--keep-going gave status %d\n%s%s", status, stdout, stderr)
+	}
+	if store.get("/a") != "a" || store.get("/c") != "c" {
+		t.Errorf("--keep-going didn't upload the other files: a %q, c %q", store.get("/a"), store.get("/c"))
+	}
+}
+
+func TestMaxErrors(t *testing.T) {
+	store, url := new_object_store(t)
+	store.refuse = "bad"
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"bad1": "x", "bad2": "y", "bad3": "z"})
+	_, stderr, status := run_safecp(t, dir, "src", "--to-http="+url, "--keep-going", "--max-errors=2", "--http-jobs=1", "--commit")
+	if status != 1 || !strings.Contains(stderr, "Aborting: 2 errors") {
+		t.Errorf("--max-errors=2 gave status %d\n%s", status, stderr)
+	}
+	if _, stderr, status := run_safecp(t, dir, "src", "dst", "--max-errors=2"); status == 0 || !strings.Contains(stderr, "only makes sense with --keep-going") {
+		t.Errorf("--max-errors without --keep-going gave status %d\n%s", status, stderr)
+	}
+}
+
+func TestVanished(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"there": "x"})
+	gone := &os.PathError{Op: "open", Path: filepath.Join(dir, "gone"), Err: os.ErrNotExist}
+	if vanished(gone, filepath.Join(dir, "gone")) == nil {
+		t.Error("a vanished file is tolerated without --tolerate-vanished")
+	}
+	opts.tolerate_vanished = true
+	if err := vanished(gone, filepath.Join(dir, "gone")); err != nil {
+		t.Errorf("a vanished file gave %v", err)
+	}
+	// the source is there, so the destination directory is missing
+	if vanished(gone, filepath.Join(dir, "there")) == nil {
+		t.Error("a missing destination directory is tolerated")
+	}
+	if vanished(os.ErrPermission, filepath.Join(dir, "gone")) == nil {
+		t.Error("another error is tolerated")
+	}
+	if stats.vanished != 1 {
+		t.Errorf("counted %d vanished files, want 1", stats.vanished)
+	}
+}
+
+func TestVanishedDuringCopy(t *testing.T) {
+	reset(t)
+	opts.tolerate_vanished = true
+	forget_completed(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src/": "", "dst/": ""})
+	jobs := copy_jobs(filepath.Join(dir, "src"), filepath.Join(dir, "dst"), "planned-but-gone")
+	run_job(jobs[0], true)
+	if stats.vanished != 1 || len(completed_jobs(jobs)) != 0 {
+		t.Errorf("counted %d vanished files and %d completed jobs", stats.vanished, len(completed_jobs(jobs)))
+	}
+}
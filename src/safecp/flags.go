@@ -0,0 +1,107 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// With --preserve-flags the inode flags of the source (what chattr sets, like
+// immutable or append-only) are applied to everything safecp writes to the
+// destination. They are only applied after all jobs are done, an immutable
+// directory can't get new entries and an immutable file can't get new
+// content or metadata.
+
+// the user modifiable flags from linux/fs.h, in the order lsattr shows them
+var inode_flag_letters = []struct {
+	flag   uint32
+	letter byte
+}{
+	{0x00000001, 's'}, // secure deletion
+	{0x00000002, 'u'}, // undelete
+	{0x00000004, 'c'}, // compress
+	{0x00000008, 'S'}, // synchronous updates
+	{0x00010000, 'D'}, // synchronous directory updates
+	{0x00000010, 'i'}, // immutable
+	{0x00000020, 'a'}, // append only
+	{0x00000040, 'd'}, // no dump
+	{0x00000080, 'A'}, // no atime updates
+	{0x00004000, 'j'}, // data journalling
+	{0x00008000, 't'}, // no tail merging
+	{0x00020000, 'T'}, // top of directory hierarchy
+	{0x00800000, 'C'}, // no copy on write
+	{0x20000000, 'P'}, // project hierarchy
+}
+
+var inode_flags_mask = func() uint32 {
+	var mask uint32
+	for _, f := range inode_flag_letters {
+		mask |= f.flag
+	}
+	return mask
+}()
+
+func format_inode_flags(flags uint32) string {
+	var b strings.Builder
+	for _, f := range inode_flag_letters {
+		if flags&f.flag != 0 {
+			b.WriteByte(f.letter)
+		}
+	}
+	return b.String()
+}
+
+var deferred_flags struct {
+	sync.Mutex
+	paths []string
+	flags []uint32
+}
+
+// remember_flags reads the flags of src so they can be applied to dst at the
+// end of the run.
+func remember_flags(src string, dst string) error {
+	if !opts.preserve_flags {
+		return nil
+	}
+	flags, err := get_inode_flags(src)
+	if err != nil {
+		return err
+	}
+	if flags&inode_flags_mask == 0 {
+		return nil
+	}
+	deferred_flags.Lock()
+	deferred_flags.paths = append(deferred_flags.paths, dst)
+	deferred_flags.flags = append(deferred_flags.flags, flags&inode_flags_mask)
+	deferred_flags.Unlock()
+	return nil
+}
+
+// apply_deferred_flags sets the remembered flags. Setting some of them (like
+// immutable) requires privileges, without those that is a warning, or an
+// error with --strict.
+func apply_deferred_flags(commit bool) error {
+	for i, path := range deferred_flags.paths {
+		flags := deferred_flags.flags[i]
+		info("Set flags: %s (%s)\n", path, format_inode_flags(flags))
+		if !commit {
+			continue
+		}
+		current, err := get_inode_flags(path)
+		if err == nil {
+			err = set_inode_flags(path, current&^inode_flags_mask|flags)
+		}
+		if err != nil {
+			if opts.strict {
+				return fmt.Errorf("cannot set flags on %s: %v", path, err)
+			}
+			warning("cannot set flags on %s: %v", path, err)
+		}
+	}
+	return nil
+}
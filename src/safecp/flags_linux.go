@@ -0,0 +1,56 @@
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x)
+
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const inode_flags_supported = true
+
+// FS_IOC_GETFLAGS and FS_IOC_SETFLAGS, which are _IOR('f', 1, long) and
+// _IOW('f', 2, long), in the ioctl encoding these architectures share.
+var (
+	fs_ioc_getflags = uintptr(2<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 1)
+	fs_ioc_setflags = uintptr(1<<30 | unsafe.Sizeof(uintptr(0))<<16 | 'f'<<8 | 2)
+)
+
+// get_inode_flags returns the flags of path, a filesystem that doesn't have
+// them gives none.
+func get_inode_flags(path string) (uint32, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	// the kernel reads and writes an int, despite what the ioctl says
+	var flags uint32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fs_ioc_getflags, uintptr(unsafe.Pointer(&flags)))
+	if errno == syscall.ENOTTY || errno == syscall.ENOTSUP || errno == syscall.EINVAL {
+		return 0, nil
+	}
+	if errno != 0 {
+		return 0, &os.PathError{Op: "getflags", Path: path, Err: errno}
+	}
+	return flags, nil
+}
+
+func set_inode_flags(path string, flags uint32) error {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), fs_ioc_setflags, uintptr(unsafe.Pointer(&flags)))
+	if errno != 0 {
+		return &os.PathError{Op: "setflags", Path: path, Err: errno}
+	}
+	return nil
+}
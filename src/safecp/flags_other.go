@@ -0,0 +1,22 @@
+//go:build !linux || !(386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x)
+
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import "errors"
+
+const inode_flags_supported = false
+
+var errNoInodeFlags = errors.New("inode flags are not supported on this platform")
+
+func get_inode_flags(path string) (uint32, error) {
+	return 0, errNoInodeFlags
+}
+
+func set_inode_flags(path string, flags uint32) error {
+	return errNoInodeFlags
+}
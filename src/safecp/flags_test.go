@@ -0,0 +1,64 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// no_atime is the A flag, which the owner of a file may set.
+const no_atime = 0x00000080
+
+func TestFormatInodeFlags(t *testing.T) {
+	cases := map[uint32]string{0: "", 0x10: "i", 0x30: "ia", 0x10 | 0x80 | 0x1: "siA", 0x80000000: ""}
+	for flags, want := range cases {
+		if got := format_inode_flags(flags); got != want {
+			t.Errorf("format_inode_flags(%#x) = %q, want %q", flags, got, want)
+		}
+	}
+}
+
+func TestRememberFlagsOnlyWithPreserveFlags(t *testing.T) {
+	reset(t)
+	t.Cleanup(func() { deferred_flags.paths, deferred_flags.flags = nil, nil })
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src": "x"})
+	if err := remember_flags(filepath.Join(dir, "src"), filepath.Join(dir, "dst")); err != nil || len(deferred_flags.paths) != 0 {
+		t.Errorf("remembered %q (%v) without --preserve-flags", deferred_flags.paths, err)
+	}
+}
+
+func TestPreserveFlags(t *testing.T) {
+	if !inode_flags_supported {
+		t.Skip("no inode flags on this platform")
+	}
+	reset(t)
+	t.Cleanup(func() { deferred_flags.paths, deferred_flags.flags = nil, nil })
+	opts.preserve_flags = true
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src": "x", "dst": "x"})
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	flags, err := get_inode_flags(src)
+	if err == nil {
+		err = set_inode_flags(src, flags|no_atime)
+	}
+	if err != nil {
+		t.Skip("the filesystem of the test directory has no inode flags:", err)
+	}
+	if err := remember_flags(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := get_inode_flags(dst); got&no_atime != 0 {
+		t.Fatal("the flags were applied right away instead of at the end")
+	}
+	if err := apply_deferred_flags(true); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := get_inode_flags(dst); got&no_atime == 0 {
+		t.Errorf("destination has flags %s, want A", format_inode_flags(got))
+	}
+}
@@ -0,0 +1,42 @@
+//go:build linux
+
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import "syscall"
+
+// filesystem magic numbers from linux/magic.h
+const (
+	tmpfs_magic = 0x01021994
+	ramfs_magic = 0x858458f6
+)
+
+// probe_volatile_filesystem tells whether path is on a filesystem that only
+// lives in memory, and if so which one.
+func probe_volatile_filesystem(path string) (string, bool, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return "", false, err
+	}
+	switch uint32(st.Type) {
+	case tmpfs_magic:
+		return "tmpfs", true, nil
+	case ramfs_magic:
+		return "ramfs", true, nil
+	}
+	return "", false, nil
+}
+
+// probe_name_max returns the longest file name the filesystem of path
+// allows, or 0 when that can't be found out.
+func probe_name_max(path string) int {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0
+	}
+	return int(st.Namelen)
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+// probe_volatile_filesystem can't tell on this platform, so nothing is
+// reported as volatile.
+func probe_volatile_filesystem(path string) (string, bool, error) {
+	return "", false, nil
+}
+
+// probe_name_max can't tell on this platform.
+func probe_name_max(path string) int {
+	return 0
+}
@@ -0,0 +1,52 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// match_glob matches name against a glob pattern with the syntax of
+// filepath.Match, plus ** as a whole path segment, which matches zero or
+// more segments: **/*.log matches a.log and logs/2024/a.log, logs/** matches
+// everything below logs (and logs itself), and a/**/b matches a/b and
+// a/x/y/b. Within a segment, like in a**b, ** is the same as *. Both / and
+// the separator of the platform separate segments, also in patterns without
+// **, so a pattern means the same on every platform.
+func match_glob(pattern string, name string) bool {
+	pattern, name = filepath.ToSlash(pattern), filepath.ToSlash(name)
+	if !strings.Contains(pattern, "**") {
+		m, _ := path.Match(pattern, name)
+		return m
+	}
+	return match_segments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func match_segments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for len(pattern) > 1 && pattern[1] == "**" {
+				pattern = pattern[1:]
+			}
+			for i := 0; i <= len(name); i++ {
+				if match_segments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if m, err := path.Match(pattern[0], name[0]); err != nil || !m {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
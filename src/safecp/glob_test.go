@@ -0,0 +1,89 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		// ** at the start
+		{"**/*.log", "a.log", true},
+		{"**/*.log", "logs/2024/a.log", true},
+		{"**/*.log", "logs/a.txt", false},
+		// in the middle
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**/b", "a/x/y/c", false},
+		{"a/**/b", "x/a/b", false},
+		// at the end
+		{"logs/**", "logs", true},
+		{"logs/**", "logs/2024/a.log", true},
+		{"logs/**", "other/a.log", false},
+		{"**", "anything/at/all", true},
+		{"a/**/**/b", "a/b", true},
+		// within a segment ** is *
+		{"a**b", "axxb", true},
+		{"a**b", "ax/xb", false},
+		// without ** it is filepath.Match, with / as separator everywhere
+		{"*.log", "a.log", true},
+		{"*.log", "logs/a.log", false},
+		{"logs/*.log", "logs/a.log", true},
+		{"logs/[ab].log", "logs/c.log", false},
+	}
+	for _, c := range cases {
+		if got := match_glob(c.pattern, c.name); got != c.want {
+			t.Errorf("match_glob(%q, %q) = %v, want %v", c.pattern, c.name, got, c.want)
+		}
+		// the separator of the platform works the same
+		if got := match_glob(filepath.FromSlash(c.pattern), filepath.FromSlash(c.name)); got != c.want {
+			t.Errorf("match_glob(%q, %q) = %v, want %v", filepath.FromSlash(c.pattern), filepath.FromSlash(c.name), got, c.want)
+		}
+	}
+}
+
+func TestErrorPath(t *testing.T) {
+	src, dst := filepath.Join("data", "src"), filepath.Join("data", "dst")
+	error_roots = []string{src, dst}
+	t.Cleanup(func() { error_roots = nil })
+	cases := map[string]string{
+		filepath.Join(src, "a", "b"):       "a/b",
+		filepath.Join(dst, "c"):            "c",
+		filepath.Join("data", "src-other"): filepath.Join("data", "src-other"),
+		filepath.Join("elsewhere", "x"):    filepath.Join("elsewhere", "x"),
+	}
+	for path, want := range cases {
+		if got := error_path(path); got != want {
+			t.Errorf("error_path(%s) = %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestIgnoreErrorDoublestar(t *testing.T) {
+	reset(t)
+	src := filepath.Join("data", "src")
+	error_roots = []string{src}
+	t.Cleanup(func() { error_roots = nil })
+	opts.ignore_errors = []string{"cache/**", "**/*.lock"}
+	err := &os.PathError{Op: "open", Path: "x", Err: errors.New("permission denied")}
+	for rel, want := range map[string]bool{"cache/a/b": true, "deep/dir/x.lock": true, "deep/cache/a": false} {
+		if got := tolerate(err, filepath.Join(src, filepath.FromSlash(rel))) == nil; got != want {
+			t.Errorf("ignored an error for %s: %v, want %v", rel, got, want)
+		}
+	}
+	if !strings.Contains(strings.Join(stats.ignored_errors, " "), "permission denied") {
+		t.Errorf("recorded %q", stats.ignored_errors)
+	}
+}
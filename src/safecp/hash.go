@@ -0,0 +1,77 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// hashers are the algorithms that can be picked with --hash and --hash-for.
+// crc32 (Castagnoli) is the cheap one, good enough to detect changes but not
+// meant for integrity checking.
+var hashers = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"crc32":  func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+}
+
+func hasher_names() string {
+	names := make([]string, 0, len(hashers))
+	for name := range hashers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func check_hasher(name string) error {
+	if _, ok := hashers[name]; !ok {
+		return fmt.Errorf("unknown hash algorithm %q, use one of: %s", name, hasher_names())
+	}
+	return nil
+}
+
+// parse_hash_for parses a --hash-for value like ".mp4=crc32,.conf=sha256"
+// into opts.hash_for, extensions are matched case insensitively.
+func parse_hash_for(value string) error {
+	if opts.hash_for == nil {
+		opts.hash_for = make(map[string]string)
+	}
+	for _, part := range strings.Split(value, ",") {
+		ext, algorithm, ok := strings.Cut(part, "=")
+		if !ok || !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("invalid --hash-for entry %q, expected .EXT=ALGORITHM", part)
+		}
+		if err := check_hasher(algorithm); err != nil {
+			return err
+		}
+		opts.hash_for[strings.ToLower(ext)] = algorithm
+	}
+	return nil
+}
+
+// hash_algorithm_for returns the algorithm used to compare the given file,
+// which is the --hash-for override for its extension or else --hash.
+func hash_algorithm_for(path string) string {
+	if algorithm, ok := opts.hash_for[strings.ToLower(filepath.Ext(path))]; ok {
+		return algorithm
+	}
+	if opts.hash != "" {
+		return opts.hash
+	}
+	return "md5"
+}
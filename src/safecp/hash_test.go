@@ -0,0 +1,70 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestHashAlgorithmFor(t *testing.T) {
+	reset(t)
+	if got := hash_algorithm_for("a.txt"); got != "md5" {
+		t.Errorf("default algorithm is %s, want md5", got)
+	}
+	opts.hash = "sha256"
+	if err := parse_hash_for(".MP4=crc32,.conf=sha1"); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{"movie.mp4": "crc32", "MOVIE.Mp4": "crc32", "x.conf": "sha1", "x.txt": "sha256", "noext": "sha256"}
+	for path, want := range cases {
+		if got := hash_algorithm_for(path); got != want {
+			t.Errorf("hash_algorithm_for(%s) = %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestParseHashForRejectsBadEntries(t *testing.T) {
+	reset(t)
+	for _, value := range []string{"mp4=crc32", ".mp4", ".mp4=whirlpool"} {
+		if err := parse_hash_for(value); err == nil {
+			t.Errorf("--hash-for=%s is accepted", value)
+		}
+	}
+}
+
+func TestHashFile(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"f": "abc"})
+	want := map[string]string{
+		"md5":    "900150983cd24fb0d6963f7d28e17f72",
+		"sha1":   "a9993e364706816aba3e25717850c26c9cd0d89d",
+		"sha256": "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		"crc32":  "364b3fb7",
+	}
+	for algorithm, hash := range want {
+		got, err := hash_file(filepath.Join(dir, "f"), algorithm)
+		if err != nil || got != hash {
+			t.Errorf("%s of abc is %s (%v), want %s", algorithm, got, err, hash)
+		}
+	}
+}
+
+func TestHashOptionRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a.bin": "new", "b.txt": "same"})
+	write_tree(t, filepath.Join(dir, "dst"), map[string]string{"a.bin": "old", "b.txt": "same"})
+	stdout, stderr, status := run_safecp(t, dir, "src", "dst", "--hash=sha256", "--hash-for=.bin=crc32")
+	// a crc32 is 8 hex digits
+	if status == 0 || !regexp.MustCompile(`Hashes are NOT the same: [0-9a-f]{8} and [0-9a-f]{8}\n`).MatchString(stderr) {
+		t.Errorf("a.bin wasn't compared by crc32: %d\n%s%s", status, stdout, stderr)
+	}
+	if _, _, status := run_safecp(t, dir, "src", "dst", "--hash=whirlpool"); status == 0 {
+		t.Error("an unknown --hash is accepted")
+	}
+}
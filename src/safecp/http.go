@@ -0,0 +1,190 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// With --to-http=URL the destination is not a directory but an HTTP server,
+// every source file is PUT to URL/relative/path. Before that a HEAD request
+// tells whether the file is there already, and if so its ETag is compared to
+// the md5 of the source (which is what S3 like stores return for plain
+// uploads). An ETag that isn't an md5 can't be compared, such files are
+// skipped with a warning unless --overwrite is used.
+//
+// Every PUT carries a Content-MD5 header so the server can check what it got.
+// For authentication headers can be added with --http-header="Name: value",
+// or the Authorization header can be passed in the SAFECP_HTTP_AUTHORIZATION
+// environment variable, which keeps it out of the process list.
+
+// upload_url returns where the file at rel (relative to the source dir) goes.
+func upload_url(base string, rel string) string {
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.TrimRight(base, "/") + "/" + strings.TrimLeft(strings.Join(segments, "/"), "/")
+}
+
+func new_http_request(method string, target string, body io.ReadCloser) (*http.Request, error) {
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Body = body
+	}
+	for _, header := range opts.http_headers {
+		name, value, _ := strings.Cut(header, ":")
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if auth := os.Getenv("SAFECP_HTTP_AUTHORIZATION"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	return req, nil
+}
+
+func prepare_upload(src_dir string, base string, jobs *[]job) {
+	walk_source(src_dir, base, jobs, func(path string, f os.FileInfo, err error, jobs *[]job) error {
+		if err != nil {
+			return tolerate(err, path)
+		}
+		if f.IsDir() || skip_by_size(f) {
+			return nil
+		}
+		return plan_upload(path, relative(path[len(src_dir):]), upload_url(base, path[len(src_dir):]), jobs)
+	})
+}
+
+// plan_upload decides whether path has to be uploaded to target.
+func plan_upload(path string, rel string, target string, jobs *[]job) error {
+	req, err := new_http_request(http.MethodHead, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return tolerate(err, path)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		add_job(jobs, job{operation: "put", source: path, destination: target, rel: rel})
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return tolerate(fmt.Errorf("HEAD %s: %s", target, resp.Status), path)
+	}
+	etag := strings.Trim(strings.TrimPrefix(resp.Header.Get("ETag"), "W/"), `"`)
+	if _, err := hex.DecodeString(etag); err != nil || len(etag) != 32 {
+		if opts.overwrite {
+			add_job(jobs, job{operation: "put", source: path, destination: target, rel: rel})
+		} else {
+			warning("cannot compare %s with %s, it has no md5 ETag, skipping", path, target)
+		}
+		return nil
+	}
+	hash_src, err := hash_file(path, "md5")
+	if err != nil {
+		return tolerate(err, path)
+	}
+	if hash_src != strings.ToLower(etag) {
+		if !opts.overwrite {
+			return &hash_mismatch{path, target, hash_src, etag}
+		}
+		add_job(jobs, job{operation: "put", source: path, destination: target, rel: rel})
+	}
+	return nil
+}
+
+// execute_upload runs the put jobs with --http-jobs uploads at a time.
+func execute_upload(jobs []job, commit bool) {
+	n := opts.http_jobs
+	if n < 1 {
+		n = 4
+	}
+	var wg sync.WaitGroup
+	var failed struct {
+		sync.Mutex
+		err error
+	}
+	slots := make(chan struct{}, n)
+	for _, job := range jobs {
+		announce(job, "Upload:    %s -> %s\n", job.source, job.destination)
+		if !commit {
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(source string, target string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			err := tolerate(put_file(source, target), source)
+			if err != nil && opts.keep_going {
+				fail(err)
+			} else if err != nil {
+				failed.Lock()
+				if failed.err == nil {
+					failed.err = err
+				}
+				failed.Unlock()
+			}
+		}(job.source, job.destination)
+	}
+	wg.Wait()
+	if failed.err != nil {
+		panic(failed.err)
+	}
+}
+
+// put_file uploads path to target, with its md5 in Content-MD5.
+func put_file(path string, target string) error {
+	hash_src, err := hash_file(path, "md5")
+	if err != nil {
+		return err
+	}
+	sum, _ := hex.DecodeString(hash_src)
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	// a zero ContentLength with a body would be sent as unknown length
+	var body io.ReadCloser = file
+	if fi.Size() == 0 {
+		file.Close()
+		body = http.NoBody
+	}
+	req, err := new_http_request(http.MethodPut, target, body)
+	if err != nil {
+		body.Close()
+		return err
+	}
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("PUT %s: %s", target, resp.Status)
+	}
+	return nil
+}
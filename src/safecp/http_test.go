@@ -0,0 +1,144 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// object_store is an HTTP server that keeps what is PUT to it, and returns
+// the md5 of it as ETag like S3 does. PUTs of paths containing refuse are
+// forbidden.
+type object_store struct {
+	sync.Mutex
+	objects map[string]string
+	puts    int
+	headers http.Header
+	refuse  string
+}
+
+func new_object_store(t *testing.T) (*object_store, string) {
+	store := &object_store{objects: make(map[string]string)}
+	server := httptest.NewServer(store)
+	t.Cleanup(server.Close)
+	return store, server.URL
+}
+
+// reset forgets all objects, while the server may be handling requests.
+func (s *object_store) reset() {
+	s.Lock()
+	defer s.Unlock()
+	s.objects = make(map[string]string)
+}
+
+// get returns the object at path, while the server may be handling requests.
+func (s *object_store) get(path string) string {
+	s.Lock()
+	defer s.Unlock()
+	return s.objects[path]
+}
+
+func (s *object_store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	switch r.Method {
+	case http.MethodHead:
+		content, ok := s.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sum := md5.Sum([]byte(content))
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		if s.refuse != "" && strings.Contains(r.URL.Path, s.refuse) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		sum := md5.Sum(data)
+		if r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.objects[r.URL.Path] = string(data)
+		s.puts++
+		s.headers = r.Header.Clone()
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestUploadURL(t *testing.T) {
+	cases := map[string]string{
+		"/a":           "http://host/base/a",
+		"/dir/b c":     "http://host/base/dir/b%20c",
+		"/what?#.txt":  "http://host/base/what%3F%23.txt",
+		"/sub/100%.md": "http://host/base/sub/100%25.md",
+	}
+	for rel, want := range cases {
+		if got := upload_url("http://host/base/", filepath.FromSlash(rel)); got != want {
+			t.Errorf("upload_url(%s) = %s, want %s", rel, got, want)
+		}
+	}
+}
+
+func TestToHTTP(t *testing.T) {
+	store, url := new_object_store(t)
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a", "sub/b c": "bc", "empty": ""})
+	must_run(t, dir, "src", "--to-http="+url+"/bucket", "--http-header=X-Test: yes", "--commit")
+	want := map[string]string{"/bucket/a": "a", "/bucket/sub/b c": "bc", "/bucket/empty": ""}
+	for path, content := range want {
+		if store.objects[path] != content {
+			t.Errorf("%s has %q, want %q", path, store.objects[path], content)
+		}
+	}
+	if store.puts != 3 || store.headers.Get("X-Test") != "yes" {
+		t.Errorf("got %d uploads with headers %v", store.puts, store.headers)
+	}
+	// everything is there now
+	must_run(t, dir, "src", "--to-http="+url+"/bucket", "--commit")
+	if store.puts != 3 {
+		t.Errorf("unchanged files were uploaded again, %d uploads", store.puts)
+	}
+}
+
+func TestToHTTPDifferentContent(t *testing.T) {
+	store, url := new_object_store(t)
+	store.objects["/a"] = "old"
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "new"})
+	if _, stderr, status := run_safecp(t, dir, "src", "--to-http="+url, "--commit"); status == 0 || !strings.Contains(stderr, "Hashes are NOT the same") {
+		t.Errorf("different content didn't bail out: %d\n%s", status, stderr)
+	}
+	must_run(t, dir, "src", "--to-http="+url, "--overwrite", "--commit")
+	if store.objects["/a"] != "new" {
+		t.Errorf("--overwrite left %q", store.objects["/a"])
+	}
+}
+
+func TestToHTTPTakesOneDirectory(t *testing.T) {
+	store, url := new_object_store(t)
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a"})
+	_, stderr, status := run_safecp(t, dir, "src", "dst", "--to-http="+url, "--commit")
+	if status == 0 || !strings.Contains(stderr, "--to-http takes only the source directory") {
+		t.Errorf("a target directory with --to-http gave status %d\n%s", status, stderr)
+	}
+	if store.puts != 0 || len(read_tree(t, dir)) != 1 {
+		t.Error("something was copied anyway")
+	}
+}
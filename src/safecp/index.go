@@ -0,0 +1,176 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// dest_index remembers the hashes of destination files between runs
+// (--dest-index=FILE), so that unchanged destination files don't have to be
+// hashed again. An entry is only trusted when the size and modification time
+// of the file are still the same as when it was hashed. The index only holds
+// paths relative to the destination, so it also records the absolute
+// destination directory it was made for, and loading it for another one
+// starts a new index.
+//
+// The file has a format version. Version 1 had no version and no algorithm
+// in it, entries without an algorithm were md5. Since version 2 the header
+// has the --hash algorithm of the run that wrote it, which entries without
+// an algorithm use. Since version 3 the header has the destination too,
+// older files don't say which destination they are for and are taken to be
+// for the one they are used with. Version 1 and 2 files are migrated when
+// loaded, an index made with another --hash or by a newer safecp is
+// discarded with a warning.
+type dest_index struct {
+	sync.Mutex
+	Version     int                          `json:"version"`
+	Algorithm   string                       `json:"algorithm"`
+	Destination string                       `json:"destination,omitempty"`
+	Entries     map[string]*dest_index_entry `json:"entries"`
+	seen        map[string]bool
+}
+
+type dest_index_entry struct {
+	Size      int64  `json:"size"`
+	Mtime     int64  `json:"mtime"`
+	Hash      string `json:"hash"`
+	Algorithm string `json:"algorithm,omitempty"` // empty for the header's
+}
+
+const index_version = 3
+
+var index *dest_index
+
+// load_dest_index reads the index from file, a missing file gives an empty
+// index, an unreadable one or one for another dest_dir is discarded with a
+// warning.
+func load_dest_index(file string, dest_dir string) *dest_index {
+	algorithm := opts.hash
+	if algorithm == "" {
+		algorithm = "md5"
+	}
+	destination, err := filepath.Abs(dest_dir)
+	if err != nil {
+		panic(err)
+	}
+	idx := &dest_index{Version: index_version, Algorithm: algorithm, Destination: destination,
+		Entries: make(map[string]*dest_index_entry), seen: make(map[string]bool)}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			warning("cannot read destination index %s, starting a new one: %v", file, err)
+		}
+		return idx
+	}
+	saved := &dest_index{}
+	if err := json.Unmarshal(data, saved); err != nil || saved.Entries == nil {
+		warning("destination index %s is corrupt, starting a new one", file)
+		return idx
+	}
+	if saved.Destination != "" && saved.Destination != destination {
+		warning("destination index %s is for %s, starting a new one for %s", file, saved.Destination, destination)
+		return idx
+	}
+	if saved.Version > index_version {
+		warning("destination index %s has format version %d, this safecp only knows up to %d, starting a new one",
+			file, saved.Version, index_version)
+		return idx
+	}
+	if saved.Version < 2 {
+		// every entry says what it is, so any --hash can use them
+		for _, entry := range saved.Entries {
+			if entry.Algorithm == "" {
+				entry.Algorithm = "md5"
+			}
+		}
+	} else if saved.Algorithm != algorithm {
+		warning("destination index %s was made with --hash=%s, starting a new one for %s", file, saved.Algorithm, algorithm)
+		return idx
+	}
+	if saved.Version < index_version {
+		info("Migrated destination index %s from format version %d to %d\n", file, max(saved.Version, 1), index_version)
+	}
+	for _, entry := range saved.Entries {
+		if entry.Algorithm == algorithm {
+			entry.Algorithm = ""
+		}
+	}
+	idx.Entries = saved.Entries
+	return idx
+}
+
+// save writes the index to file, dropping entries of files that no longer
+// exist in dest_dir. The file is replaced atomically so that an interrupted
+// run never leaves a truncated index behind.
+func (idx *dest_index) save(file string, dest_dir string) error {
+	idx.Lock()
+	defer idx.Unlock()
+	for rel := range idx.Entries {
+		if idx.seen[rel] {
+			continue
+		}
+		if _, err := os.Stat(dest_dir + rel); os.IsNotExist(err) {
+			delete(idx.Entries, rel)
+		}
+	}
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Clean(file))
+}
+
+// hash_dest returns the hash of the destination file path, rel is the same
+// path relative to the destination directory and is the key in the index.
+// An entry made with another algorithm is of no use and gets replaced.
+func hash_dest(path string, rel string, algorithm string) (string, error) {
+	if index == nil {
+		return hash_dest_file(path, algorithm)
+	}
+	fi, err := cached_stat(path)
+	if err != nil {
+		return "", err
+	}
+	index.Lock()
+	index.seen[rel] = true
+	entry, ok := index.Entries[rel]
+	index.Unlock()
+	if ok && entry.Size == fi.Size() && entry.Mtime == fi.ModTime().UnixNano() && index.algorithm_of(entry) == algorithm {
+		stats.Lock()
+		stats.index_hits++
+		stats.Unlock()
+		return entry.Hash, nil
+	}
+	hash, err := hash_dest_file(path, algorithm)
+	if err != nil {
+		return "", err
+	}
+	if algorithm == index.Algorithm {
+		algorithm = ""
+	}
+	index.Lock()
+	index.Entries[rel] = &dest_index_entry{fi.Size(), fi.ModTime().UnixNano(), hash, algorithm}
+	index.Unlock()
+	stats.Lock()
+	stats.index_misses++
+	stats.Unlock()
+	return hash, nil
+}
+
+func (idx *dest_index) algorithm_of(e *dest_index_entry) string {
+	if e.Algorithm == "" {
+		return idx.Algorithm
+	}
+	return e.Algorithm
+}
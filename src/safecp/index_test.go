@@ -0,0 +1,161 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// use_index makes idx the index for the test.
+func use_index(t *testing.T, idx *dest_index) {
+	index = idx
+	t.Cleanup(func() { index = nil })
+}
+
+func TestDestIndexSkipsHashingUnchangedFiles(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "dst")
+	write_tree(t, dst, map[string]string{"a": "content"})
+	file := filepath.Join(dir, "index.json")
+	path := filepath.Join(dst, "a")
+	use_index(t, load_dest_index(file, dst))
+	first, err := hash_dest(path, "/a", "md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.save(file, dst); err != nil {
+		t.Fatal(err)
+	}
+	use_index(t, load_dest_index(file, dst))
+	// a wrong hash in the index shows whether the file was hashed again
+	index.Entries["/a"].Hash = "from the index"
+	if hash, _ := hash_dest(path, "/a", "md5"); hash != "from the index" {
+		t.Errorf("an unchanged file was hashed again, got %s", hash)
+	}
+	if stats.index_hits != 1 || stats.index_misses != 1 {
+		t.Errorf("counted %d hits and %d misses, want 1 and 1", stats.index_hits, stats.index_misses)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if hash, _ := hash_dest(path, "/a", "md5"); hash != first {
+		t.Errorf("a changed file wasn't hashed again, got %s instead of %s", hash, first)
+	}
+}
+
+func TestDestIndexDropsRemovedFiles(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "dst")
+	write_tree(t, dst, map[string]string{"a": "a", "b": "b"})
+	file := filepath.Join(dir, "index.json")
+	use_index(t, load_dest_index(file, dst))
+	for _, rel := range []string{"/a", "/b"} {
+		if _, err := hash_dest(dst+rel, rel, "md5"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index.save(file, dst)
+	os.Remove(filepath.Join(dst, "b"))
+	use_index(t, load_dest_index(file, dst))
+	index.save(file, dst)
+	if idx := load_dest_index(file, dst); len(idx.Entries) != 1 || idx.Entries["/a"] == nil {
+		t.Errorf("index has %v, want only /a", idx.Entries)
+	}
+}
+
+func TestDestIndexIsForOneDestination(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"one/a": "same", "two/a": "same"})
+	file := filepath.Join(dir, "index.json")
+	use_index(t, load_dest_index(file, filepath.Join(dir, "one")))
+	if _, err := hash_dest(filepath.Join(dir, "one", "a"), "/a", "md5"); err != nil {
+		t.Fatal(err)
+	}
+	index.save(file, filepath.Join(dir, "one"))
+	if idx := load_dest_index(file, filepath.Join(dir, "one")); len(idx.Entries) != 1 {
+		t.Errorf("the index for the same destination has %d entries, want 1", len(idx.Entries))
+	}
+	if idx := load_dest_index(file, filepath.Join(dir, "two")); len(idx.Entries) != 0 {
+		t.Errorf("the index for another destination has %d entries, want none", len(idx.Entries))
+	}
+}
+
+func TestDestIndexRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a", "b": "b"})
+	write_tree(t, filepath.Join(dir, "dst"), map[string]string{"a": "a", "b": "b"})
+	must_run(t, dir, "src", "dst", "--dest-index=index.json")
+	if _, err := os.Stat(filepath.Join(dir, "index.json")); err != nil {
+		t.Fatal(err)
+	}
+	reset(t)
+	idx := load_dest_index(filepath.Join(dir, "index.json"), filepath.Join(dir, "dst"))
+	if len(idx.Entries) != 2 {
+		t.Errorf("the index has %d entries, want 2", len(idx.Entries))
+	}
+}
+
+func TestDestIndexMigratesOldVersions(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "index")
+	cases := map[string]string{
+		// version 1 has no version and md5 entries
+		"1": `{"entries":{"/a":{"size":1,"mtime":2,"hash":"aa"}}}`,
+		"2": `{"version":2,"algorithm":"md5","entries":{"/a":{"size":1,"mtime":2,"hash":"aa"}}}`,
+	}
+	for version, data := range cases {
+		reset(t)
+		os.WriteFile(file, []byte(data), 0644)
+		idx := load_dest_index(file, dir)
+		if entry := idx.Entries["/a"]; entry == nil || entry.Hash != "aa" || entry.Algorithm != "" {
+			t.Errorf("version %s gave entries %v", version, idx.Entries)
+		}
+		if err := idx.save(file, dir); err != nil {
+			t.Fatal(err)
+		}
+		saved, _ := os.ReadFile(file)
+		if !strings.Contains(string(saved), `"version":3`) || !strings.Contains(string(saved), `"destination":`) {
+			t.Errorf("version %s was saved as %s", version, saved)
+		}
+	}
+}
+
+func TestDestIndexVersionOneWithAnotherHash(t *testing.T) {
+	reset(t)
+	opts.hash = "sha256"
+	dir := t.TempDir()
+	file := filepath.Join(dir, "index")
+	os.WriteFile(file, []byte(`{"entries":{"/a":{"size":1,"mtime":2,"hash":"aa"}}}`), 0644)
+	// the md5 entries are kept, hash_dest replaces them when it gets there
+	if entry := load_dest_index(file, dir).Entries["/a"]; entry == nil || entry.Algorithm != "md5" {
+		t.Errorf("got entry %v, want the md5 one", entry)
+	}
+}
+
+func TestDestIndexDiscarded(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "index")
+	cases := map[string]string{
+		"newer":        `{"version":4,"algorithm":"md5","entries":{"/a":{"size":1,"mtime":2,"hash":"aa"}}}`,
+		"another hash": `{"version":3,"algorithm":"sha1","entries":{"/a":{"size":1,"mtime":2,"hash":"aa"}}}`,
+		"corrupt":      `{"version":3,`,
+	}
+	for name, data := range cases {
+		reset(t)
+		os.WriteFile(file, []byte(data), 0644)
+		if idx := load_dest_index(file, dir); len(idx.Entries) != 0 || idx.Version != index_version {
+			t.Errorf("a %s index was used: %v", name, idx.Entries)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// With --inode-report=FILE the device and inode number of every regular
+// source file is written to FILE while planning, together with where the
+// file goes in the destination and its path relative to the source. Files that are hard links of each other end
+// up in the same group, so an audit of a backup can check afterwards that
+// linked files are still linked (or at least identical) and tell what each
+// destination file was originally. Nothing about the copy itself changes.
+
+// inode_file is one regular source file seen during the walk.
+type inode_file struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Rel         string `json:"rel"` // the path relative to the source, see portable
+}
+
+type inode_group struct {
+	Device uint64       `json:"device"`
+	Inode  uint64       `json:"inode"`
+	Links  uint64       `json:"links"`
+	Files  []inode_file `json:"files"`
+}
+
+type inode_key struct {
+	device uint64
+	inode  uint64
+}
+
+var inodes struct {
+	sync.Mutex
+	groups map[inode_key]*inode_group
+}
+
+// note_inode adds the source file at path, rel in the source, to the
+// report, destination is where it is copied or uploaded to.
+func note_inode(path string, rel string, destination string, f os.FileInfo) {
+	if !f.Mode().IsRegular() {
+		return
+	}
+	device, inode, links, ok := file_inode(f)
+	if !ok {
+		return
+	}
+	inodes.Lock()
+	defer inodes.Unlock()
+	if inodes.groups == nil {
+		inodes.groups = make(map[inode_key]*inode_group)
+	}
+	key := inode_key{device, inode}
+	group, ok := inodes.groups[key]
+	if !ok {
+		group = &inode_group{Device: device, Inode: inode, Links: links}
+		inodes.groups[key] = group
+	}
+	group.Files = append(group.Files, inode_file{path, destination, portable(rel)})
+}
+
+// sorted_inode_groups returns the groups by device and inode number, with
+// the files in every group sorted by source path.
+func sorted_inode_groups() []*inode_group {
+	groups := make([]*inode_group, 0, len(inodes.groups))
+	for _, group := range inodes.groups {
+		sort.Slice(group.Files, func(i, j int) bool {
+			return group.Files[i].Source < group.Files[j].Source
+		})
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Device != groups[j].Device {
+			return groups[i].Device < groups[j].Device
+		}
+		return groups[i].Inode < groups[j].Inode
+	})
+	return groups
+}
+
+// write_inode_report writes the report to file, as CSV with a row per file
+// if it ends in .csv, JSON with a list of groups otherwise.
+func write_inode_report(file string) error {
+	groups := sorted_inode_groups()
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if !strings.HasSuffix(strings.ToLower(file), ".csv") {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(groups)
+	}
+	w := csv.NewWriter(out)
+	w.Write([]string{"device", "inode", "links", "source", "destination", "rel"})
+	for _, group := range groups {
+		for _, f := range group.Files {
+			w.Write([]string{strconv.FormatUint(group.Device, 10), strconv.FormatUint(group.Inode, 10),
+				strconv.FormatUint(group.Links, 10), f.Source, f.Destination, f.Rel})
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,77 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// inode_tree has a and sub/b as hard links of each other, and c.
+func inode_tree(t *testing.T) string {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "linked", "c": "alone", "sub/": ""})
+	if err := os.Link(filepath.Join(dir, "src", "a"), filepath.Join(dir, "src", "sub", "b")); err != nil {
+		t.Skip("cannot make hard links:", err)
+	}
+	fi, _ := os.Stat(filepath.Join(dir, "src", "a"))
+	if _, _, _, ok := file_inode(fi); !ok {
+		t.Skip("no inode numbers on this platform")
+	}
+	return dir
+}
+
+func TestInodeReportJSON(t *testing.T) {
+	dir := inode_tree(t)
+	must_run(t, dir, "src", "dst", "--inode-report=inodes.json")
+	data, err := os.ReadFile(filepath.Join(dir, "inodes.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var groups []inode_group
+	if err := json.Unmarshal(data, &groups); err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("got %d groups, want 2: %s", len(groups), data)
+	}
+	for _, group := range groups {
+		switch len(group.Files) {
+		case 2:
+			a, b := group.Files[0], group.Files[1]
+			if a.Source != filepath.Join("src", "a") || b.Source != filepath.Join("src", "sub", "b") ||
+				b.Destination != filepath.Join("dst", "sub", "b") || b.Rel != "sub/b" || group.Links != 2 {
+				t.Errorf("the linked files are reported as %+v", group)
+			}
+		case 1:
+			if group.Files[0].Source != filepath.Join("src", "c") || group.Links != 1 {
+				t.Errorf("c is reported as %+v", group)
+			}
+		default:
+			t.Errorf("unexpected group %+v", group)
+		}
+	}
+}
+
+func TestInodeReportCSV(t *testing.T) {
+	dir := inode_tree(t)
+	must_run(t, dir, "src", "dst", "--inode-report=inodes.CSV")
+	file, err := os.Open(filepath.Join(dir, "inodes.CSV"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 || rows[0][0] != "device" || rows[0][4] != "destination" || rows[0][5] != "rel" {
+		t.Errorf("got rows %q", rows)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+)
+
+// announce prints what a job is about to do, either in safecp's own words
+// or with --itemize as an rsync itemized change.
+func announce(j job, format string, a ...interface{}) {
+	if opts.itemize {
+		info("%s\n", itemize(j))
+		return
+	}
+	info(format, a...)
+}
+
+// itemize describes a job the way rsync --itemize-changes does, as
+// YXcstpoguax followed by the relative path:
+//
+//	Y  > file copied to the destination, < file sent to a server (--to-http),
+//	   c directory created, h hard link to the canonical copy (--dedupe),
+//	   . only attributes change
+//	X  f file, d directory
+//	c  content differs (what safecp compares by hash)
+//	s  size differs
+//	t  modification time gets set to that of the source, T when it becomes
+//	   the transfer time instead (an overwrite without --update-metadata)
+//	p  permissions differ
+//	o  owner differs
+//	g  group differs
+//	x  extended attributes differ
+//
+// New files and directories get +++++++++ like rsync does, hard links are
+// followed by "=> " and the path they link to. Source files removed by
+// --move show up as "*deleting", like rsync shows deletions. The u (access
+// time) and a (ACL) positions are always '.', safecp doesn't handle either.
+// The o and g positions are only filled in where files have a uid and gid.
+func itemize(j job) string {
+	name := portable(j.rel)
+	switch j.operation {
+	case "mkdir":
+		if name == "" {
+			name = "."
+		}
+		return "cd+++++++++ " + name + "/"
+	case "copy":
+		return ">f+++++++++ " + name
+	case "put":
+		return "<f+++++++++ " + name
+	case "remove":
+		return "*deleting   " + name
+	case "link":
+		return "hf+++++++++ " + name + " => " + portable(j.target)
+	}
+	flags := []byte(">fc........")
+	if j.operation == "metadata" {
+		flags = []byte(".f.........")
+	}
+	sfi, serr := os.Stat(j.source)
+	dfi, derr := os.Stat(j.destination)
+	if serr != nil || derr != nil {
+		return string(flags) + " " + name
+	}
+	if sfi.Size() != dfi.Size() {
+		flags[3] = 's'
+	}
+	if (j.operation == "overwrite" || j.operation == "append") && !opts.update_metadata {
+		flags[4] = 'T'
+		return string(flags) + " " + name
+	}
+	if !sfi.ModTime().Equal(dfi.ModTime()) {
+		flags[4] = 't'
+	}
+	if sfi.Mode()&mode_bits != dfi.Mode()&mode_bits {
+		flags[5] = 'p'
+	}
+	suid, sgid, sok := file_owner(sfi)
+	duid, dgid, dok := file_owner(dfi)
+	if sok && dok && suid != duid {
+		flags[6] = 'o'
+	}
+	if sok && dok && sgid != dgid {
+		flags[7] = 'g'
+	}
+	if j.operation == "metadata" && j.metadata.xattrs {
+		flags[10] = 'x'
+	} else if j.operation == "overwrite" {
+		sx, _ := copied_xattrs(j.source)
+		dx, _ := copied_xattrs(j.destination)
+		if !same_xattrs(sx, dx) {
+			flags[10] = 'x'
+		}
+	}
+	return string(flags) + " " + name
+}
@@ -0,0 +1,82 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestItemizeNewEntries(t *testing.T) {
+	reset(t)
+	cases := []struct {
+		j    job
+		want string
+	}{
+		{job{operation: "mkdir", rel: ""}, "cd+++++++++ ./"},
+		{job{operation: "mkdir", rel: filepath.Join("a", "b")}, "cd+++++++++ a/b/"},
+		{job{operation: "copy", rel: filepath.Join("a", "f")}, ">f+++++++++ a/f"},
+		{job{operation: "put", rel: "f"}, "<f+++++++++ f"},
+		{job{operation: "remove", rel: "f"}, "*deleting   f"},
+		{job{operation: "link", rel: "copy", target: filepath.Join("a", "f")}, "hf+++++++++ copy => a/f"},
+	}
+	for _, c := range cases {
+		if got := itemize(c.j); got != c.want {
+			t.Errorf("itemize(%s %s) = %q, want %q", c.j.operation, c.j.rel, got, c.want)
+		}
+	}
+}
+
+func TestItemizeChanges(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src": "longer", "dst": "short", "same_src": "x", "same_dst": "x"})
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	set_metadata(t, filepath.Join(dir, "same_src"), 0600, mtime)
+	overwrite := job{operation: "overwrite", source: filepath.Join(dir, "src"), destination: filepath.Join(dir, "dst"), rel: "f"}
+	if got := itemize(overwrite); got != ">fcsT...... f" {
+		t.Errorf("overwrite itemized as %q", got)
+	}
+	metadata := job{operation: "metadata", source: filepath.Join(dir, "same_src"), destination: filepath.Join(dir, "same_dst"), rel: "g",
+		metadata: metadata_diff{mode: true, times: true}}
+	want := ".f..tp..... g"
+	if runtime.GOOS == "windows" {
+		want = ".f..t...... g"
+	}
+	if got := itemize(metadata); got != want {
+		t.Errorf("metadata job itemized as %q, want %q", got, want)
+	}
+}
+
+func TestItemizeRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"sub/a": "a"})
+	out := must_run(t, dir, "src", "dst", "--itemize")
+	for _, line := range []string{"cd+++++++++ ./\n", "cd+++++++++ sub/\n", ">f+++++++++ sub/a\n"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("output has no %q:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, "Copy file:") {
+		t.Errorf("--itemize still prints the usual lines:\n%s", out)
+	}
+}
+
+func TestItemizeNativeSeparator(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"sub/a": "a"})
+	out := must_run(t, dir, "src", "dst", "--itemize", "--path-separator=native")
+	if line := ">f+++++++++ " + filepath.Join("sub", "a") + "\n"; !strings.Contains(out, line) {
+		t.Errorf("output has no %q:\n%s", line, out)
+	}
+	// the trailing slash marks a directory, it is no separator
+	if line := "cd+++++++++ sub/\n"; !strings.Contains(out, line) {
+		t.Errorf("output has no %q:\n%s", line, out)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Symbolic links in the source are handled according to --links:
+//
+//	(not set)  the link is copied like a file, which hard links the link
+//	           itself when possible and copies what it points to otherwise
+//	follow     what the link points to is copied, links to directories are
+//	           not descended into
+//	skip       links are left out
+//
+// When following links, a link that points outside of source_dir is not
+// followed (unless --allow-symlink-escape is given), otherwise a link in an
+// untrusted tree could pull in any file on the system.
+
+// follow_link resolves the symlink at path, it returns the file to copy
+// instead, or "" when the link must be left out.
+func follow_link(src_dir string, path string) (string, os.FileInfo, error) {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if !opts.allow_symlink_escape {
+		escapes, err := outside_of(src_dir, target)
+		if err != nil {
+			return "", nil, err
+		}
+		if escapes {
+			warning("blocked symlink pointing outside of the source: %s -> %s", path, target)
+			stats.Lock()
+			stats.blocked_links++
+			stats.Unlock()
+			return "", nil, nil
+		}
+	}
+	fi, err := os.Stat(target)
+	if err != nil {
+		return "", nil, err
+	}
+	if fi.IsDir() {
+		warning("not following symlink to directory %s -> %s", path, target)
+		return "", nil, nil
+	}
+	return target, fi, nil
+}
+
+// outside_of tells whether the resolved path target is outside of dir.
+func outside_of(dir string, target string) (bool, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false, err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return false, err
+	}
+	target, err = filepath.Abs(target)
+	if err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return true, nil
+	}
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(os.PathSeparator)), nil
+}
@@ -0,0 +1,76 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// symlink makes a symlink or skips the test where that isn't allowed.
+func symlink(t *testing.T, target string, path string) {
+	t.Helper()
+	if err := os.Symlink(target, path); err != nil {
+		t.Skip("cannot make symlinks:", err)
+	}
+}
+
+func TestOutsideOf(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	write_tree(t, dir, map[string]string{"src/": "", "src-other/": ""})
+	cases := map[string]bool{
+		filepath.Join(src, "a"):              false,
+		filepath.Join(src, "sub", "..", "b"): false,
+		filepath.Join(dir, "secret"):         true,
+		filepath.Join(dir, "src-other", "x"): true,
+		src:                                  false,
+	}
+	for target, want := range cases {
+		if got, err := outside_of(src, target); err != nil || got != want {
+			t.Errorf("outside_of(%s) = %v (%v), want %v", target, got, err, want)
+		}
+	}
+}
+
+func links_tree(t *testing.T) string {
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src/file": "inside", "src/sub/": "", "secret": "outside"})
+	symlink(t, "file", filepath.Join(dir, "src", "inside"))
+	symlink(t, filepath.Join(dir, "secret"), filepath.Join(dir, "src", "escape"))
+	symlink(t, "sub", filepath.Join(dir, "src", "dir"))
+	return dir
+}
+
+func TestLinksFollowBlocksEscapes(t *testing.T) {
+	dir := links_tree(t)
+	stdout, stderr, status := run_safecp(t, dir, "src", "dst", "--links=follow", "--commit")
+	if status != 0 {
+		t.Fatalf("exit status %d\n%s%s", status, stdout, stderr)
+	}
+	got := read_tree(t, filepath.Join(dir, "dst"))
+	if got["inside"] != "inside" || got["file"] != "inside" {
+		t.Errorf("the link inside the source wasn't followed: %v", got)
+	}
+	if _, ok := got["escape"]; ok {
+		t.Error("the link pointing outside of the source was followed")
+	}
+	if !strings.Contains(stderr, "blocked symlink pointing outside of the source") || !strings.Contains(stderr, "not following symlink to directory") {
+		t.Errorf("no warnings about the skipped links:\n%s", stderr)
+	}
+	must_run(t, dir, "src", "dst2", "--links=follow", "--allow-symlink-escape", "--commit")
+	if got := read_tree(t, filepath.Join(dir, "dst2")); got["escape"] != "outside" {
+		t.Errorf("--allow-symlink-escape didn't follow the link: %v", got)
+	}
+}
+
+func TestLinksSkip(t *testing.T) {
+	dir := links_tree(t)
+	must_run(t, dir, "src", "dst", "--links=skip", "--commit")
+	same_names(t, read_tree(t, filepath.Join(dir, "dst")), "file")
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import "errors"
+
+func read_load_average() (float64, error) {
+	return 0, errors.New("the load average is only available on Linux")
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+const lock_probe_supported = false
+
+// dest_locked can't tell, files open elsewhere don't stop writes here.
+func dest_locked(path string) bool {
+	return false
+}
@@ -0,0 +1,38 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSkipLockedOnlyWithTheOption(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"dst": "x"})
+	open, err := os.Open(filepath.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	if skip_locked(job{operation: "overwrite", destination: filepath.Join(dir, "dst")}) {
+		t.Error("skipped a job without --skip-locked")
+	}
+}
+
+func TestSkipLockedNeedsWindows(t *testing.T) {
+	if lock_probe_supported {
+		t.Skip("--skip-locked is supported here")
+	}
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a"})
+	if _, stderr, status := run_safecp(t, dir, "src", "dst", "--skip-locked"); status == 0 || !strings.Contains(stderr, "only supported on Windows") {
+		t.Errorf("--skip-locked gave status %d\n%s", status, stderr)
+	}
+}
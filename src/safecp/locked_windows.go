@@ -0,0 +1,33 @@
+//go:build windows
+
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import "syscall"
+
+const lock_probe_supported = true
+
+const (
+	error_sharing_violation = syscall.Errno(32)
+	error_lock_violation    = syscall.Errno(33)
+)
+
+// dest_locked opens path for reading and writing without sharing it, which
+// fails with a sharing violation while another process has it open.
+func dest_locked(path string) bool {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return false
+	}
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+		syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return err == error_sharing_violation || err == error_lock_violation
+	}
+	syscall.CloseHandle(h)
+	return false
+}
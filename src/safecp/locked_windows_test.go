@@ -0,0 +1,35 @@
+//go:build windows
+
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSkipLocked(t *testing.T) {
+	reset(t)
+	opts.skip_locked = true
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"open": "x", "closed": "x"})
+	open, err := os.Open(filepath.Join(dir, "open"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	if !skip_locked(job{operation: "overwrite", destination: filepath.Join(dir, "open")}) {
+		t.Error("a file this process has open wasn't skipped")
+	}
+	if skip_locked(job{operation: "overwrite", destination: filepath.Join(dir, "closed")}) {
+		t.Error("a closed file was skipped")
+	}
+	if stats.skipped_locked != 1 {
+		t.Errorf("counted %d skipped files, want 1", stats.skipped_locked)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Everything safecp reports while running goes through the functions below,
+// which print it, and with --syslog also send it to syslog at the priority
+// that fits:
+//
+//	info       what every job does, and other progress    LOG_INFO
+//	notice     the start and the summary of a run          LOG_NOTICE
+//	warning    things that may need attention              LOG_WARNING
+//	log_error  the reason the run bails out                LOG_ERR
+
+// log_sink is the part of *syslog.Writer that safecp uses.
+type log_sink interface {
+	Info(m string) error
+	Notice(m string) error
+	Warning(m string) error
+	Err(m string) error
+}
+
+// syslog_sink is nil unless --syslog is used.
+var syslog_sink log_sink
+
+func info(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	fmt.Print(msg)
+	if syslog_sink != nil {
+		syslog_sink.Info(strings.TrimRight(msg, "\n"))
+	}
+}
+
+func notice(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	fmt.Print(msg)
+	if syslog_sink != nil {
+		syslog_sink.Notice(strings.TrimRight(msg, "\n"))
+	}
+}
+
+func warning(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	fmt.Fprintf(os.Stderr, "Warning: %s\n", msg)
+	if syslog_sink != nil {
+		syslog_sink.Warning(msg)
+	}
+}
+
+func log_error(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	fmt.Fprint(os.Stderr, msg)
+	if syslog_sink != nil {
+		syslog_sink.Err(strings.TrimRight(msg, "\n"))
+	}
+}
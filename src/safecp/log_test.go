@@ -0,0 +1,56 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// recorded_sink stands in for syslog and keeps "priority: message" lines.
+type recorded_sink struct {
+	lines []string
+}
+
+func (s *recorded_sink) record(priority string, m string) error {
+	s.lines = append(s.lines, priority+": "+m)
+	return nil
+}
+
+func (s *recorded_sink) Info(m string) error    { return s.record("info", m) }
+func (s *recorded_sink) Notice(m string) error  { return s.record("notice", m) }
+func (s *recorded_sink) Warning(m string) error { return s.record("warning", m) }
+func (s *recorded_sink) Err(m string) error     { return s.record("err", m) }
+
+func fake_syslog(t *testing.T) *recorded_sink {
+	sink := &recorded_sink{}
+	syslog_sink = sink
+	t.Cleanup(func() { syslog_sink = nil })
+	return sink
+}
+
+func TestSyslogPriorities(t *testing.T) {
+	sink := fake_syslog(t)
+	info("Copy file: %s\n", "a")
+	notice("Summary\n")
+	warning("cannot read %s", "b")
+	log_error("Error: %s\n", "bailing out")
+	want := "info: Copy file: a|notice: Summary|warning: cannot read b|err: Error: bailing out"
+	if got := strings.Join(sink.lines, "|"); got != want {
+		t.Errorf("syslog got %q, want %q", got, want)
+	}
+}
+
+func TestUnknownSyslogFacility(t *testing.T) {
+	if _, err := open_syslog("nonsense", "safecp"); err == nil {
+		t.Error("no error for an unknown facility")
+	}
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src/a": "a"})
+	if _, stderr, status := run_safecp(t, dir, "src", "dst", "--syslog", "--syslog-facility=nonsense"); status == 0 || !strings.Contains(stderr, "cannot log to syslog") {
+		t.Errorf("an unknown facility gave status %d\n%s", status, stderr)
+	}
+}
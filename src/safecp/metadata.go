@@ -0,0 +1,261 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// mode_bits are the parts of os.FileMode that are copied as metadata.
+const mode_bits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// metadata_diff tells which kinds of metadata differ between two files.
+type metadata_diff struct {
+	mode   bool
+	owner  bool
+	times  bool
+	xattrs bool
+}
+
+func (d metadata_diff) any() bool {
+	return d.mode || d.owner || d.times || d.xattrs
+}
+
+func (d metadata_diff) String() string {
+	parts := make([]string, 0)
+	if d.mode {
+		parts = append(parts, "mode")
+	}
+	if d.owner {
+		parts = append(parts, "owner")
+	}
+	if d.times {
+		parts = append(parts, "times")
+	}
+	if d.xattrs {
+		parts = append(parts, "xattrs")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// With --template-attrs=FILE the mode, owner and extended attributes of
+// every destination file come from FILE instead of from its source, with
+// --template-dir-attrs=DIR the same goes for directories. Modification
+// times still come from the source. Copied files get the template applied
+// right away, directories made by the plan get it after all jobs ran (its
+// mode might not allow adding files). With --update-metadata or
+// --metadata-only, files that differ from the template are updated too.
+
+// attrs_template returns the template for the destination dfi, or "" when
+// its attributes come from its source.
+func attrs_template(dfi os.FileInfo) string {
+	if dfi.IsDir() {
+		return opts.template_dir_attrs
+	}
+	return opts.template_attrs
+}
+
+// check_template fails when a template can't be used.
+func check_template(path string, want_dir bool) error {
+	fi, err := os.Stat(path)
+	if err == nil {
+		_, err = list_xattrs(path)
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() != want_dir {
+		if want_dir {
+			return fmt.Errorf("%s is not a directory", path)
+		}
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return nil
+}
+
+// apply_dir_templates gives the directories made by jobs the attributes
+// of --template-dir-attrs.
+func apply_dir_templates(jobs []job) {
+	if opts.template_dir_attrs == "" {
+		return
+	}
+	for _, j := range jobs {
+		if j.operation != "mkdir" {
+			continue
+		}
+		err := apply_metadata(j.source, j.destination, metadata_diff{mode: true, owner: true, xattrs: true})
+		if err = tolerate(err, j.destination); err != nil {
+			fail(err)
+		}
+	}
+}
+
+// diff_metadata compares the mode, owner, modification time and extended
+// attributes of src and dst, or of the template for dst. Access times are
+// not compared, hashing the files already changes them.
+func diff_metadata(src string, dst string) (metadata_diff, error) {
+	var d metadata_diff
+	sfi, err := cached_stat(src)
+	if err != nil {
+		return d, err
+	}
+	dfi, err := cached_stat(dst)
+	if err != nil {
+		return d, err
+	}
+	attrs, afi := src, sfi
+	if template := attrs_template(dfi); template != "" {
+		if afi, err = cached_stat(template); err != nil {
+			return d, err
+		}
+		attrs = template
+	}
+	d.mode = afi.Mode()&mode_bits != dfi.Mode()&mode_bits
+	suid, sgid, sok := file_owner(afi)
+	duid, dgid, dok := file_owner(dfi)
+	d.owner = sok && dok && (suid != duid || sgid != dgid)
+	d.times = !sfi.ModTime().Equal(dfi.ModTime())
+	sx, err := copied_xattrs(attrs)
+	if err != nil {
+		return d, err
+	}
+	dx, err := copied_xattrs(dst)
+	if err != nil {
+		return d, err
+	}
+	d.xattrs = !same_xattrs(sx, dx)
+	return d, nil
+}
+
+func same_xattrs(a map[string][]byte, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		other, ok := b[name]
+		if !ok || !bytes.Equal(value, other) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply_metadata copies the kinds of metadata selected in d from src (or
+// the template for dst) to dst. The owner goes first because chown clears
+// the setuid/setgid bits, the times go last because nothing after them may
+// touch the file.
+func apply_metadata(src string, dst string, d metadata_diff) error {
+	sfi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	dfi, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	attrs, afi := src, sfi
+	if template := attrs_template(dfi); template != "" {
+		if afi, err = os.Stat(template); err != nil {
+			return err
+		}
+		attrs = template
+	}
+	if d.owner {
+		if uid, gid, ok := file_owner(afi); ok {
+			if err := os.Chown(dst, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+	if d.mode || d.owner {
+		if err := os.Chmod(dst, afi.Mode()&mode_bits); err != nil {
+			return err
+		}
+	}
+	if d.xattrs {
+		if err := copy_xattrs(attrs, dst); err != nil {
+			return err
+		}
+	}
+	if d.times {
+		if err := os.Chtimes(dst, time.Time{}, sfi.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copy_xattrs makes the extended attributes of dst equal to those of src,
+// removing the ones src doesn't have. Excluded ones are left alone on both.
+func copy_xattrs(src string, dst string) error {
+	sx, err := copied_xattrs(src)
+	if err != nil {
+		return err
+	}
+	dx, err := copied_xattrs(dst)
+	if err != nil {
+		return err
+	}
+	for name := range dx {
+		if _, ok := sx[name]; !ok {
+			if err := remove_xattr(dst, name); err != nil {
+				return err
+			}
+		}
+	}
+	for name, value := range sx {
+		if other, ok := dx[name]; ok && bytes.Equal(value, other) {
+			continue
+		}
+		if err := set_xattr(dst, name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// default_xattr_excludes are skipped unless --xattr-include says otherwise,
+// security.* (SELinux labels, capabilities) needs privileges to set and
+// rarely means the same on another host.
+var default_xattr_excludes = []string{"security."}
+
+// xattr_excluded tells whether the extended attribute name is left out of
+// comparing and copying, because it starts with one of the --xattr-exclude
+// prefixes, or with a default one no --xattr-include prefix matches.
+func xattr_excluded(name string) bool {
+	for _, prefix := range opts.xattr_exclude {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	for _, prefix := range default_xattr_excludes {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		for _, include := range opts.xattr_include {
+			if strings.HasPrefix(name, include) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// copied_xattrs returns the extended attributes of path that are not excluded.
+func copied_xattrs(path string) (map[string][]byte, error) {
+	xattrs, err := list_xattrs(path)
+	for name := range xattrs {
+		if xattr_excluded(name) {
+			delete(xattrs, name)
+		}
+	}
+	return xattrs, err
+}
@@ -0,0 +1,189 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// set_metadata gives path mode and modification time mtime.
+func set_metadata(t *testing.T, path string, mode os.FileMode, mtime time.Time) {
+	t.Helper()
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiffMetadata(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src": "same", "dst": "same"})
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	set_metadata(t, src, 0600, mtime)
+	set_metadata(t, dst, 0600, mtime)
+	if d, err := diff_metadata(src, dst); err != nil || d.any() {
+		t.Errorf("equal metadata differs in %v (%v)", d, err)
+	}
+	set_metadata(t, dst, 0644, mtime.Add(time.Second))
+	d, err := diff_metadata(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.mode != (runtime.GOOS != "windows") || !d.times || d.owner {
+		t.Errorf("got difference %v, want mode and times", d)
+	}
+	if err := apply_metadata(src, dst, d); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := diff_metadata(src, dst); d.any() {
+		t.Errorf("still differs in %v after applying", d)
+	}
+}
+
+func TestMetadataOnly(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no permission bits to compare")
+	}
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"same": "content", "missing": "x"})
+	write_tree(t, filepath.Join(dir, "dst"), map[string]string{"same": "content"})
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	set_metadata(t, filepath.Join(dir, "src", "same"), 0600, mtime)
+	out := must_run(t, dir, "src", "dst", "--metadata-only", "--commit")
+	if !strings.Contains(out, "Metadata:") {
+		t.Errorf("no metadata job:\n%s", out)
+	}
+	same_names(t, read_tree(t, filepath.Join(dir, "dst")), "same")
+	fi, err := os.Stat(filepath.Join(dir, "dst", "same"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("destination has mode %v and mtime %v, want 0600 and %v", fi.Mode().Perm(), fi.ModTime(), mtime)
+	}
+	if again := must_run(t, dir, "src", "dst", "--metadata-only"); strings.Contains(again, "Metadata:") {
+		t.Errorf("metadata still differs after the run:\n%s", again)
+	}
+}
+
+func TestXattrExcluded(t *testing.T) {
+	reset(t)
+	if _, err := parse_args([]string{"--xattr-exclude=user.cache*", "--xattr-include=security.capability"}); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{
+		"user.cache.size":     true,
+		"user.comment":        false,
+		"security.selinux":    true,
+		"security.capability": false,
+		"system.posix_acl":    false,
+	}
+	for name, want := range cases {
+		if got := xattr_excluded(name); got != want {
+			t.Errorf("xattr_excluded(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestCopyXattrsLeavesExcludedAlone(t *testing.T) {
+	reset(t)
+	opts.xattr_exclude = []string{"user.local."}
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src": "", "dst": ""})
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := set_xattr(src, "user.comment", []byte("hi")); err != nil {
+		t.Skip("no extended attributes here:", err)
+	}
+	set_xattr(src, "user.local.src", []byte("src"))
+	set_xattr(dst, "user.local.dst", []byte("dst"))
+	set_xattr(dst, "user.stale", []byte("stale"))
+	if err := copy_xattrs(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	got, err := list_xattrs(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got["user.comment"]) != "hi" || string(got["user.local.dst"]) != "dst" {
+		t.Errorf("destination has xattrs %q", got)
+	}
+	if _, ok := got["user.stale"]; ok {
+		t.Error("an xattr the source doesn't have was kept")
+	}
+	if _, ok := got["user.local.src"]; ok {
+		t.Error("an excluded xattr was copied")
+	}
+}
+
+func TestCheckTemplate(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"file": "", "dir/": ""})
+	if err := check_template(filepath.Join(dir, "file"), false); err != nil {
+		t.Error(err)
+	}
+	if err := check_template(filepath.Join(dir, "dir"), false); err == nil {
+		t.Error("a directory is taken as file template")
+	}
+	if err := check_template(filepath.Join(dir, "file"), true); err == nil {
+		t.Error("a file is taken as directory template")
+	}
+	if err := check_template(filepath.Join(dir, "missing"), false); err == nil {
+		t.Error("a missing template is taken")
+	}
+}
+
+func TestTemplateAttrsRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no permission bits to compare")
+	}
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src/sub/a": "a", "file_template": "", "dir_template/": ""})
+	os.Chmod(filepath.Join(dir, "src", "sub", "a"), 0644)
+	os.Chmod(filepath.Join(dir, "file_template"), 0640)
+	os.Chmod(filepath.Join(dir, "dir_template"), 0750)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(filepath.Join(dir, "src", "sub", "a"), mtime, mtime)
+	must_run(t, dir, "src", "dst", "--template-attrs=file_template", "--template-dir-attrs=dir_template", "--update-metadata", "--commit")
+	fi, err := os.Stat(filepath.Join(dir, "dst", "sub", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("the copy has mode %v, want that of the template", fi.Mode())
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("the copy has mtime %v, want that of the source", fi.ModTime())
+	}
+	if di, _ := os.Stat(filepath.Join(dir, "dst", "sub")); di.Mode().Perm() != 0750 {
+		t.Errorf("the directory has mode %v, want that of the template", di.Mode())
+	}
+}
+
+func TestTemplateAttrsUpdatesExistingFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no permission bits to compare")
+	}
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src/a": "a", "dst/a": "a", "template": ""})
+	os.Chmod(filepath.Join(dir, "template"), 0600)
+	os.Chmod(filepath.Join(dir, "dst", "a"), 0644)
+	must_run(t, dir, "src", "dst", "--template-attrs=template", "--metadata-only", "--commit")
+	if fi, _ := os.Stat(filepath.Join(dir, "dst", "a")); fi.Mode().Perm() != 0600 {
+		t.Errorf("the existing file has mode %v, want that of the template", fi.Mode())
+	}
+	if _, stderr, status := run_safecp(t, dir, "src", "dst", "--template-attrs=src"); status == 0 {
+		t.Errorf("a directory as file template was taken\n%s", stderr)
+	}
+}
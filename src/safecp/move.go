@@ -0,0 +1,95 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// With --move source files end up in the destination only. A file that is
+// copied or overwritten is renamed into place when source and destination
+// are on the same filesystem, which costs no I/O at all, and is copied and
+// then removed from the source otherwise. Source files the destination
+// already has with the same content are removed. Directories of the source
+// are left in place.
+
+// check_move_dirs refuses --move when source and destination overlap, files
+// removed from the source could be the ones in the destination then.
+func check_move_dirs(src_dir string, dest_dir string) error {
+	src, err := filepath.EvalSymlinks(src_dir)
+	if err != nil {
+		return err
+	}
+	// the part of dest_dir that doesn't exist yet can't be a symlink
+	dest_dir, _ = filepath.Abs(dest_dir)
+	parent := existing_parent(dest_dir)
+	dest, err := filepath.EvalSymlinks(parent)
+	if err != nil {
+		return err
+	}
+	src, _ = filepath.Abs(src)
+	dest, _ = filepath.Abs(dest)
+	dest = filepath.Join(dest, strings.TrimPrefix(dest_dir, parent))
+	sep := string(os.PathSeparator)
+	if src == dest || strings.HasPrefix(dest, src+sep) || strings.HasPrefix(src, dest+sep) {
+		return fmt.Errorf("--move needs a destination outside of the source and the other way around")
+	}
+	return nil
+}
+
+// move_file moves src to dst. dst must not exist, unless replace is set (for
+// an overwrite job), then it keeps its mode like overwrite_file does.
+func move_file(src string, dst string, replace bool) error {
+	dfi, err := os.Lstat(dst)
+	if err == nil && !replace {
+		return fmt.Errorf("%s was created after planning, not moving %s over it", dst, src)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Rename(src, dst)
+	if err == nil {
+		if dfi != nil && !opts.update_metadata {
+			err = os.Chmod(dst, dfi.Mode()&mode_bits)
+		}
+		if err == nil {
+			err = remember_deferred(dst, dst)
+		}
+		return err
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	return move_by_copy(src, dst, replace)
+}
+
+// move_by_copy is a variable so that tests can tell a rename from a copy.
+var move_by_copy = copy_and_remove
+
+// copy_and_remove moves src to dst on another filesystem.
+func copy_and_remove(src string, dst string, replace bool) error {
+	var err error
+	if replace {
+		err = overwrite_file(src, dst)
+	} else {
+		err = CopyFile(src, dst)
+	}
+	if err == nil {
+		err = sync_metadata(src, dst)
+	}
+	if err == nil {
+		err = remember_deferred(src, dst)
+	}
+	if err == nil {
+		err = os.Remove(src)
+	}
+	return err
+}
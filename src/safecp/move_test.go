@@ -0,0 +1,100 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCheckMoveDirs(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src/inner/": "", "src-other/": ""})
+	src := filepath.Join(dir, "src")
+	cases := map[string]bool{
+		filepath.Join(dir, "dst"):        true,
+		filepath.Join(dir, "src-other"):  true,
+		src:                              false,
+		filepath.Join(src, "inner"):      false,
+		filepath.Join(src, "new", "dst"): false,
+		dir:                              false,
+	}
+	for dest, ok := range cases {
+		if err := check_move_dirs(src, dest); (err == nil) != ok {
+			t.Errorf("check_move_dirs(%s) = %v, want ok %v", dest, err, ok)
+		}
+	}
+}
+
+// no_copies fails the test when a move falls back to copying.
+func no_copies(t *testing.T) {
+	move_by_copy = func(src string, dst string, replace bool) error {
+		t.Errorf("%s was copied to %s instead of renamed", src, dst)
+		return copy_and_remove(src, dst, replace)
+	}
+	t.Cleanup(func() { move_by_copy = copy_and_remove })
+}
+
+func TestMoveFile(t *testing.T) {
+	reset(t)
+	no_copies(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"a": "new", "b": "other", "old": "old"})
+	before := must_stat(t, filepath.Join(dir, "a"))
+	if err := move_file(filepath.Join(dir, "a"), filepath.Join(dir, "b"), false); err == nil {
+		t.Error("moved over a file that was created after planning")
+	}
+	os.Chmod(filepath.Join(dir, "old"), 0600)
+	if err := move_file(filepath.Join(dir, "a"), filepath.Join(dir, "old"), true); err != nil {
+		t.Fatal(err)
+	}
+	got := read_tree(t, dir)
+	if _, ok := got["a"]; ok || got["old"] != "new" {
+		t.Errorf("after the move there is %v", got)
+	}
+	// on the same filesystem a move is a rename
+	if !os.SameFile(before, must_stat(t, filepath.Join(dir, "old"))) {
+		t.Error("the moved file is another file")
+	}
+	if fi, _ := os.Stat(filepath.Join(dir, "old")); runtime.GOOS != "windows" && fi.Mode().Perm() != 0600 {
+		t.Errorf("the replaced file has mode %v, want the mode it had", fi.Mode())
+	}
+}
+
+func TestMoveRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a", "sub/b": "b", "same": "same"})
+	write_tree(t, filepath.Join(dir, "dst"), map[string]string{"same": "same"})
+	a, b := must_stat(t, filepath.Join(dir, "src", "a")), must_stat(t, filepath.Join(dir, "src", "sub", "b"))
+	must_run(t, dir, "src", "dst", "--move", "--commit")
+	if got := read_tree(t, filepath.Join(dir, "dst")); got["a"] != "a" || got["sub/b"] != "b" || got["same"] != "same" {
+		t.Errorf("destination has %v", got)
+	}
+	if !os.SameFile(a, must_stat(t, filepath.Join(dir, "dst", "a"))) || !os.SameFile(b, must_stat(t, filepath.Join(dir, "dst", "sub", "b"))) {
+		t.Error("the files were copied instead of renamed")
+	}
+	if left := read_tree(t, filepath.Join(dir, "src")); len(left) != 0 {
+		t.Errorf("source still has %v", left)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "src", "sub")); err != nil {
+		t.Error("the directories of the source weren't left in place")
+	}
+}
+
+func TestMoveRefusesOverlap(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a"})
+	_, stderr, status := run_safecp(t, dir, "src", filepath.Join("src", "dst"), "--move", "--commit")
+	if status == 0 || !strings.Contains(stderr, "--move needs a destination outside of the source") {
+		t.Errorf("a destination inside the source gave status %d\n%s", status, stderr)
+	}
+	if got := read_tree(t, filepath.Join(dir, "src")); len(got) != 1 {
+		t.Errorf("source has %v", got)
+	}
+}
@@ -0,0 +1,405 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// options holds everything that can be set from the command line,
+// see usage() for what each of them does.
+type options struct {
+	commit                  bool
+	strict                  bool
+	allow_volatile_dest     bool
+	exclude_empty_files     bool
+	only_empty_files        bool
+	merge_report            string
+	walk_jobs               int
+	ignore_errors           []string
+	dest_index              string
+	metadata_only           bool
+	update_metadata         bool
+	overwrite               bool
+	preserve_flags          bool
+	partial_dir             string
+	throttle_on_load        float64
+	hash                    string
+	hash_for                map[string]string
+	to_http                 string
+	http_jobs               int
+	http_headers            []string
+	itemize                 bool
+	links                   string
+	backup_dest             string
+	allow_symlink_escape    bool
+	syslog                  bool
+	syslog_facility         string
+	syslog_tag              string
+	dedupe                  bool
+	dedupe_canonical        string
+	keep_going              bool
+	max_errors              int
+	source_mtime_floor      time.Duration
+	move                    bool
+	atomic_swap             bool
+	verify_after_swap       string
+	diff                    bool
+	max_path_length         int
+	max_name_length         int
+	plan_checkpoint         string
+	xattr_exclude           []string
+	xattr_include           []string
+	copy_order              string
+	on_readonly_dest        string
+	verify                  bool
+	verify_jobs             int
+	tolerate_vanished       bool
+	append_mode             bool
+	jobs                    int
+	summary_json            string
+	compare_to              string
+	sparse                  bool
+	dest_charset            string
+	dest_charset_substitute bool
+	inode_report            string
+	autotune_jobs           bool
+	skip_locked             bool
+	chunk_store             string
+	restore_chunks          bool
+	chunk_gc                bool
+	save_plan               string
+	apply_plan              string
+	apply_subset            string
+	apply_limit             int
+	verify_links            bool
+	template_attrs          string
+	template_dir_attrs      string
+	no_temp_cleanup         bool
+	drop_cache              bool
+	bwlimit_schedule        []bwlimit_range
+	verify_cmd              string
+	verify_cmd_timeout      time.Duration
+	selinux                 bool
+	check_case_collisions   bool
+	analyze_dedup           bool
+	commit_batch_size       int
+	commit_batch_bytes      int64
+	path_separator          string
+	verbose                 bool
+}
+
+var opts = options{
+	syslog_facility:    "user",
+	syslog_tag:         "safecp",
+	source_mtime_floor: 5 * time.Minute,
+}
+
+// parse_args fills in opts from the given arguments and returns the
+// positional arguments (anything not starting with --) in order.
+func parse_args(args []string) ([]string, error) {
+	positional := make([]string, 0)
+	var err error
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "--") {
+			positional = append(positional, arg)
+			continue
+		}
+		name, value, has_value := strings.Cut(arg[2:], "=")
+		switch {
+		case name == "verbose" && !has_value:
+			opts.verbose = true
+		case name == "commit" && !has_value:
+			opts.commit = true
+		case name == "strict" && !has_value:
+			opts.strict = true
+		case name == "allow-volatile-dest" && !has_value:
+			opts.allow_volatile_dest = true
+		case name == "exclude-empty-files" && !has_value:
+			opts.exclude_empty_files = true
+		case name == "only-empty-files" && !has_value:
+			opts.only_empty_files = true
+		case name == "summary-json" && has_value:
+			opts.summary_json = value
+		case name == "compare-to" && has_value:
+			opts.compare_to = value
+		case name == "inode-report" && has_value:
+			opts.inode_report = value
+		case name == "merge-report" && has_value:
+			opts.merge_report = value
+		case name == "ignore-error" && has_value:
+			opts.ignore_errors = append(opts.ignore_errors, value)
+		case name == "dest-index" && has_value:
+			opts.dest_index = value
+		case name == "check-case-collisions" && !has_value:
+			opts.check_case_collisions = true
+		case name == "diff" && !has_value:
+			opts.diff = true
+		case name == "xattr-exclude" && has_value:
+			opts.xattr_exclude = append(opts.xattr_exclude, strings.TrimSuffix(value, "*"))
+		case name == "xattr-include" && has_value:
+			opts.xattr_include = append(opts.xattr_include, strings.TrimSuffix(value, "*"))
+		case name == "metadata-only" && !has_value:
+			opts.metadata_only = true
+		case name == "update-metadata" && !has_value:
+			opts.update_metadata = true
+		case name == "template-attrs" && has_value:
+			opts.template_attrs = value
+		case name == "template-dir-attrs" && has_value:
+			opts.template_dir_attrs = value
+		case name == "overwrite" && !has_value:
+			opts.overwrite = true
+		case name == "on-readonly-dest" && (value == "fail" || value == "chmod" || value == "skip"):
+			opts.on_readonly_dest = value
+		case name == "skip-locked" && !has_value:
+			opts.skip_locked = true
+		case name == "append-mode" && !has_value:
+			opts.append_mode = true
+		case name == "selinux" && !has_value:
+			opts.selinux = true
+			opts.xattr_include = append(opts.xattr_include, selinux_xattr)
+		case name == "preserve-flags" && !has_value:
+			opts.preserve_flags = true
+		case name == "copy-order" && (value == "size-asc" || value == "size-desc"):
+			opts.copy_order = value
+		case name == "sparse" && !has_value:
+			opts.sparse = true
+		case name == "chunk-store" && has_value:
+			opts.chunk_store = value
+		case name == "restore-chunks" && !has_value:
+			opts.restore_chunks = true
+		case name == "chunk-gc" && !has_value:
+			opts.chunk_gc = true
+		case name == "no-temp-cleanup" && !has_value:
+			opts.no_temp_cleanup = true
+		case name == "drop-cache" && !has_value:
+			opts.drop_cache = true
+		case name == "commit-batch-size" && has_value:
+			opts.commit_batch_size, err = strconv.Atoi(value)
+		case name == "commit-batch-bytes" && has_value:
+			opts.commit_batch_bytes, err = parse_size(value)
+		case name == "partial-dir" && has_value:
+			opts.partial_dir = value
+		case name == "throttle-on-load" && has_value:
+			opts.throttle_on_load, err = strconv.ParseFloat(value, 64)
+		case name == "bwlimit-schedule" && has_value:
+			if opts.bwlimit_schedule, err = parse_bwlimit_schedule(value); err != nil {
+				return nil, err
+			}
+		case name == "hash" && has_value:
+			if err := check_hasher(value); err != nil {
+				return nil, err
+			}
+			opts.hash = value
+		case name == "hash-for" && has_value:
+			if err := parse_hash_for(value); err != nil {
+				return nil, err
+			}
+		case name == "to-http" && has_value:
+			opts.to_http = value
+		case name == "http-jobs" && has_value:
+			opts.http_jobs, err = strconv.Atoi(value)
+		case name == "http-header" && strings.Contains(value, ":"):
+			opts.http_headers = append(opts.http_headers, value)
+		case name == "itemize" && !has_value:
+			opts.itemize = true
+		case name == "links" && (value == "follow" || value == "skip"):
+			opts.links = value
+		case name == "no-symlink-escape" && !has_value:
+			opts.allow_symlink_escape = false
+		case name == "allow-symlink-escape" && !has_value:
+			opts.allow_symlink_escape = true
+		case name == "verify" && !has_value:
+			opts.verify = true
+		case name == "verify-cmd" && strings.TrimSpace(value) != "":
+			opts.verify_cmd = value
+		case name == "verify-cmd-timeout" && has_value:
+			opts.verify_cmd_timeout, err = time.ParseDuration(value)
+		case name == "verify-links" && !has_value:
+			opts.verify_links = true
+		case name == "verify-jobs" && has_value:
+			opts.verify_jobs, err = strconv.Atoi(value)
+		case name == "backup-dest" && (value == "dir" || value == "tar"):
+			opts.backup_dest = value
+		case name == "atomic-swap" && !has_value:
+			opts.atomic_swap = true
+		case name == "verify-after-swap" && (value == "sample" || value == "full"):
+			opts.verify_after_swap = value
+		case name == "move" && !has_value:
+			opts.move = true
+		case name == "analyze-dedup" && !has_value:
+			opts.analyze_dedup = true
+		case name == "dedupe" && !has_value:
+			opts.dedupe = true
+		case name == "dedupe-canonical" && (value == "first-path" || value == "shortest-path"):
+			opts.dedupe_canonical = value
+		case name == "syslog" && !has_value:
+			opts.syslog = true
+		case name == "syslog-facility" && has_value:
+			opts.syslog_facility = value
+		case name == "syslog-tag" && has_value:
+			opts.syslog_tag = value
+		case name == "tolerate-vanished" && !has_value:
+			opts.tolerate_vanished = true
+		case name == "keep-going" && !has_value:
+			opts.keep_going = true
+		case name == "max-errors" && has_value:
+			opts.max_errors, err = strconv.Atoi(value)
+		case name == "source-mtime-floor" && has_value:
+			opts.source_mtime_floor, err = time.ParseDuration(value)
+		case name == "dest-charset" && has_value:
+			if _, ok := charsets[strings.ToLower(value)]; !ok {
+				return nil, fmt.Errorf("unknown charset %q, use one of: %s", value, charset_names())
+			}
+			opts.dest_charset = strings.ToLower(value)
+		case name == "dest-charset-substitute" && !has_value:
+			opts.dest_charset_substitute = true
+		case name == "path-separator" && has_value:
+			if value != "slash" && value != "native" {
+				return nil, fmt.Errorf("unknown path separator %q, use slash or native", value)
+			}
+			opts.path_separator = value
+		case name == "max-path-length" && has_value:
+			opts.max_path_length, err = strconv.Atoi(value)
+		case name == "max-name-length" && has_value:
+			opts.max_name_length, err = strconv.Atoi(value)
+		case name == "save-plan" && has_value:
+			opts.save_plan = value
+		case name == "apply-plan" && has_value:
+			opts.apply_plan = value
+		case name == "apply-subset" && has_value:
+			opts.apply_subset = value
+		case name == "apply-limit" && has_value:
+			opts.apply_limit, err = strconv.Atoi(value)
+		case name == "plan-checkpoint" && has_value:
+			opts.plan_checkpoint = value
+		case name == "jobs" && has_value:
+			opts.jobs, err = strconv.Atoi(value)
+		case name == "autotune-jobs" && !has_value:
+			opts.autotune_jobs = true
+		case name == "walk-jobs" && has_value:
+			opts.walk_jobs, err = strconv.Atoi(value)
+		default:
+			return nil, fmt.Errorf("invalid option: %s", arg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for --%s: %s", name, value)
+		}
+	}
+	return positional, nil
+}
+
+// check_options rejects combinations of options that make no sense.
+func check_options() error {
+	if opts.exclude_empty_files && opts.only_empty_files {
+		return fmt.Errorf("--exclude-empty-files and --only-empty-files cannot be combined")
+	}
+	if opts.metadata_only && opts.overwrite {
+		return fmt.Errorf("--metadata-only never writes file content, it cannot be combined with --overwrite")
+	}
+	if opts.to_http != "" && (opts.metadata_only || opts.update_metadata || opts.preserve_flags ||
+		opts.partial_dir != "" || opts.dest_index != "" || opts.merge_report != "" || opts.backup_dest != "" ||
+		opts.dedupe || opts.move || opts.atomic_swap || opts.verify || opts.verify_cmd != "" || opts.verify_links || opts.dest_charset != "" || opts.chunk_store != "") {
+		return fmt.Errorf("--to-http cannot be combined with options for a destination directory")
+	}
+	if opts.dedupe_canonical != "" && !opts.dedupe {
+		return fmt.Errorf("--dedupe-canonical only makes sense with --dedupe")
+	}
+	if opts.move && (opts.verify || opts.verify_cmd != "") {
+		return fmt.Errorf("--verify and --verify-cmd look at the source files, they cannot be combined with --move")
+	}
+	if opts.chunk_store != "" && opts.verify_cmd != "" {
+		return fmt.Errorf("--verify-cmd cannot be combined with --chunk-store, the destination only holds chunk lists")
+	}
+	if opts.append_mode && opts.metadata_only {
+		return fmt.Errorf("--metadata-only never writes file content, it cannot be combined with --append-mode")
+	}
+	if opts.move && opts.metadata_only {
+		return fmt.Errorf("--move cannot be combined with --metadata-only")
+	}
+	if opts.move && (opts.dedupe || opts.links == "follow") {
+		return fmt.Errorf("--move cannot be combined with --dedupe or --links=follow, which copy files from elsewhere")
+	}
+	if opts.diff && (opts.commit || opts.to_http != "" || opts.dest_charset != "") {
+		return fmt.Errorf("--diff only compares two directories, it cannot be combined with --commit, --to-http or --dest-charset")
+	}
+	if (opts.restore_chunks || opts.chunk_gc) && opts.chunk_store == "" {
+		return fmt.Errorf("--restore-chunks and --chunk-gc need a --chunk-store")
+	}
+	if opts.restore_chunks && opts.chunk_gc {
+		return fmt.Errorf("--restore-chunks and --chunk-gc cannot be combined")
+	}
+	if opts.chunk_store != "" && (opts.move || opts.append_mode || opts.sparse || opts.partial_dir != "" || opts.diff) {
+		return fmt.Errorf("--chunk-store cannot be combined with --move, --append-mode, --sparse, --partial-dir or --diff")
+	}
+	if opts.apply_plan != "" && (opts.diff || opts.plan_checkpoint != "" || opts.dedupe || opts.copy_order != "" || opts.to_http != "") {
+		return fmt.Errorf("--apply-plan executes a plan as it is, it cannot be combined with options that change planning")
+	}
+	if (opts.apply_subset != "" || opts.apply_limit != 0) && opts.apply_plan == "" {
+		return fmt.Errorf("--apply-subset and --apply-limit only make sense with --apply-plan")
+	}
+	if opts.save_plan != "" && (opts.diff || opts.to_http != "") {
+		return fmt.Errorf("--save-plan cannot be combined with --diff or --to-http")
+	}
+	if opts.plan_checkpoint != "" && opts.walk_jobs > 1 {
+		return fmt.Errorf("--plan-checkpoint cannot be combined with --walk-jobs")
+	}
+	if opts.plan_checkpoint != "" && opts.inode_report != "" {
+		return fmt.Errorf("--inode-report needs to see every source file, it cannot be combined with --plan-checkpoint")
+	}
+	if opts.autotune_jobs && opts.jobs == 1 {
+		return fmt.Errorf("--jobs sets the maximum for --autotune-jobs, it must be more than 1")
+	}
+	if opts.verify_after_swap != "" && !opts.atomic_swap {
+		return fmt.Errorf("--verify-after-swap only makes sense with --atomic-swap")
+	}
+	if opts.verify_after_swap != "" && opts.move {
+		return fmt.Errorf("--verify-after-swap cannot be combined with --move, the sources are gone by then")
+	}
+	if opts.max_errors != 0 && !opts.keep_going {
+		return fmt.Errorf("--max-errors only makes sense with --keep-going")
+	}
+	if opts.inode_report != "" && !inode_numbers_supported {
+		return fmt.Errorf("--inode-report is not supported on this platform")
+	}
+	if opts.skip_locked && !lock_probe_supported {
+		return fmt.Errorf("--skip-locked is only supported on Windows")
+	}
+	if (opts.template_attrs != "" || opts.template_dir_attrs != "") && (opts.move || opts.to_http != "") {
+		return fmt.Errorf("--template-attrs and --template-dir-attrs cannot be combined with --move or --to-http")
+	}
+	if opts.template_attrs != "" {
+		if err := check_template(opts.template_attrs, false); err != nil {
+			return fmt.Errorf("--template-attrs: %v", err)
+		}
+	}
+	if opts.template_dir_attrs != "" {
+		if err := check_template(opts.template_dir_attrs, true); err != nil {
+			return fmt.Errorf("--template-dir-attrs: %v", err)
+		}
+	}
+	if opts.commit_batch_size < 0 {
+		return fmt.Errorf("--commit-batch-size cannot be negative")
+	}
+	if (opts.commit_batch_size > 0 || opts.commit_batch_bytes > 0) && opts.to_http != "" {
+		return fmt.Errorf("--commit-batch-size and --commit-batch-bytes cannot be combined with --to-http")
+	}
+	if opts.selinux && !selinux_supported {
+		return fmt.Errorf("--selinux is only supported on Linux")
+	}
+	if opts.preserve_flags && !inode_flags_supported {
+		return fmt.Errorf("--preserve-flags is not supported on this platform")
+	}
+	if opts.throttle_on_load > 0 {
+		if _, err := load_average(); err != nil {
+			return fmt.Errorf("--throttle-on-load: %v", err)
+		}
+	}
+	return nil
+}
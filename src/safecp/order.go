@@ -0,0 +1,58 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"sort"
+)
+
+// By default jobs run in the order the source was walked. With
+// --copy-order=size-asc the files that get copied (or overwritten, appended
+// to or uploaded) go smallest first, with size-desc largest first, and files of
+// the same size keep the walk order. What other jobs depend on still comes
+// first or last: all directories are made before anything is copied, and
+// the remaining jobs (metadata updates, removals for --move, hard links for
+// --dedupe) run after all copies, in walk order.
+
+// order_jobs sorts jobs in place for --copy-order.
+func order_jobs(jobs []job) {
+	if opts.copy_order == "" {
+		return
+	}
+	sizes := make(map[string]int64)
+	for _, j := range jobs {
+		if transfers(j) {
+			if fi, err := os.Stat(j.source); err == nil {
+				sizes[j.source] = fi.Size()
+			}
+		}
+	}
+	rank := func(j job) int {
+		switch {
+		case j.operation == "mkdir":
+			return 0
+		case transfers(j):
+			return 1
+		}
+		return 2
+	}
+	sort.SliceStable(jobs, func(a, b int) bool {
+		ra, rb := rank(jobs[a]), rank(jobs[b])
+		if ra != rb || ra != 1 {
+			return ra < rb
+		}
+		if opts.copy_order == "size-desc" {
+			return sizes[jobs[a].source] > sizes[jobs[b].source]
+		}
+		return sizes[jobs[a].source] < sizes[jobs[b].source]
+	})
+}
+
+// transfers tells whether j writes file content.
+func transfers(j job) bool {
+	return j.operation == "copy" || j.operation == "overwrite" || j.operation == "append" || j.operation == "put"
+}
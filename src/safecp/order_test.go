@@ -0,0 +1,51 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// order_plan is a plan over files "1", "333", "22" and "4444" (named after
+// their size) with a mkdir first and a hard link in between.
+func order_plan(t *testing.T) []job {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	write_tree(t, src, map[string]string{"1": "1", "333": "333", "22": "22", "4444": "4444", "b": "22"})
+	jobs := []job{{operation: "mkdir", rel: ""}}
+	jobs = append(jobs, copy_jobs(src, filepath.Join(dir, "dst"), "1", "333")...)
+	jobs = append(jobs, job{operation: "link", rel: "link", target: "1"})
+	jobs = append(jobs, copy_jobs(src, filepath.Join(dir, "dst"), "22", "b", "4444")...)
+	return jobs
+}
+
+func TestCopyOrder(t *testing.T) {
+	reset(t)
+	cases := map[string]string{
+		"":          "mkdir , copy 1, copy 333, link link => 1, copy 22, copy b, copy 4444",
+		"size-asc":  "mkdir , copy 1, copy 22, copy b, copy 333, copy 4444, link link => 1",
+		"size-desc": "mkdir , copy 4444, copy 333, copy 22, copy b, copy 1, link link => 1",
+	}
+	for order, want := range cases {
+		opts.copy_order = order
+		jobs := order_plan(t)
+		order_jobs(jobs)
+		if got := describe_jobs(jobs); got != want {
+			t.Errorf("--copy-order=%s ran %s, want %s", order, got, want)
+		}
+	}
+}
+
+func TestCopyOrderRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "aaa", "b": "b", "c": "cc"})
+	out := must_run(t, dir, "src", "dst", "--copy-order=size-desc", "--itemize")
+	if want := "cd+++++++++ ./\n>f+++++++++ a\n>f+++++++++ c\n>f+++++++++ b\n"; !strings.Contains(out, want) {
+		t.Errorf("--copy-order=size-desc printed:\n%s", out)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// temp_prefix starts the name of every temporary file safecp creates next to
+// a destination file.
+const temp_prefix = ".safecp-tmp-"
+
+// overwrite_file replaces the content of dst with that of src. The new
+// content is written to a temporary file in the same directory which is then
+// renamed over dst, so dst is never half written, and other hard links to
+// the old dst are left alone. The mode of dst is kept.
+//
+// Replacing a read-only dst is refused on some platforms (Windows), with
+// --on-readonly-dest=chmod it is made writable first. It ends up with its
+// old mode again either way, only other hard links to the old dst keep the
+// write permission.
+func overwrite_file(src string, dst string) error {
+	dfi, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	if read_only(dfi) && opts.on_readonly_dest == "chmod" {
+		if err := os.Chmod(dst, dfi.Mode()&mode_bits|0200); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				os.Chmod(dst, dfi.Mode()&mode_bits)
+			}
+		}()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), temp_prefix+filepath.Base(dst)+"-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	tmp_name := tmp.Name()
+	if opts.chunk_store != "" {
+		err = write_chunk_list(src, tmp_name)
+	} else {
+		err = copyFileContents(src, tmp_name)
+	}
+	if err == nil {
+		err = os.Chmod(tmp_name, dfi.Mode()&mode_bits)
+	}
+	if err == nil {
+		err = os.Rename(tmp_name, dst)
+	}
+	if err != nil {
+		os.Remove(tmp_name)
+	}
+	return err
+}
+
+// sync_metadata gives dst the metadata of src when --update-metadata is
+// used, after it has been copied or overwritten. Without it only the
+// attributes of --template-attrs are applied, if any.
+func sync_metadata(src string, dst string) error {
+	if !opts.update_metadata {
+		if opts.template_attrs == "" {
+			return nil
+		}
+		return apply_metadata(src, dst, metadata_diff{mode: true, owner: true, xattrs: true})
+	}
+	diff, err := diff_metadata(src, dst)
+	if err != nil || !diff.any() {
+		return err
+	}
+	count_metadata(diff)
+	return apply_metadata(src, dst, diff)
+}
+
+// read_only tells whether the owner may not write to a file.
+func read_only(fi os.FileInfo) bool {
+	return fi.Mode()&0200 == 0
+}
+
+// skip_locked implements --skip-locked (Windows): a job that changes an
+// existing destination file is skipped with a warning while another process
+// has that file open, writing to it would fail with a sharing violation
+// halfway through the run.
+func skip_locked(j job) bool {
+	if !opts.skip_locked || !dest_locked(j.destination) {
+		return false
+	}
+	warning("not changing %s, another process has it open", j.destination)
+	stats.Lock()
+	stats.skipped_locked++
+	stats.Unlock()
+	return true
+}
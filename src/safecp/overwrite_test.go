@@ -0,0 +1,152 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDifferentContentBailsOut(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "new"})
+	write_tree(t, filepath.Join(dir, "dst"), map[string]string{"a": "old"})
+	stdout, stderr, status := run_safecp(t, dir, "src", "dst", "--commit")
+	if status == 0 || !strings.Contains(stderr, "Hashes are NOT the same") {
+		t.Errorf("different content didn't bail out: %d\n%s%s", status, stdout, stderr)
+	}
+	if got := read_tree(t, filepath.Join(dir, "dst")); got["a"] != "old" {
+		t.Errorf("destination was changed to %q", got["a"])
+	}
+}
+
+func TestOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "new content"})
+	write_tree(t, filepath.Join(dir, "dst"), map[string]string{"a": "old"})
+	dst := filepath.Join(dir, "dst", "a")
+	other := filepath.Join(dir, "other")
+	if err := os.Link(dst, other); err != nil {
+		t.Skip("cannot make hard links:", err)
+	}
+	must_run(t, dir, "src", "dst", "--overwrite", "--commit")
+	if data, _ := os.ReadFile(dst); string(data) != "new content" {
+		t.Errorf("destination has %q", data)
+	}
+	// the old file was replaced, not written to
+	if data, _ := os.ReadFile(other); string(data) != "old" {
+		t.Errorf("another hard link of the destination has %q", data)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "dst", temp_prefix+"*")); len(left) != 0 {
+		t.Errorf("temporary files left behind: %q", left)
+	}
+}
+
+func TestSameContentDifferentMetadata(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "same"})
+	write_tree(t, filepath.Join(dir, "dst"), map[string]string{"a": "same"})
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	set_metadata(t, filepath.Join(dir, "src", "a"), 0644, mtime)
+	if out := must_run(t, dir, "src", "dst", "--commit"); strings.Contains(out, "Metadata:") || strings.Contains(out, "Overwrite:") {
+		t.Errorf("metadata alone made the file count as different:\n%s", out)
+	}
+	must_run(t, dir, "src", "dst", "--update-metadata", "--commit")
+	fi, err := os.Stat(filepath.Join(dir, "dst", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("--update-metadata left the mtime at %v, want %v", fi.ModTime(), mtime)
+	}
+}
+
+func TestSyncMetadataOnlyWithUpdateMetadata(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src": "x", "dst": "x"})
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	set_metadata(t, src, 0644, mtime)
+	if err := sync_metadata(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(dst); fi.ModTime().Equal(mtime) {
+		t.Error("metadata was synced without --update-metadata")
+	}
+	opts.update_metadata = true
+	if err := sync_metadata(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(dst); !fi.ModTime().Equal(mtime) || stats.metadata_times != 1 {
+		t.Errorf("got mtime %v and %d counted, want %v and 1", fi.ModTime(), stats.metadata_times, mtime)
+	}
+}
+
+func readonly_tree(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("read-only files are handled differently on Windows")
+	}
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"ro": "new", "rw": "new"})
+	write_tree(t, filepath.Join(dir, "dst"), map[string]string{"ro": "old", "rw": "old"})
+	os.Chmod(filepath.Join(dir, "dst", "ro"), 0444)
+	return dir
+}
+
+func TestOnReadonlyDestFail(t *testing.T) {
+	dir := readonly_tree(t)
+	_, stderr, status := run_safecp(t, dir, "src", "dst", "--overwrite", "--on-readonly-dest=fail", "--commit")
+	if status == 0 || !strings.Contains(stderr, "is read-only, not overwriting it") {
+		t.Errorf("a read-only destination gave status %d\n%s", status, stderr)
+	}
+	if got := read_tree(t, filepath.Join(dir, "dst")); got["ro"] != "old" || got["rw"] != "old" {
+		t.Errorf("destination has %v after bailing out", got)
+	}
+}
+
+func TestOnReadonlyDestSkip(t *testing.T) {
+	dir := readonly_tree(t)
+	out := must_run(t, dir, "src", "dst", "--overwrite", "--on-readonly-dest=skip", "--commit")
+	if got := read_tree(t, filepath.Join(dir, "dst")); got["ro"] != "old" || got["rw"] != "new" {
+		t.Errorf("destination has %v", got)
+	}
+	if !strings.Contains(out, "Skipped 1 read-only destination files") {
+		t.Errorf("the summary doesn't count the skipped file:\n%s", out)
+	}
+}
+
+func TestOnReadonlyDestChmod(t *testing.T) {
+	dir := readonly_tree(t)
+	must_run(t, dir, "src", "dst", "--overwrite", "--on-readonly-dest=chmod", "--commit")
+	if got := read_tree(t, filepath.Join(dir, "dst")); got["ro"] != "new" {
+		t.Errorf("destination has %v", got)
+	}
+	// the replaced file is read-only again
+	if fi, _ := os.Stat(filepath.Join(dir, "dst", "ro")); fi.Mode().Perm() != 0444 {
+		t.Errorf("the replaced file has mode %v", fi.Mode())
+	}
+}
+
+func TestOnReadonlyDestChmodAtomicSwap(t *testing.T) {
+	dir := readonly_tree(t)
+	live := filepath.Join(dir, "live")
+	if err := os.Link(filepath.Join(dir, "dst", "ro"), live); err != nil {
+		t.Skip("cannot make hard links:", err)
+	}
+	must_run(t, dir, "src", "dst", "--overwrite", "--on-readonly-dest=chmod", "--atomic-swap", "--commit")
+	if got := read_tree(t, filepath.Join(dir, "dst")); got["ro"] != "new" {
+		t.Errorf("destination has %v", got)
+	}
+	// the live file was not made writable in the staging tree before the swap
+	if fi := must_stat(t, live); fi.Mode().Perm() != 0444 {
+		t.Errorf("the file that was live during the run has mode %v", fi.Mode())
+	}
+}
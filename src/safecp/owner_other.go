@@ -0,0 +1,22 @@
+//go:build !unix
+
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import "os"
+
+// file_owner has no uid/gid to offer on this platform.
+func file_owner(fi os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+const inode_numbers_supported = false
+
+// file_inode has no inode numbers to offer on this platform either.
+func file_inode(fi os.FileInfo) (uint64, uint64, uint64, bool) {
+	return 0, 0, 0, false
+}
@@ -0,0 +1,121 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// With --jobs=N up to N files are copied (or overwritten, or appended to) at
+// the same time. The jobs are still started in plan order, directories are
+// not waited for though: every copy makes the directories it needs itself,
+// through planned_dirs, which makes each of them exactly once no matter how
+// many workers ask for it at the same time. Other jobs (metadata updates,
+// hard links, removals) wait until all copies started before them are done,
+// a hard link for --dedupe needs its canonical copy to be there.
+
+// planned_dirs are the directories the plan makes, with their modes.
+type planned_dirs struct {
+	sync.Mutex
+	modes map[string]os.FileMode
+	made  map[string]*made_dir
+}
+
+type made_dir struct {
+	once sync.Once
+	err  error
+}
+
+// dirs is only set while execute_parallel runs.
+var dirs *planned_dirs
+
+// make_dir makes the directory of a mkdir job.
+func make_dir(path string, mode os.FileMode) error {
+	if dirs == nil {
+		return os.Mkdir(path, mode)
+	}
+	return dirs.ensure(path)
+}
+
+// ensure makes path, after its parents, when it is one of the planned
+// directories. Concurrent calls for the same path all wait for the first
+// one and get its result, and a directory that exists (made by someone
+// else) is no error.
+func (d *planned_dirs) ensure(path string) error {
+	d.Lock()
+	mode, planned := d.modes[path]
+	state, ok := d.made[path]
+	if planned && !ok {
+		state = &made_dir{}
+		d.made[path] = state
+	}
+	d.Unlock()
+	if !planned {
+		return nil
+	}
+	state.once.Do(func() {
+		if state.err = d.ensure(filepath.Dir(path)); state.err != nil {
+			return
+		}
+		state.err = os.Mkdir(path, mode)
+		if errors.Is(state.err, fs.ErrExist) {
+			if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+				state.err = nil
+			}
+		}
+	})
+	return state.err
+}
+
+func execute_parallel(jobs []job, n int) {
+	dirs = &planned_dirs{modes: make(map[string]os.FileMode), made: make(map[string]*made_dir)}
+	defer func() { dirs = nil }()
+	for _, j := range jobs {
+		if j.operation == "mkdir" {
+			dirs.modes[j.destination] = j.mode
+		}
+	}
+	var wg sync.WaitGroup
+	pool := new_worker_pool(n)
+	if opts.autotune_jobs {
+		pool = new_worker_pool(1)
+		done := make(chan struct{})
+		defer close(done)
+		go autotune(pool, n, done)
+	}
+	for _, j := range jobs {
+		if !transfers(j) {
+			if j.operation != "mkdir" {
+				wg.Wait()
+			}
+			run_job(j, true)
+			batch_done(j)
+			continue
+		}
+		wg.Add(1)
+		pool.acquire()
+		go func(j job) {
+			defer wg.Done()
+			defer pool.release()
+			if err := tolerate(dirs.ensure(filepath.Dir(j.destination)), j.destination); err != nil {
+				fail(err)
+				return
+			}
+			run_job(j, true)
+			batch_done(j)
+			if opts.autotune_jobs {
+				if fi, err := os.Stat(j.destination); err == nil {
+					copied.Add(fi.Size())
+				}
+			}
+		}(j)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,87 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestPlannedDirsEnsure(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(a, "b")
+	d := &planned_dirs{modes: map[string]os.FileMode{a: 0755, b: 0700}, made: make(map[string]*made_dir)}
+	var wg sync.WaitGroup
+	errs := make([]error, 16)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = d.ensure(b)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fi, err := os.Stat(b); err != nil || !fi.IsDir() {
+		t.Errorf("%s wasn't made: %v", b, err)
+	}
+	// not planned, so not made
+	if err := d.ensure(filepath.Join(dir, "other")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "other")); !os.IsNotExist(err) {
+		t.Error("a directory the plan doesn't make was made")
+	}
+}
+
+func TestPlannedDirsExisting(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	os.Mkdir(a, 0755)
+	d := &planned_dirs{modes: map[string]os.FileMode{a: 0755}, made: make(map[string]*made_dir)}
+	if err := d.ensure(a); err != nil {
+		t.Errorf("a directory made by someone else gave %v", err)
+	}
+	write_tree(t, dir, map[string]string{"file": ""})
+	file := filepath.Join(dir, "file")
+	d.modes[file] = 0755
+	if err := d.ensure(file); err == nil {
+		t.Error("a file in the way of a directory gave no error")
+	}
+}
+
+func TestJobsRun(t *testing.T) {
+	dir := t.TempDir()
+	files := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		files[fmt.Sprintf("d%d/sub%d/f%d", i%3, i%5, i)] = fmt.Sprint(i)
+	}
+	files["dup1"], files["dup2"] = "same", "same"
+	write_tree(t, filepath.Join(dir, "src"), files)
+	must_run(t, dir, "src", "dst", "--jobs=4", "--dedupe", "--commit")
+	got := read_tree(t, filepath.Join(dir, "dst"))
+	if len(got) != len(files) {
+		t.Errorf("copied %d of %d files", len(got), len(files))
+	}
+	for rel, content := range files {
+		if got[rel] != content {
+			t.Errorf("%s has %q, want %q", rel, got[rel], content)
+		}
+	}
+	a, _ := os.Stat(filepath.Join(dir, "dst", "dup1"))
+	b, _ := os.Stat(filepath.Join(dir, "dst", "dup2"))
+	if !os.SameFile(a, b) {
+		t.Error("the link for --dedupe wasn't made")
+	}
+}
@@ -0,0 +1,134 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// With --partial-dir=DIR a copy is written to a file in DIR first, and only
+// renamed to its destination once it is complete. When a copy gets
+// interrupted the partial file stays behind in DIR, and the next run that
+// copies the same destination with the same --partial-dir continues where it
+// stopped, after checking that the partial data is still a prefix of the
+// source. If it isn't, the partial file is thrown away and the copy starts
+// over.
+//
+// Because of the rename, a destination file never exists in a half written
+// state, put DIR on the same filesystem as the destination to keep that
+// rename cheap (otherwise the finished file is copied once more).
+
+// partial_path returns where the partial copy for dst is kept.
+func partial_path(dst string) string {
+	abs, err := filepath.Abs(dst)
+	if err != nil {
+		abs = dst
+	}
+	sum := md5.Sum([]byte(abs))
+	return filepath.Join(opts.partial_dir, hex.EncodeToString(sum[:8])+"-"+filepath.Base(dst))
+}
+
+// copy_with_partial copies src to dst through the partial directory.
+func copy_with_partial(src string, dst string) (err error) {
+	if err = os.MkdirAll(opts.partial_dir, 0700); err != nil {
+		return
+	}
+	partial := partial_path(dst)
+	offset, err := resumable_offset(src, partial)
+	if err != nil {
+		return
+	}
+	if offset > 0 {
+		info("Resuming:  %s from %d bytes\n", dst, offset)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	if _, err = in.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	out, err := os.OpenFile(partial, flags, 0666)
+	if err != nil {
+		return
+	}
+	if _, err = copy_data(out, in); err != nil {
+		out.Close()
+		return
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return
+	}
+	done_with(in, out)
+	if err = out.Close(); err != nil {
+		return
+	}
+	err = os.Rename(partial, dst)
+	if errors.Is(err, syscall.EXDEV) {
+		if err = copyFileContents(partial, dst); err == nil {
+			err = os.Remove(partial)
+		}
+	}
+	return
+}
+
+// resumable_offset returns how many bytes of the partial file can be kept,
+// which is either all of them (when they match the start of src) or none.
+func resumable_offset(src string, partial string) (int64, error) {
+	pfi, err := os.Stat(partial)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	sfi, err := os.Stat(src)
+	if err != nil {
+		return 0, err
+	}
+	if pfi.Size() == 0 || pfi.Size() > sfi.Size() {
+		return 0, nil
+	}
+	hash_src, err := hash_prefix_md5(src, pfi.Size())
+	if err != nil {
+		return 0, err
+	}
+	hash_partial, err := hash_prefix_md5(partial, pfi.Size())
+	if err != nil {
+		return 0, err
+	}
+	if hash_src != hash_partial {
+		warning("partial file %s doesn't match %s, starting over", partial, src)
+		return 0, nil
+	}
+	return pfi.Size(), nil
+}
+
+// hash_prefix_md5 hashes the first n bytes of a file.
+func hash_prefix_md5(path string, n int64) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := md5.New()
+	if _, err := io.CopyN(hash, file, n); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
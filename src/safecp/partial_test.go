@@ -0,0 +1,62 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPartialCopyResumes(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	opts.partial_dir = filepath.Join(dir, "partial")
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	content := strings.Repeat("0123456789", 1000)
+	write_tree(t, dir, map[string]string{"src": content})
+	// an interrupted copy left the first half behind
+	if err := os.MkdirAll(opts.partial_dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partial_path(dst), []byte(content[:5000]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if offset, err := resumable_offset(src, partial_path(dst)); err != nil || offset != 5000 {
+		t.Errorf("resumable_offset = %d, %v, want 5000", offset, err)
+	}
+	if err := copy_with_partial(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(dst); string(data) != content {
+		t.Errorf("resumed copy has %d bytes that differ from the source", len(data))
+	}
+	if _, err := os.Stat(partial_path(dst)); !os.IsNotExist(err) {
+		t.Errorf("the partial file is still there: %v", err)
+	}
+}
+
+func TestPartialCopyStartsOverWhenNotAPrefix(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	opts.partial_dir = filepath.Join(dir, "partial")
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	write_tree(t, dir, map[string]string{"src": "the real content"})
+	os.MkdirAll(opts.partial_dir, 0700)
+	if err := os.WriteFile(partial_path(dst), []byte("other"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if offset, err := resumable_offset(src, partial_path(dst)); err != nil || offset != 0 {
+		t.Errorf("resumable_offset = %d, %v, want 0", offset, err)
+	}
+	if err := copy_with_partial(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(dst); string(data) != "the real content" {
+		t.Errorf("copy has %q", data)
+	}
+}
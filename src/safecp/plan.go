@@ -0,0 +1,178 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// With --save-plan=FILE the plan is written to FILE once it is made, and
+// safecp --apply-plan=FILE --commit executes it later without walking the
+// source again. The jobs are not planned again either, before applying only
+// the plan is checked against the current state: sources must still exist,
+// nothing may have appeared where the plan creates something, and files to
+// append to must still have the size they had. Content that changed in
+// place since the plan was made is not noticed.
+//
+// With --apply-subset=PREFIX only the jobs for paths below PREFIX (relative
+// to source_dir) are applied, and with --apply-limit=N only those for the
+// first N paths, for trying a large plan on a small part first. The
+// directories these need are made as well, and so are the canonical copies
+// hard links made by --dedupe point to. The rest of the plan is written to
+// the file given with --save-plan, which can be the plan file itself, to be
+// applied by a later run. Without it a new dry run plans the rest again.
+
+type saved_plan struct {
+	Source      string       `json:"source"`
+	Destination string       `json:"destination"`
+	Jobs        []job_record `json:"jobs"`
+}
+
+func save_plan(file string, src_dir string, dest_dir string, jobs []job) error {
+	plan := saved_plan{src_dir, dest_dir, make([]job_record, 0, len(jobs))}
+	for _, j := range jobs {
+		plan.Jobs = append(plan.Jobs, record_job(j))
+	}
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Clean(file))
+}
+
+func load_plan(file string) (*saved_plan, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	plan := &saved_plan{}
+	if err := json.Unmarshal(data, plan); err != nil {
+		return nil, fmt.Errorf("%s is not a saved plan: %v", file, err)
+	}
+	return plan, nil
+}
+
+// jobs returns the jobs of the plan, with the state before them captured
+// now instead of when planning.
+func (plan *saved_plan) jobs() []job {
+	jobs := make([]job, 0, len(plan.Jobs))
+	for _, r := range plan.Jobs {
+		j := r.job()
+		if opts.merge_report != "" {
+			j.before = capture_state(j.destination)
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs
+}
+
+// check_plan_current returns an error for the first job that doesn't fit
+// the current state of source and destination.
+func check_plan_current(jobs []job) error {
+	for _, j := range jobs {
+		if j.operation == "mkdir" || j.operation == "copy" || j.operation == "link" {
+			if _, err := os.Lstat(j.destination); !os.IsNotExist(err) {
+				return fmt.Errorf("the plan is out of date, %s exists now", j.destination)
+			}
+		}
+		if j.operation == "mkdir" || j.operation == "link" {
+			continue
+		}
+		if _, err := os.Lstat(j.source); err != nil {
+			return fmt.Errorf("the plan is out of date: %v", err)
+		}
+		if j.operation == "append" {
+			if fi, err := os.Stat(j.destination); err != nil || fi.Size() != j.offset {
+				return fmt.Errorf("the plan is out of date, %s changed", j.destination)
+			}
+		}
+	}
+	return nil
+}
+
+// plan_subset splits jobs in those to apply now, for --apply-subset and
+// --apply-limit, and the rest.
+func plan_subset(jobs []job, prefix string, limit int) ([]job, []job) {
+	if prefix != "" {
+		prefix = relative(filepath.Clean(string(os.PathSeparator) + prefix))
+	}
+	below := func(rel string) bool {
+		return prefix == "" || rel == prefix || strings.HasPrefix(rel, prefix+string(os.PathSeparator))
+	}
+	selected := make(map[string]bool)
+	for _, j := range jobs {
+		if j.operation == "mkdir" || !below(j.rel) || selected[j.rel] {
+			continue
+		}
+		if limit > 0 && len(selected) == limit {
+			break
+		}
+		selected[j.rel] = true
+	}
+	for _, j := range jobs {
+		if j.operation == "link" && selected[j.rel] {
+			selected[j.target] = true
+		}
+	}
+	needed := make(map[string]bool)
+	for rel := range selected {
+		for dir := filepath.Dir(rel); dir != "." && dir != string(os.PathSeparator); dir = filepath.Dir(dir) {
+			needed[dir] = true
+		}
+		needed[""] = true
+	}
+	subset, rest := make([]job, 0), make([]job, 0)
+	for _, j := range jobs {
+		var take bool
+		if j.operation == "mkdir" {
+			// empty directories below prefix are part of it, unless a
+			// limit says how much to take
+			take = needed[j.rel] || (limit == 0 && prefix != "" && below(j.rel))
+		} else {
+			take = selected[j.rel]
+		}
+		if take {
+			subset = append(subset, j)
+		} else {
+			rest = append(rest, j)
+		}
+	}
+	return subset, rest
+}
+
+// applied_plan loads the plan for --apply-plan and returns the jobs to
+// apply now, keeping the rest with --save-plan when committing.
+func applied_plan(plan *saved_plan, commit bool) []job {
+	jobs, rest := plan_subset(plan.jobs(), opts.apply_subset, opts.apply_limit)
+	if err := check_plan_current(jobs); err != nil {
+		log_error("Error: %v. Bailing out!\n", err)
+		os.Exit(1)
+	}
+	if opts.apply_subset == "" && opts.apply_limit == 0 {
+		return jobs
+	}
+	notice("Applying %d of the %d jobs in %s\n", len(jobs), len(jobs)+len(rest), opts.apply_plan)
+	switch {
+	case opts.save_plan == "":
+		notice("The other %d jobs are planned again by the next dry run\n", len(rest))
+	case !commit:
+		notice("The other %d jobs are only saved to %s when using --commit\n", len(rest), opts.save_plan)
+	default:
+		if err := save_plan(opts.save_plan, plan.Source, plan.Destination, rest); err != nil {
+			panic(err)
+		}
+		notice("The other %d jobs are saved to: %s\n", len(rest), opts.save_plan)
+	}
+	return jobs
+}
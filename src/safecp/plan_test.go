@@ -0,0 +1,102 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// subset_plan is a plan with directories a, a/sub, a/empty and b, and c is
+// a hard link (--dedupe) of b/3.
+func subset_plan() []job {
+	mkdir := func(rel string) job { return job{operation: "mkdir", rel: filepath.FromSlash(rel)} }
+	copy := func(rel string) job { return job{operation: "copy", rel: filepath.FromSlash(rel)} }
+	return []job{
+		mkdir(""), mkdir("a"), copy("a/1"), mkdir("a/empty"), mkdir("a/sub"), copy("a/sub/2"),
+		mkdir("b"), copy("b/3"), copy("d"), {operation: "link", rel: "c", target: filepath.FromSlash("b/3")},
+	}
+}
+
+func TestPlanSubset(t *testing.T) {
+	cases := []struct {
+		prefix string
+		limit  int
+		want   string
+	}{
+		{"a", 0, "mkdir , mkdir a, copy a/1, mkdir a/empty, mkdir a/sub, copy a/sub/2"},
+		{"/a/", 0, "mkdir , mkdir a, copy a/1, mkdir a/empty, mkdir a/sub, copy a/sub/2"},
+		{"a", 1, "mkdir , mkdir a, copy a/1"},
+		{"", 2, "mkdir , mkdir a, copy a/1, mkdir a/sub, copy a/sub/2"},
+		// the canonical copy comes along with the link
+		{"c", 0, "mkdir , mkdir b, copy b/3, link c => b/3"},
+		{"a/s", 0, ""},
+	}
+	for _, c := range cases {
+		subset, rest := plan_subset(subset_plan(), c.prefix, c.limit)
+		if got := describe_jobs(subset); got != c.want {
+			t.Errorf("plan_subset(%q, %d) = %s, want %s", c.prefix, c.limit, got, c.want)
+		}
+		if len(subset)+len(rest) != len(subset_plan()) {
+			t.Errorf("plan_subset(%q, %d) lost jobs: %s and %s", c.prefix, c.limit, describe_jobs(subset), describe_jobs(rest))
+		}
+	}
+}
+
+func TestApplyPlanRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a", "sub/b": "b"})
+	must_run(t, dir, "src", "dst", "--save-plan=plan.json")
+	// applying doesn't walk the source again
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"later": "later"})
+	must_run(t, dir, "src", "dst", "--apply-plan=plan.json", "--commit")
+	same_names(t, read_tree(t, filepath.Join(dir, "dst")), "a", "sub/b")
+}
+
+func TestApplyPlanOutOfDate(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a"})
+	write_tree(t, filepath.Join(dir, "dst"), map[string]string{})
+	must_run(t, dir, "src", "dst", "--save-plan=plan.json")
+	write_tree(t, filepath.Join(dir, "dst"), map[string]string{"a": "other"})
+	_, stderr, status := run_safecp(t, dir, "src", "dst", "--apply-plan=plan.json", "--commit")
+	if status == 0 || !strings.Contains(stderr, "the plan is out of date") {
+		t.Errorf("an out of date plan gave status %d\n%s", status, stderr)
+	}
+	if got := read_tree(t, filepath.Join(dir, "dst")); got["a"] != "other" {
+		t.Errorf("destination has %v", got)
+	}
+}
+
+func TestApplySubsetRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a/1": "1", "a/2": "2", "b/3": "3"})
+	must_run(t, dir, "src", "dst", "--save-plan=plan.json")
+	out := must_run(t, dir, "src", "dst", "--apply-plan=plan.json", "--apply-subset=a", "--save-plan=plan.json", "--commit")
+	if !strings.Contains(out, "The other 2 jobs are saved to: plan.json") {
+		t.Errorf("applying a subset printed:\n%s", out)
+	}
+	same_names(t, read_tree(t, filepath.Join(dir, "dst")), "a/1", "a/2")
+	must_run(t, dir, "src", "dst", "--apply-plan=plan.json", "--commit")
+	same_names(t, read_tree(t, filepath.Join(dir, "dst")), "a/1", "a/2", "b/3")
+	if _, stderr, status := run_safecp(t, dir, "src", "dst", "--apply-subset=a"); status == 0 || !strings.Contains(stderr, "only make sense with --apply-plan") {
+		t.Errorf("--apply-subset without a plan gave status %d\n%s", status, stderr)
+	}
+}
+
+func TestApplyPlanForOtherDirectories(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a"})
+	must_run(t, dir, "src", "dst", "--save-plan=plan.json")
+	if _, stderr, status := run_safecp(t, dir, "src", "elsewhere", "--apply-plan=plan.json", "--commit"); status == 0 || !strings.Contains(stderr, "is a plan for src and dst") {
+		t.Errorf("a plan for another destination gave status %d\n%s", status, stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "elsewhere")); !os.IsNotExist(err) {
+		t.Error("the plan was applied anyway")
+	}
+}
@@ -0,0 +1,127 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// volatile_filesystem is a variable so the check can be tried without an
+// actual tmpfs mount.
+var volatile_filesystem = probe_volatile_filesystem
+
+// existing_parent returns path, or the closest parent of it that exists.
+func existing_parent(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+// check_volatile_destination warns (or with --strict fails) when dest_dir
+// is on a filesystem that won't survive a reboot, like tmpfs.
+func check_volatile_destination(dest_dir string) error {
+	if opts.allow_volatile_dest {
+		return nil
+	}
+	fs, volatile, err := volatile_filesystem(existing_parent(dest_dir))
+	if err != nil || !volatile {
+		return err
+	}
+	if opts.strict {
+		return fmt.Errorf("destination %s is on %s, which does not survive a reboot (use --allow-volatile-dest if that is intended)", dest_dir, fs)
+	}
+	fmt.Fprintln(os.Stderr, "************************************************************")
+	warning("destination %s is on %s, everything copied there is lost on reboot!", dest_dir, fs)
+	fmt.Fprintln(os.Stderr, "************************************************************")
+	return nil
+}
+
+// future_mtimes collects the source paths whose modification time is more
+// than --source-mtime-floor ahead of the system clock. Such times come from
+// clock skew or corrupt metadata and make anything that compares mtimes
+// unreliable.
+var future_mtimes struct {
+	sync.Mutex
+	count    int
+	examples []string
+}
+
+const future_mtime_examples = 5
+
+func note_future_mtime(path string, f os.FileInfo) {
+	if !f.ModTime().After(time.Now().Add(opts.source_mtime_floor)) {
+		return
+	}
+	future_mtimes.Lock()
+	defer future_mtimes.Unlock()
+	future_mtimes.count++
+	if len(future_mtimes.examples) < future_mtime_examples {
+		future_mtimes.examples = append(future_mtimes.examples, path)
+	}
+}
+
+// check_future_mtimes warns (or with --strict fails) when the source has
+// files with modification times in the future.
+func check_future_mtimes() error {
+	if future_mtimes.count == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("%d source paths have a modification time in the future, for example: %s",
+		future_mtimes.count, strings.Join(future_mtimes.examples, ", "))
+	if opts.strict {
+		return fmt.Errorf("%s (check the clock, or allow more with --source-mtime-floor)", msg)
+	}
+	warning("%s", msg)
+	return nil
+}
+
+// check_path_lengths fails when the plan would create destination paths
+// longer than --max-path-length, or names longer than --max-name-length
+// (by default what the filesystem of the destination allows). All of them
+// are listed, so they can be dealt with before anything is copied instead
+// of failing halfway.
+func check_path_lengths(dest_dir string, jobs []job) error {
+	name_max := opts.max_name_length
+	if name_max == 0 {
+		name_max = probe_name_max(existing_parent(dest_dir))
+	}
+	if name_max == 0 && opts.max_path_length == 0 {
+		return nil
+	}
+	too_long := 0
+	for _, j := range jobs {
+		if j.operation != "mkdir" && j.operation != "copy" && j.operation != "link" {
+			continue
+		}
+		path, err := filepath.Abs(j.destination)
+		if err != nil {
+			return err
+		}
+		if opts.max_path_length > 0 && len(path) > opts.max_path_length {
+			too_long++
+			log_error("Path too long: %s (%d bytes, the limit is %d)\n", path, len(path), opts.max_path_length)
+		} else if name := filepath.Base(path); name_max > 0 && len(name) > name_max {
+			too_long++
+			log_error("Name too long: %s (%d bytes, the limit is %d)\n", path, len(name), name_max)
+		}
+	}
+	if too_long > 0 {
+		return fmt.Errorf("%d destination paths are too long", too_long)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fake_tmpfs makes every filesystem tmpfs, and returns the paths that were
+// probed.
+func fake_tmpfs(t *testing.T) *[]string {
+	probed := new([]string)
+	volatile_filesystem = func(path string) (string, bool, error) {
+		*probed = append(*probed, path)
+		return "tmpfs", true, nil
+	}
+	t.Cleanup(func() { volatile_filesystem = probe_volatile_filesystem })
+	return probed
+}
+
+func TestVolatileDestinationWarns(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	probed := fake_tmpfs(t)
+	if err := check_volatile_destination(filepath.Join(dir, "new", "dst")); err != nil {
+		t.Errorf("got %v, want only a warning", err)
+	}
+	// the destination doesn't exist yet, its closest existing parent is probed
+	if len(*probed) != 1 || (*probed)[0] != dir {
+		t.Errorf("probed %q, want %s", *probed, dir)
+	}
+}
+
+func TestVolatileDestinationStrict(t *testing.T) {
+	reset(t)
+	fake_tmpfs(t)
+	opts.strict = true
+	err := check_volatile_destination(t.TempDir())
+	if err == nil || !strings.Contains(err.Error(), "tmpfs") {
+		t.Errorf("got %v, want an error about tmpfs", err)
+	}
+	opts.allow_volatile_dest = true
+	if err := check_volatile_destination(t.TempDir()); err != nil {
+		t.Errorf("--allow-volatile-dest still fails: %v", err)
+	}
+}
+
+func TestPersistentDestination(t *testing.T) {
+	reset(t)
+	volatile_filesystem = func(path string) (string, bool, error) { return "ext4", false, nil }
+	t.Cleanup(func() { volatile_filesystem = probe_volatile_filesystem })
+	opts.strict = true
+	if err := check_volatile_destination(t.TempDir()); err != nil {
+		t.Errorf("a persistent destination fails: %v", err)
+	}
+}
+
+func forget_future_mtimes(t *testing.T) {
+	t.Cleanup(func() { future_mtimes.count, future_mtimes.examples = 0, nil })
+}
+
+func TestNoteFutureMtime(t *testing.T) {
+	reset(t)
+	forget_future_mtimes(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"now": "", "soon": "", "later": ""})
+	os.Chtimes(filepath.Join(dir, "soon"), time.Now(), time.Now().Add(time.Minute))
+	os.Chtimes(filepath.Join(dir, "later"), time.Now(), time.Now().Add(time.Hour))
+	for _, name := range []string{"now", "soon", "later"} {
+		f, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		note_future_mtime(name, f)
+	}
+	// within the default floor of five minutes is fine
+	if future_mtimes.count != 1 || future_mtimes.examples[0] != "later" {
+		t.Errorf("noted %d future mtimes: %q", future_mtimes.count, future_mtimes.examples)
+	}
+	if err := check_future_mtimes(); err != nil {
+		t.Errorf("got %v, want only a warning", err)
+	}
+	opts.strict = true
+	if err := check_future_mtimes(); err == nil || !strings.Contains(err.Error(), "--source-mtime-floor") {
+		t.Errorf("--strict gave %v", err)
+	}
+}
+
+func TestFutureMtimeExamples(t *testing.T) {
+	reset(t)
+	forget_future_mtimes(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"f": ""})
+	os.Chtimes(filepath.Join(dir, "f"), time.Now(), time.Now().Add(24*time.Hour))
+	f, _ := os.Lstat(filepath.Join(dir, "f"))
+	for i := 0; i < 2*future_mtime_examples; i++ {
+		note_future_mtime("f", f)
+	}
+	if future_mtimes.count != 2*future_mtime_examples || len(future_mtimes.examples) != future_mtime_examples {
+		t.Errorf("noted %d with %d examples", future_mtimes.count, len(future_mtimes.examples))
+	}
+}
+
+func TestSourceMtimeFloorRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a"})
+	os.Chtimes(filepath.Join(dir, "src", "a"), time.Now(), time.Now().Add(time.Hour))
+	_, stderr, status := run_safecp(t, dir, "src", "dst", "--strict", "--allow-volatile-dest")
+	if status == 0 || !strings.Contains(stderr, "modification time in the future") {
+		t.Errorf("a future mtime with --strict gave status %d\n%s", status, stderr)
+	}
+	must_run(t, dir, "src", "dst", "--strict", "--allow-volatile-dest", "--source-mtime-floor=2h")
+}
+
+func TestCheckPathLengths(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "dst")
+	opts.max_name_length = 8
+	jobs := copy_jobs(filepath.Join(dir, "src"), dst, "short", "much-too-long", "sub/short")
+	jobs = append(jobs, job{operation: "metadata", destination: filepath.Join(dst, "also-much-too-long")})
+	err := check_path_lengths(dst, jobs)
+	if err == nil || !strings.HasPrefix(err.Error(), "1 destination paths") {
+		t.Errorf("--max-name-length=8 gave %v", err)
+	}
+	opts.max_path_length = len(filepath.Join(dst, "short"))
+	err = check_path_lengths(dst, copy_jobs(filepath.Join(dir, "src"), dst, "short", "sub/short", "sub/abc"))
+	if err == nil || !strings.HasPrefix(err.Error(), "2 destination paths") {
+		t.Errorf("--max-path-length gave %v", err)
+	}
+}
+
+func TestPathLengthsRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a", "a-long-name": "b"})
+	_, stderr, status := run_safecp(t, dir, "src", "dst", "--max-name-length=5", "--commit")
+	if status == 0 || !strings.Contains(stderr, "Name too long: ") || !strings.Contains(stderr, "a-long-name (11 bytes, the limit is 5)") {
+		t.Errorf("a long name gave status %d\n%s", status, stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dst")); err == nil {
+		t.Error("something was copied before failing")
+	}
+}
@@ -0,0 +1,75 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// file_state is what a path in the destination looked like at some point.
+type file_state struct {
+	Exists    bool   `json:"exists"`
+	Size      int64  `json:"size"`
+	Hash      string `json:"hash,omitempty"`
+	Algorithm string `json:"algorithm,omitempty"`
+}
+
+type report_entry struct {
+	Operation string     `json:"operation"`
+	Path      string     `json:"path"`
+	Rel       string     `json:"rel"` // the path relative to the source, see portable
+	Before    file_state `json:"before"`
+	After     file_state `json:"after"`
+}
+
+// capture_state stats (and for regular files hashes) the given path, a
+// path that cannot be read is reported as not existing.
+func capture_state(path string) file_state {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return file_state{}
+	}
+	state := file_state{Exists: true}
+	if fi.Mode().IsRegular() {
+		state.Size = fi.Size()
+		state.Algorithm = hash_algorithm_for(path)
+		state.Hash, _ = hash_dest_file(path, state.Algorithm)
+	}
+	return state
+}
+
+// write_merge_report captures the state after execution for every job and
+// writes it together with the state from before to file.
+func write_merge_report(file string, jobs []job) error {
+	entries := make([]report_entry, 0, len(jobs))
+	for _, job := range jobs {
+		entries = append(entries, report_entry{job.operation, job.destination, portable(job.rel), job.before, capture_state(job.destination)})
+	}
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if !strings.HasSuffix(strings.ToLower(file), ".csv") {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+	w := csv.NewWriter(out)
+	w.Write([]string{"operation", "path", "before_exists", "before_size", "before_hash", "before_algorithm",
+		"after_exists", "after_size", "after_hash", "after_algorithm", "rel"})
+	for _, e := range entries {
+		w.Write([]string{e.Operation, e.Path,
+			strconv.FormatBool(e.Before.Exists), strconv.FormatInt(e.Before.Size, 10), e.Before.Hash, e.Before.Algorithm,
+			strconv.FormatBool(e.After.Exists), strconv.FormatInt(e.After.Size, 10), e.After.Hash, e.After.Algorithm, e.Rel})
+	}
+	w.Flush()
+	return w.Error()
+}
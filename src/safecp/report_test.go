@@ -0,0 +1,96 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMergeReport(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"new": "new", "changed": "after"})
+	write_tree(t, filepath.Join(dir, "dst"), map[string]string{"changed": "before"})
+	must_run(t, dir, "src", "dst", "--overwrite", "--merge-report=report.json", "--commit")
+	data, err := os.ReadFile(filepath.Join(dir, "report.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []report_entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]report_entry)
+	for _, e := range entries {
+		found[filepath.Base(e.Path)] = e
+	}
+	if e := found["new"]; e.Operation != "copy" || e.Before.Exists || !e.After.Exists || e.After.Size != 3 {
+		t.Errorf("new file reported as %+v", e)
+	}
+	e := found["changed"]
+	if e.Operation != "overwrite" || !e.Before.Exists || e.Before.Size != 6 || e.After.Size != 5 {
+		t.Errorf("overwritten file reported as %+v", e)
+	}
+	if e.Before.Hash == "" || e.Before.Hash == e.After.Hash || e.After.Algorithm != "md5" {
+		t.Errorf("overwritten file has hashes %q and %q (%s)", e.Before.Hash, e.After.Hash, e.After.Algorithm)
+	}
+}
+
+func TestMergeReportCSV(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a"})
+	must_run(t, dir, "src", "dst", "--merge-report=report.csv", "--commit")
+	out, err := os.Open(filepath.Join(dir, "report.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	rows, err := csv.NewReader(out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// header, mkdir dst and copy a
+	if len(rows) != 3 || rows[0][0] != "operation" || rows[2][0] != "copy" || rows[2][6] != "true" {
+		t.Errorf("unexpected report %q", rows)
+	}
+}
+
+func TestMergeReportRelativePaths(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"sub/a": "a"})
+	for separator, want := range map[string]string{"slash": "sub/a", "native": filepath.Join("sub", "a")} {
+		dst := "dst-" + separator
+		must_run(t, dir, "src", dst, "--merge-report="+dst+".json", "--path-separator="+separator, "--commit")
+		data, err := os.ReadFile(filepath.Join(dir, dst+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []report_entry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			t.Fatal(err)
+		}
+		rels := make([]string, 0, len(entries))
+		for _, e := range entries {
+			rels = append(rels, e.Rel)
+		}
+		if got := strings.Join(rels, " "); got != " sub "+want {
+			t.Errorf("--path-separator=%s reported %q", separator, got)
+		}
+	}
+}
+
+func TestMergeReportOnlyWhenCommitting(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a"})
+	must_run(t, dir, "src", "dst", "--merge-report=report.json")
+	if _, err := os.Stat(filepath.Join(dir, "report.json")); !os.IsNotExist(err) {
+		t.Errorf("a dry run wrote the report: %v", err)
+	}
+}
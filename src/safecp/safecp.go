@@ -6,111 +6,945 @@
 package main
 
 import (
-	"crypto/md5"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 )
 
 type job struct {
 	operation   string
 	source      string
 	destination string
+	rel         string // path relative to source_dir, "" for source_dir itself
 	mode        os.FileMode
+	metadata    metadata_diff // what a "metadata" job has to update
+	target      string        // rel of the canonical copy for a "link" job
+	offset      int64         // size of the destination for an "append" job
+	size        int64         // size of the source when planned, for a job that transfers it
+	before      file_state    // only filled in for --merge-report
 }
 
+// summary collects counters that are printed after the run.
+type summary struct {
+	sync.Mutex
+	skipped_empty     int
+	skipped_non_empty int
+	ignored_errors    []string
+	skipped_missing   int
+	skipped_links     int
+	blocked_links     int
+	metadata_mode     int
+	metadata_owner    int
+	metadata_times    int
+	metadata_xattrs   int
+	index_hits        int
+	index_misses      int
+	chunks_stored     int
+	chunks_reused     int
+	chunk_bytes       int64
+	deduplicated      int
+	failed            []string
+	skipped_readonly  int
+	skipped_locked    int
+	vanished          int
+	source_files      int64
+	source_bytes      int64
+}
+
+var stats summary
+
 func usage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s \"<source_dir>\" \"<target_dir>\" [ --commit ]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s \"<source_dir>\" \"<target_dir>\" [ --commit ] [ options ]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s \"<source_dir>\" --to-http=URL [ --commit ] [ options ]\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Options:")
+	fmt.Fprintln(os.Stderr, "  --commit               execute the changes (default is always dry run)")
+	fmt.Fprintln(os.Stderr, "  --verbose              print more details, like how long the syncs of")
+	fmt.Fprintln(os.Stderr, "                         --commit-batch-size took")
+	fmt.Fprintln(os.Stderr, "  --strict               turn warnings about a risky setup into errors")
+	fmt.Fprintln(os.Stderr, "  --allow-volatile-dest  don't warn about a destination on tmpfs or ramfs")
+	fmt.Fprintln(os.Stderr, "  --exclude-empty-files  skip source files of zero bytes")
+	fmt.Fprintln(os.Stderr, "  --only-empty-files     skip source files that are not zero bytes")
+	fmt.Fprintln(os.Stderr, "  --check-case-collisions")
+	fmt.Fprintln(os.Stderr, "                         don't copy anything, list the paths in source_dir that")
+	fmt.Fprintln(os.Stderr, "                         only differ in case (give no target_dir)")
+	fmt.Fprintln(os.Stderr, "  --diff                 don't copy anything, only list the files that differ")
+	fmt.Fprintln(os.Stderr, "                         between source_dir and target_dir")
+	fmt.Fprintln(os.Stderr, "  --metadata-only        don't copy anything, only update mode, owner, mtime")
+	fmt.Fprintln(os.Stderr, "                         and xattrs of destination files with the same content")
+	fmt.Fprintln(os.Stderr, "  --links=follow|skip    copy what symlinks point to, or leave them out")
+	fmt.Fprintln(os.Stderr, "  --allow-symlink-escape with --links=follow, also follow symlinks pointing")
+	fmt.Fprintln(os.Stderr, "                         outside of source_dir (--no-symlink-escape, the")
+	fmt.Fprintln(os.Stderr, "                         default, blocks them)")
+	fmt.Fprintln(os.Stderr, "  --update-metadata      also make mode, owner, mtime and xattrs of destination")
+	fmt.Fprintln(os.Stderr, "                         files equal to the source, content is compared apart")
+	fmt.Fprintln(os.Stderr, "  --xattr-exclude=PREFIX leave out xattrs starting with PREFIX, like system.")
+	fmt.Fprintln(os.Stderr, "                         (can be repeated), security.* is left out by default")
+	fmt.Fprintln(os.Stderr, "  --xattr-include=PREFIX do copy the default excluded xattrs starting with PREFIX")
+	fmt.Fprintln(os.Stderr, "  --template-attrs=FILE  give copied files the mode, owner and xattrs of FILE")
+	fmt.Fprintln(os.Stderr, "                         instead of those of their source")
+	fmt.Fprintln(os.Stderr, "  --template-dir-attrs=DIR")
+	fmt.Fprintln(os.Stderr, "                         the same for the directories that are made")
+	fmt.Fprintln(os.Stderr, "  --overwrite            replace destination files with different content")
+	fmt.Fprintln(os.Stderr, "                         instead of bailing out")
+	fmt.Fprintln(os.Stderr, "  --on-readonly-dest=fail|chmod|skip")
+	fmt.Fprintln(os.Stderr, "                         with --overwrite, bail out on read-only destination")
+	fmt.Fprintln(os.Stderr, "                         files, make them writable while replacing them, or")
+	fmt.Fprintln(os.Stderr, "                         leave them alone (default: replace them as they are)")
+	fmt.Fprintln(os.Stderr, "  --skip-locked          leave destination files that another process has open")
+	fmt.Fprintln(os.Stderr, "                         alone, with a warning (Windows)")
+	fmt.Fprintln(os.Stderr, "  --append-mode          when a destination file is equal to the start of its")
+	fmt.Fprintln(os.Stderr, "                         source (like a grown log file), append the rest to it")
+	fmt.Fprintln(os.Stderr, "  --preserve-flags       copy inode flags like immutable and append-only (Linux),")
+	fmt.Fprintln(os.Stderr, "                         they are set after everything else is done")
+	fmt.Fprintln(os.Stderr, "  --selinux              copy SELinux contexts (the security.selinux xattr, Linux),")
+	fmt.Fprintln(os.Stderr, "                         they are set after all jobs are done")
+	fmt.Fprintln(os.Stderr, "  --move                 remove source files once they are in the destination,")
+	fmt.Fprintln(os.Stderr, "                         by renaming them when on the same filesystem")
+	fmt.Fprintln(os.Stderr, "  --dedupe               copy files with the same content only once and hard")
+	fmt.Fprintln(os.Stderr, "                         link the others to that copy")
+	fmt.Fprintln(os.Stderr, "  --analyze-dedup        don't copy anything, report how much deduplicating the")
+	fmt.Fprintln(os.Stderr, "                         one directory given would save")
+	fmt.Fprintln(os.Stderr, "  --dedupe-canonical=first-path|shortest-path")
+	fmt.Fprintln(os.Stderr, "                         which of them is copied, the smallest or the shortest")
+	fmt.Fprintln(os.Stderr, "                         relative path (default first-path)")
+	fmt.Fprintln(os.Stderr, "  --verify               hash copied and overwritten files again when done and")
+	fmt.Fprintln(os.Stderr, "                         report every one that differs from its source")
+	fmt.Fprintln(os.Stderr, "  --verify-cmd=CMD       run CMD SOURCE DESTINATION for those files when done,")
+	fmt.Fprintln(os.Stderr, "                         an exit status other than 0 is reported as a failure")
+	fmt.Fprintln(os.Stderr, "  --verify-cmd-timeout=DURATION")
+	fmt.Fprintln(os.Stderr, "                         how long CMD may run for a file (default 1m)")
+	fmt.Fprintln(os.Stderr, "  --verify-links         check that the hard links made by --dedupe share the")
+	fmt.Fprintln(os.Stderr, "                         inode of their canonical copy when done")
+	fmt.Fprintln(os.Stderr, "  --verify-jobs=N        number of files verified at the same time (default 4)")
+	fmt.Fprintln(os.Stderr, "  --backup-dest=dir|tar  before changing anything, copy the whole destination")
+	fmt.Fprintln(os.Stderr, "                         to <target_dir>.backup-<time>, as directory or tar")
+	fmt.Fprintln(os.Stderr, "  --atomic-swap          make the changes in a staging copy of the destination")
+	fmt.Fprintln(os.Stderr, "                         and swap that into place when all of them worked")
+	fmt.Fprintln(os.Stderr, "  --verify-after-swap=sample|full")
+	fmt.Fprintln(os.Stderr, "                         compare (some of) the swapped in files with the")
+	fmt.Fprintln(os.Stderr, "                         source, and swap back when any differs")
+	fmt.Fprintln(os.Stderr, "  --jobs=N               copy up to N files at the same time (default 1)")
+	fmt.Fprintln(os.Stderr, "  --autotune-jobs        find the number of files to copy at the same time by")
+	fmt.Fprintln(os.Stderr, "                         measuring the throughput, starting from 1 and up to")
+	fmt.Fprintln(os.Stderr, "                         --jobs (default 8)")
+	fmt.Fprintln(os.Stderr, "  --copy-order=size-asc|size-desc")
+	fmt.Fprintln(os.Stderr, "                         copy the smallest or the largest files first instead")
+	fmt.Fprintln(os.Stderr, "                         of in walk order, directories are still made first")
+	fmt.Fprintln(os.Stderr, "  --sparse               keep holes in sparse files (exactly on Linux, else")
+	fmt.Fprintln(os.Stderr, "                         by turning all zero blocks into holes)")
+	fmt.Fprintln(os.Stderr, "  --chunk-store=DIR      store the content of copied files in DIR, cut in chunks")
+	fmt.Fprintln(os.Stderr, "                         that are stored once, and write lists of their chunks")
+	fmt.Fprintln(os.Stderr, "                         to target_dir instead")
+	fmt.Fprintln(os.Stderr, "  --restore-chunks       with --chunk-store, write the files for the chunk lists")
+	fmt.Fprintln(os.Stderr, "                         in source_dir to target_dir")
+	fmt.Fprintln(os.Stderr, "  --chunk-gc             with --chunk-store, remove chunks not used by the chunk")
+	fmt.Fprintln(os.Stderr, "                         lists in any of the given directories")
+	fmt.Fprintln(os.Stderr, "  --no-temp-cleanup      don't remove the temporary files an interrupted run left")
+	fmt.Fprintln(os.Stderr, "                         in the destination (done for files older than an hour)")
+	fmt.Fprintln(os.Stderr, "  --drop-cache           keep copied and hashed files out of the page cache (Linux)")
+	fmt.Fprintln(os.Stderr, "  --commit-batch-size=N  sync everything written (directories too) after every")
+	fmt.Fprintln(os.Stderr, "                         N jobs, so a crash loses at most the last N")
+	fmt.Fprintln(os.Stderr, "  --commit-batch-bytes=SIZE")
+	fmt.Fprintln(os.Stderr, "                         the same after every SIZE (K, M, G) bytes copied")
+	fmt.Fprintln(os.Stderr, "  --partial-dir=DIR      write copies to DIR first and rename them into place")
+	fmt.Fprintln(os.Stderr, "                         when done, interrupted copies are resumed from DIR")
+	fmt.Fprintln(os.Stderr, "  --throttle-on-load=N   pause copying while the load average is above N (Linux)")
+	fmt.Fprintln(os.Stderr, "  --bwlimit-schedule=FROM-TO=RATE[,...]")
+	fmt.Fprintln(os.Stderr, "                         limit reading to RATE bytes per second (K, M, G or")
+	fmt.Fprintln(os.Stderr, "                         unlimited) between the times of day FROM and TO,")
+	fmt.Fprintln(os.Stderr, "                         like 09:00-17:00=5M,17:00-09:00=unlimited")
+	fmt.Fprintln(os.Stderr, "  --source-mtime-floor=DURATION")
+	fmt.Fprintln(os.Stderr, "                         warn (or fail with --strict) about source files with a")
+	fmt.Fprintln(os.Stderr, "                         modification time more than DURATION in the future")
+	fmt.Fprintln(os.Stderr, "                         (default 5m)")
+	fmt.Fprintln(os.Stderr, "  --dest-charset=NAME    write destination names in another charset, one of:")
+	fmt.Fprintf(os.Stderr, "                         %s\n", charset_names())
+	fmt.Fprintln(os.Stderr, "  --dest-charset-substitute")
+	fmt.Fprintln(os.Stderr, "                         write characters the charset lacks as _ instead of")
+	fmt.Fprintln(os.Stderr, "                         bailing out")
+	fmt.Fprintln(os.Stderr, "  --max-path-length=N    bail out before copying when destination paths would")
+	fmt.Fprintln(os.Stderr, "                         be longer than N bytes")
+	fmt.Fprintln(os.Stderr, "  --max-name-length=N    same for names longer than N bytes (default: what the")
+	fmt.Fprintln(os.Stderr, "                         filesystem of the destination allows, on Linux)")
+	fmt.Fprintln(os.Stderr, "  --walk-jobs=N          plan up to N top level subdirectories in parallel")
+	fmt.Fprintln(os.Stderr, "  --save-plan=FILE       write the plan to FILE, to apply it later")
+	fmt.Fprintln(os.Stderr, "  --apply-plan=FILE      execute the plan saved in FILE instead of making one,")
+	fmt.Fprintln(os.Stderr, "                         source_dir and target_dir can then be left out")
+	fmt.Fprintln(os.Stderr, "  --apply-subset=PREFIX  with --apply-plan, only apply the jobs for paths below")
+	fmt.Fprintln(os.Stderr, "                         PREFIX, the rest is saved to the --save-plan FILE")
+	fmt.Fprintln(os.Stderr, "  --apply-limit=N        with --apply-plan, only apply the jobs for the first N")
+	fmt.Fprintln(os.Stderr, "                         paths, the rest is saved to the --save-plan FILE")
+	fmt.Fprintln(os.Stderr, "  --plan-checkpoint=FILE save the plan to FILE while planning, so an interrupted")
+	fmt.Fprintln(os.Stderr, "                         run can continue planning where it was")
+	fmt.Fprintln(os.Stderr, "  --ignore-error=PATTERN continue with a warning on errors whose message")
+	fmt.Fprintln(os.Stderr, "                         contains PATTERN, or for paths matching the glob")
+	fmt.Fprintln(os.Stderr, "                         PATTERN relative to source_dir or target_dir (can")
+	fmt.Fprintln(os.Stderr, "                         be repeated), ** in it matches any number of")
+	fmt.Fprintln(os.Stderr, "                         directories")
+	fmt.Fprintln(os.Stderr, "  --tolerate-vanished    skip source files that are deleted while safecp runs,")
+	fmt.Fprintln(os.Stderr, "                         with a warning, instead of bailing out")
+	fmt.Fprintln(os.Stderr, "  --keep-going           when copying, updating or uploading a file fails,")
+	fmt.Fprintln(os.Stderr, "                         continue with the others and exit with status 1")
+	fmt.Fprintln(os.Stderr, "  --max-errors=N         with --keep-going, abort once N errors happened")
+	fmt.Fprintln(os.Stderr, "                         (default 0, unlimited)")
+	fmt.Fprintln(os.Stderr, "  --hash=ALGORITHM       hash used to compare files (default md5), one of:")
+	fmt.Fprintf(os.Stderr, "                         %s\n", hasher_names())
+	fmt.Fprintln(os.Stderr, "  --hash-for=.EXT=ALGORITHM[,...]")
+	fmt.Fprintln(os.Stderr, "                         use another hash for files with these extensions")
+	fmt.Fprintln(os.Stderr, "  --dest-index=FILE      keep the hashes of destination files in FILE and")
+	fmt.Fprintln(os.Stderr, "                         reuse them while their size and mtime are unchanged")
+	fmt.Fprintln(os.Stderr, "  --to-http=URL          upload files with PUT to URL/relative/path instead")
+	fmt.Fprintln(os.Stderr, "                         of copying them to a target_dir")
+	fmt.Fprintln(os.Stderr, "  --http-jobs=N          number of uploads running at the same time (default 4)")
+	fmt.Fprintln(os.Stderr, "  --http-header=\"NAME: VALUE\"")
+	fmt.Fprintln(os.Stderr, "                         add a header to every request (can be repeated), the")
+	fmt.Fprintln(os.Stderr, "                         Authorization header can also be set through the")
+	fmt.Fprintln(os.Stderr, "                         SAFECP_HTTP_AUTHORIZATION environment variable")
+	fmt.Fprintln(os.Stderr, "  --itemize              print changes like rsync --itemize-changes does")
+	fmt.Fprintln(os.Stderr, "  --path-separator=slash|native")
+	fmt.Fprintln(os.Stderr, "                         separator in relative paths in output, reports and")
+	fmt.Fprintln(os.Stderr, "                         snapshots, slash by default on every platform")
+	fmt.Fprintln(os.Stderr, "  --syslog               also send progress, warnings and the summary to syslog")
+	fmt.Fprintln(os.Stderr, "  --syslog-facility=NAME syslog facility to use (default user)")
+	fmt.Fprintln(os.Stderr, "  --syslog-tag=TAG       syslog tag to use (default safecp)")
+	fmt.Fprintln(os.Stderr, "  --summary-json=FILE    write the numbers of this run to FILE")
+	fmt.Fprintln(os.Stderr, "  --compare-to=FILE      print how this run differs from the one that wrote")
+	fmt.Fprintln(os.Stderr, "                         FILE with --summary-json (can be the same FILE)")
+	fmt.Fprintln(os.Stderr, "  --inode-report=FILE    write the device and inode number of every source file")
+	fmt.Fprintln(os.Stderr, "                         to FILE, grouping hard links, as CSV if it ends in .csv")
+	fmt.Fprintln(os.Stderr, "  --merge-report=FILE    write the before/after state of every touched path")
+	fmt.Fprintln(os.Stderr, "                         to FILE, as CSV if it ends in .csv, JSON otherwise")
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "NOTE: never use trailing slashes for source_dir or target_dir.")
-	fmt.Fprintln(os.Stderr, "NOTE: use --commit as a 3rd parameter to execute (default is always dry run).")
-	fmt.Fprintln(os.Stderr, "NOTE: files are compared by md5 when they exist in source and target,")
-	fmt.Fprintln(os.Stderr, "      when the checksum doesn't match the program bails out always, before")
-	fmt.Fprintln(os.Stderr, "      making any changes to the filesystem.")
+	fmt.Fprintln(os.Stderr, "NOTE: files are compared by hash when they exist in source and target,")
+	fmt.Fprintln(os.Stderr, "      when the checksum doesn't match the program bails out (unless --overwrite),")
+	fmt.Fprintln(os.Stderr, "      before making any changes to the filesystem. Metadata differences never")
+	fmt.Fprintln(os.Stderr, "      make files count as different.")
 }
 
 func prepare_merge(src_dir string, dest_dir string, jobs *[]job) {
-	e := filepath.Walk(src_dir, func(path string, f os.FileInfo, err error) error {
-		path_part := path[len(src_dir):]
-		path_in_dest := dest_dir + path_part
-		if f.IsDir() {
-			if _, err := os.Stat(path_in_dest); os.IsNotExist(err) {
-				*jobs = append(*jobs, job{"mkdir", "", path_in_dest, f.Mode()})
+	walk_source(src_dir, dest_dir, jobs, func(path string, f os.FileInfo, err error, jobs *[]job) error {
+		return plan_path(src_dir, dest_dir, path, f, err, jobs)
+	})
+}
+
+// planner adds the jobs for a single path from the source tree, err is the
+// error filepath.Walk ran into for this path, if any.
+type planner func(path string, f os.FileInfo, err error, jobs *[]job) error
+
+// walk_source runs plan for everything in src_dir, bailing out on the
+// first error. It also looks out for modification times in the future.
+func walk_source(src_dir string, dest_dir string, jobs *[]job, plan planner) {
+	start_stat_cache()
+	defer stop_stat_cache()
+	// account does the bookkeeping for every source path, also for those
+	// whose plan is resumed from a --plan-checkpoint
+	account := func(path string, f os.FileInfo) {
+		note_future_mtime(path, f)
+		count_source(f)
+		if opts.inode_report != "" {
+			note_inode(path, relative(path[len(src_dir):]), planned_destination(src_dir, dest_dir, path), f)
+		}
+	}
+	checked := func(path string, f os.FileInfo, err error, jobs *[]job) error {
+		if err == nil {
+			remember_stat(path, f)
+			account(path, f)
+		}
+		return plan(path, f, err, jobs)
+	}
+	var e error
+	if opts.plan_checkpoint != "" {
+		e = walk_checkpointed(src_dir, jobs, checked, account, opts.plan_checkpoint, dest_dir)
+	} else if opts.walk_jobs > 1 {
+		e = walk_parallel(src_dir, jobs, checked, opts.walk_jobs)
+	} else {
+		e = filepath.Walk(src_dir, func(path string, f os.FileInfo, err error) error {
+			return checked(path, f, err, jobs)
+		})
+	}
+	if mismatch, ok := e.(*hash_mismatch); ok {
+		log_error("Hashes are NOT the same: %s and %s\n", mismatch.hash_src, mismatch.hash_dst)
+		log_error("Problematic files: %s and %s. Bailing out!\n", mismatch.src, mismatch.dst)
+		os.Exit(1)
+	}
+	if e == nil {
+		e = check_future_mtimes()
+	}
+	if e == nil && opts.inode_report != "" {
+		if e = write_inode_report(opts.inode_report); e == nil {
+			notice("Inode report written to: %s\n", opts.inode_report)
+		}
+	}
+	if e != nil {
+		log_error("Error: %v. Bailing out!\n", e)
+		os.Exit(1)
+	}
+}
+
+// planned_destination returns where path from src_dir ends up, for a
+// dest_dir or the base URL of --to-http.
+func planned_destination(src_dir string, dest_dir string, path string) string {
+	if opts.to_http != "" {
+		return upload_url(dest_dir, path[len(src_dir):])
+	}
+	dest_part, err := dest_name(path[len(src_dir):])
+	if err != nil {
+		// planning the path reports this
+		return ""
+	}
+	return dest_dir + dest_part
+}
+
+// hash_mismatch is returned while planning when a file exists in both
+// source and destination with different content.
+type hash_mismatch struct {
+	src, dst           string
+	hash_src, hash_dst string
+}
+
+func (e *hash_mismatch) Error() string {
+	return fmt.Sprintf("hashes are not the same for %s and %s", e.src, e.dst)
+}
+
+// plan_path adds the jobs needed for a single path from the source tree,
+// err is the error filepath.Walk ran into for this path, if any.
+func plan_path(src_dir string, dest_dir string, path string, f os.FileInfo, err error, jobs *[]job) error {
+	if err != nil {
+		return tolerate(vanished(err, path), path)
+	}
+	path_part := path[len(src_dir):]
+	dest_part, err := dest_name(path_part)
+	if err != nil {
+		return tolerate(err, path)
+	}
+	path_in_dest := dest_dir + dest_part
+	if f.IsDir() {
+		if _, err := cached_stat(path_in_dest); os.IsNotExist(err) && !opts.metadata_only {
+			add_job(jobs, job{operation: "mkdir", source: path, destination: path_in_dest, rel: relative(path_part), mode: f.Mode()})
+		}
+	} else {
+		source := path
+		if f.Mode()&os.ModeSymlink != 0 && opts.links != "" {
+			if opts.links == "skip" {
+				stats.Lock()
+				stats.skipped_links++
+				stats.Unlock()
+				return nil
 			}
-		} else {
-			if _, err := os.Stat(path_in_dest); os.IsNotExist(err) {
-				*jobs = append(*jobs, job{"copy", path, path_in_dest, 0})
-			} else {
-				hash_src, err := hash_file_md5(path)
-				if err != nil {
-					panic(err)
-				}
-				hash_dst, err2 := hash_file_md5(path_in_dest)
-				if err2 != nil {
-					panic(err)
-				}
-				if hash_src != hash_dst {
-					fmt.Fprintf(os.Stderr, "Hashes are NOT the same: %s and %s\n", hash_src, hash_dst)
-					fmt.Fprintf(os.Stderr, "Problematic files: %s and %s. Bailing out!\n", path, path_in_dest)
-					os.Exit(1)
+			source, f, err = follow_link(src_dir, path)
+			if err != nil || source == "" {
+				return tolerate(err, path)
+			}
+		}
+		if skip_by_size(f) {
+			return nil
+		}
+		return plan_file(source, path_in_dest, path_part, jobs)
+	}
+	return nil
+}
+
+// plan_file decides what to do with a source file. Its content and its
+// metadata are looked at separately: first the content is compared by hash,
+// and only when that is the same the metadata (mode, owner, mtime, xattrs)
+// is compared. This gives the following decision matrix:
+//
+//	content    metadata   action
+//	missing    -          copy, or skip with --metadata-only
+//	same       same       nothing
+//	same       different  update the metadata with --update-metadata or
+//	                      --metadata-only, nothing otherwise
+//	different  -          bail out, or replace the content with --overwrite
+//	                      (with --append-mode a destination that is the
+//	                      start of the source gets the rest appended)
+//
+// With --move the source file is removed after any of these, see move.go.
+//
+// With --update-metadata the metadata of the source is also applied to
+// copied and overwritten files, without it a copy gets default metadata and
+// an overwritten file keeps the mode it had.
+func plan_file(path string, path_in_dest string, path_part string, jobs *[]job) error {
+	if _, err := cached_stat(path_in_dest); os.IsNotExist(err) {
+		if opts.metadata_only {
+			stats.Lock()
+			stats.skipped_missing++
+			stats.Unlock()
+			return nil
+		}
+		add_job(jobs, job{operation: "copy", source: path, destination: path_in_dest, rel: relative(path_part)})
+		return nil
+	}
+	algorithm := hash_algorithm_for(path)
+	hash_src, err := hash_file(path, algorithm)
+	if err != nil {
+		return tolerate(vanished(err, path), path)
+	}
+	hash_dst, err := hash_dest(path_in_dest, path_part, algorithm)
+	if err != nil {
+		return tolerate(err, path_in_dest)
+	}
+	if hash_src != hash_dst {
+		if opts.append_mode {
+			offset, err := appendable(path, path_in_dest)
+			if err != nil {
+				return tolerate(vanished(err, path), path, path_in_dest)
+			}
+			if offset >= 0 {
+				add_job(jobs, job{operation: "append", source: path, destination: path_in_dest, rel: relative(path_part), offset: offset})
+				if opts.move {
+					add_job(jobs, job{operation: "remove", source: path, destination: path_in_dest, rel: relative(path_part)})
 				}
+				return nil
+			}
+		}
+		if !opts.overwrite {
+			return &hash_mismatch{path, path_in_dest, hash_src, hash_dst}
+		}
+		if dfi, err := cached_stat(path_in_dest); err == nil && read_only(dfi) {
+			switch opts.on_readonly_dest {
+			case "fail":
+				return fmt.Errorf("%s is read-only, not overwriting it (see --on-readonly-dest)", path_in_dest)
+			case "skip":
+				warning("not overwriting %s, it is read-only", path_in_dest)
+				stats.Lock()
+				stats.skipped_readonly++
+				stats.Unlock()
+				return nil
 			}
 		}
+		add_job(jobs, job{operation: "overwrite", source: path, destination: path_in_dest, rel: relative(path_part)})
 		return nil
-	})
-	if e != nil {
-		panic(e)
 	}
+	if opts.metadata_only || opts.update_metadata {
+		diff, err := diff_metadata(path, path_in_dest)
+		if err != nil {
+			return tolerate(err, path, path_in_dest)
+		}
+		if diff.any() {
+			add_job(jobs, job{operation: "metadata", source: path, destination: path_in_dest, rel: relative(path_part), metadata: diff})
+		}
+	}
+	if opts.move {
+		add_job(jobs, job{operation: "remove", source: path, destination: path_in_dest, rel: relative(path_part)})
+	}
+	return nil
+}
+
+// relative turns the part of a path after source_dir into a relative path.
+func relative(path_part string) string {
+	return strings.TrimPrefix(path_part, string(os.PathSeparator))
+}
+
+// portable renders the relative path rel for output, reports and snapshot
+// entries. These are read on other platforms too, so separators are slashes
+// everywhere (like tar expects), unless --path-separator=native is given.
+// Paths used to reach files are never rendered like this.
+func portable(rel string) string {
+	if opts.path_separator == "native" {
+		return rel
+	}
+	return filepath.ToSlash(rel)
+}
+
+// add_job appends j to the plan, recording the current state of its
+// destination first when a merge report was requested.
+func add_job(jobs *[]job, j job) {
+	if opts.merge_report != "" {
+		j.before = capture_state(j.destination)
+	}
+	if transfers(j) {
+		if fi, err := cached_stat(j.source); err == nil {
+			j.size = fi.Size()
+		}
+	}
+	*jobs = append(*jobs, j)
+}
+
+// skip_by_size applies the --exclude-empty-files and --only-empty-files
+// filters to a regular file, it returns true when the file must be skipped.
+func skip_by_size(f os.FileInfo) bool {
+	if !f.Mode().IsRegular() {
+		return false
+	}
+	if opts.exclude_empty_files && f.Size() == 0 {
+		stats.Lock()
+		stats.skipped_empty++
+		stats.Unlock()
+		return true
+	}
+	if opts.only_empty_files && f.Size() != 0 {
+		stats.Lock()
+		stats.skipped_non_empty++
+		stats.Unlock()
+		return true
+	}
+	return false
 }
 
 func execute_merge(jobs *[]job, commit bool) {
-	for _, job := range *jobs {
-		switch job.operation {
-		case "mkdir":
-			fmt.Printf("Make dir:  %s, %d\n", job.destination, job.mode)
+	if commit && opts.autotune_jobs {
+		limit := opts.jobs
+		if limit == 0 {
+			limit = autotune_max_jobs
+		}
+		execute_parallel(*jobs, limit)
+	} else if commit && opts.jobs > 1 {
+		execute_parallel(*jobs, opts.jobs)
+	} else {
+		for _, job := range *jobs {
+			run_job(job, commit)
 			if commit {
-				err := os.Mkdir(job.destination, job.mode)
-				if err != nil {
-					panic(err)
-				}
+				batch_done(job)
 			}
-		case "copy":
-			fmt.Printf("Copy file: %s -> %s\n", job.source, job.destination)
-			if commit {
-				err := CopyFile(job.source, job.destination)
-				if err != nil {
-					panic(err)
-				}
+		}
+	}
+	if commit {
+		finish_batch()
+		apply_dir_templates(*jobs)
+	}
+	if err := apply_deferred_contexts(commit); err != nil {
+		panic(err)
+	}
+	if err := apply_deferred_flags(commit); err != nil {
+		panic(err)
+	}
+}
+
+// completed holds the jobs that did their work, the checks after executing
+// (--verify and the like) leave out jobs that were skipped, or failed and
+// were tolerated. They are told apart by operation and rel, --atomic-swap
+// runs them with another destination.
+var completed struct {
+	sync.Mutex
+	jobs map[string]bool
+}
+
+func completed_key(j job) string {
+	return j.operation + " " + j.rel
+}
+
+func complete(j job) {
+	completed.Lock()
+	defer completed.Unlock()
+	if completed.jobs == nil {
+		completed.jobs = make(map[string]bool)
+	}
+	completed.jobs[completed_key(j)] = true
+}
+
+// completed_jobs returns the jobs that did their work.
+func completed_jobs(jobs []job) []job {
+	completed.Lock()
+	defer completed.Unlock()
+	done := make([]job, 0, len(jobs))
+	for _, j := range jobs {
+		if completed.jobs[completed_key(j)] {
+			done = append(done, j)
+		}
+	}
+	return done
+}
+
+// run_job executes a single job, or only announces it without commit.
+func run_job(job job, commit bool) {
+	switch job.operation {
+	case "mkdir":
+		announce(job, "Make dir:  %s, %d\n", job.destination, job.mode)
+		if commit {
+			err := make_dir(job.destination, job.mode)
+			if err == nil {
+				err = remember_deferred(job.source, job.destination)
+			}
+			if err = tolerate(err, job.destination); err != nil {
+				fail(err)
+			}
+		}
+	case "copy":
+		announce(job, "Copy file: %s -> %s\n", job.source, job.destination)
+		if commit && opts.move {
+			wait_for_load()
+			err := move_file(job.source, job.destination, false)
+			if err == nil {
+				complete(job)
+			}
+			if err = tolerate(vanished(err, job.source), job.source, job.destination); err != nil {
+				fail(err)
+			}
+		} else if commit {
+			wait_for_load()
+			err := CopyFile(job.source, job.destination)
+			if err == nil {
+				err = sync_metadata(job.source, job.destination)
+			}
+			if err == nil {
+				err = remember_deferred(job.source, job.destination)
+			}
+			if err == nil {
+				complete(job)
+			}
+			if err = tolerate(vanished(err, job.source), job.source, job.destination); err != nil {
+				fail(err)
+			}
+		}
+	case "overwrite":
+		if skip_locked(job) {
+			return
+		}
+		announce(job, "Overwrite: %s -> %s\n", job.source, job.destination)
+		if commit && opts.move {
+			err := move_file(job.source, job.destination, true)
+			if err == nil {
+				complete(job)
+			}
+			if err = tolerate(vanished(err, job.source), job.source, job.destination); err != nil {
+				fail(err)
+			}
+		} else if commit {
+			err := overwrite_file(job.source, job.destination)
+			if err == nil {
+				err = sync_metadata(job.source, job.destination)
+			}
+			if err == nil {
+				err = remember_deferred(job.source, job.destination)
+			}
+			if err == nil {
+				complete(job)
+			}
+			if err = tolerate(vanished(err, job.source), job.source, job.destination); err != nil {
+				fail(err)
+			}
+		}
+	case "append":
+		if skip_locked(job) {
+			return
+		}
+		announce(job, "Append:    %s -> %s (from byte %d)\n", job.source, job.destination, job.offset)
+		if commit {
+			wait_for_load()
+			err := append_file(job.source, job.destination, job.offset)
+			if err == nil {
+				err = sync_metadata(job.source, job.destination)
+			}
+			if err == nil {
+				err = remember_deferred(job.source, job.destination)
+			}
+			if err == nil {
+				complete(job)
+			}
+			if err = tolerate(vanished(err, job.source), job.source, job.destination); err != nil {
+				fail(err)
+			}
+		}
+	case "link":
+		announce(job, "Link file: %s -> %s\n", job.source, job.destination)
+		stats.Lock()
+		stats.deduplicated++
+		stats.Unlock()
+		if commit {
+			err := os.Link(job.source, job.destination)
+			if err == nil {
+				complete(job)
+			}
+			if err = tolerate(err, job.source, job.destination); err != nil {
+				fail(err)
 			}
-		default:
-			panic(job.operation)
 		}
+	case "remove":
+		announce(job, "Remove:    %s (same as %s)\n", job.source, job.destination)
+		if commit {
+			if err := tolerate(os.Remove(job.source), job.source); err != nil {
+				fail(err)
+			}
+		}
+	case "metadata":
+		if skip_locked(job) {
+			return
+		}
+		announce(job, "Metadata:  %s -> %s (%s)\n", job.source, job.destination, job.metadata)
+		count_metadata(job.metadata)
+		if commit {
+			err := apply_metadata(job.source, job.destination, job.metadata)
+			if err == nil {
+				err = remember_deferred(job.source, job.destination)
+			}
+			if err == nil {
+				complete(job)
+			}
+			if err = tolerate(vanished(err, job.source), job.source, job.destination); err != nil {
+				fail(err)
+			}
+		}
+	default:
+		panic(job.operation)
+	}
+}
+
+// want_args bails out with the usage when a mode that doesn't merge gets
+// another number of arguments than n, so it never runs a merge instead.
+func want_args(args []string, n int, msg string) {
+	if len(args) != n {
+		fmt.Fprintln(os.Stderr, msg)
+		usage()
+		os.Exit(1)
 	}
 }
 
 func main() {
 	// process arguments
-	if len(os.Args) < 3 {
+	args, err := parse_args(os.Args[1:])
+	if err == nil {
+		err = check_options()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		usage()
+		os.Exit(1)
+	}
+	if opts.syslog {
+		syslog_sink, err = open_syslog(opts.syslog_facility, opts.syslog_tag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot log to syslog: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	error_roots = args
+	if opts.restore_chunks {
+		want_args(args, 2, "--restore-chunks takes the directory with chunk lists and the target directory")
+		restore_chunks(args[0], args[1], opts.commit)
+		return
+	}
+	if opts.chunk_gc && len(args) > 0 {
+		collect_chunks(args, opts.commit)
+		return
+	}
+	if opts.analyze_dedup {
+		want_args(args, 1, "--analyze-dedup takes only the directory to analyze")
+		analyze_dedup(args[0])
 		return
 	}
-	src_dir := os.Args[1]
-	dest_dir := os.Args[2]
-	commit := len(os.Args) == 4 && os.Args[3] == "--commit"
+	if opts.check_case_collisions {
+		want_args(args, 1, "--check-case-collisions takes only the source directory")
+		os.Exit(check_case_collisions(args[0]))
+	}
+	if opts.to_http != "" {
+		want_args(args, 1, "--to-http takes only the source directory")
+		upload(args[0], opts.to_http, opts.commit)
+		return
+	}
+	var plan *saved_plan
+	if opts.apply_plan != "" {
+		if plan, err = load_plan(opts.apply_plan); err != nil {
+			log_error("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if len(args) == 0 {
+			args = []string{plan.Source, plan.Destination}
+		} else if len(args) < 2 || args[0] != plan.Source || args[1] != plan.Destination {
+			log_error("Error: %s is a plan for %s and %s\n", opts.apply_plan, plan.Source, plan.Destination)
+			os.Exit(1)
+		}
+	}
+	if len(args) < 2 {
+		usage()
+		return
+	}
+	src_dir := args[0]
+	dest_dir := args[1]
+	error_roots = []string{src_dir, dest_dir}
+	commit := opts.commit
 	// check arguments
 	if commit {
-		fmt.Println("Going to commit changes this time! No dry run!")
+		notice("Going to commit changes this time! No dry run!\n")
 	}
 	if src_dir[len(src_dir)-1] == '/' || dest_dir[len(dest_dir)-1] == '/' {
-		fmt.Fprintf(os.Stderr, "Do not use trailing slash when specifying directories.")
+		log_error("Do not use trailing slash when specifying directories.")
 		return
 	}
+	if opts.move {
+		if err := check_move_dirs(src_dir, dest_dir); err != nil {
+			log_error("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := check_volatile_destination(dest_dir); err != nil {
+		log_error("Error: %v\n", err)
+		os.Exit(1)
+	}
 	// run
 	jobs := make([]job, 0)
-	prepare_merge(src_dir, dest_dir, &jobs)
-	execute_merge(&jobs, commit)
+	if opts.dest_index != "" {
+		index = load_dest_index(opts.dest_index, dest_dir)
+	}
+	if opts.diff {
+		status := diff_trees(src_dir, dest_dir)
+		if index != nil {
+			if err = index.save(opts.dest_index, dest_dir); err != nil {
+				panic(err)
+			}
+		}
+		print_summary()
+		os.Exit(status)
+	}
+	if plan != nil {
+		jobs = applied_plan(plan, commit)
+	} else {
+		prepare_merge(src_dir, dest_dir, &jobs)
+		if opts.dedupe {
+			if err := dedupe_jobs(&jobs); err != nil {
+				log_error("Error: %v. Bailing out!\n", err)
+				os.Exit(1)
+			}
+		}
+		if index != nil {
+			err = index.save(opts.dest_index, dest_dir)
+			if err != nil {
+				panic(err)
+			}
+		}
+		order_jobs(jobs)
+	}
+	if err := check_path_lengths(dest_dir, jobs); err != nil {
+		log_error("Error: %v. Bailing out!\n", err)
+		os.Exit(1)
+	}
+	if opts.save_plan != "" && plan == nil {
+		if err := save_plan(opts.save_plan, src_dir, dest_dir, jobs); err != nil {
+			panic(err)
+		}
+		notice("Plan written to: %s\n", opts.save_plan)
+	}
+	if commit && opts.backup_dest != "" && len(jobs) > 0 {
+		backup_destination(dest_dir)
+	}
+	// the snapshot goes first, it has the destination as it was
+	if !opts.no_temp_cleanup {
+		clean_temps(dest_dir, commit)
+		if opts.chunk_store != "" {
+			clean_temps(opts.chunk_store, commit)
+		}
+	}
+	if opts.atomic_swap {
+		swap_merge(src_dir, dest_dir, &jobs, commit)
+	} else {
+		execute_merge(&jobs, commit)
+	}
+	if commit && (opts.verify || opts.verify_cmd != "") {
+		verify_destination(completed_jobs(jobs))
+	}
+	if commit && opts.verify_links {
+		verify_links(completed_jobs(jobs))
+	}
+	if opts.merge_report != "" {
+		if commit {
+			err = write_merge_report(opts.merge_report, jobs)
+			if err != nil {
+				panic(err)
+			}
+			notice("Merge report written to: %s\n", opts.merge_report)
+		} else {
+			notice("Merge report is only written when using --commit.\n")
+		}
+	}
+	print_summary()
+	finish_summary(src_dir, dest_dir, jobs, commit)
+	if len(stats.failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+func count_metadata(d metadata_diff) {
+	stats.Lock()
+	defer stats.Unlock()
+	if d.mode {
+		stats.metadata_mode++
+	}
+	if d.owner {
+		stats.metadata_owner++
+	}
+	if d.times {
+		stats.metadata_times++
+	}
+	if d.xattrs {
+		stats.metadata_xattrs++
+	}
+}
+
+// upload runs safecp with an HTTP server as destination, see http.go.
+func upload(src_dir string, base string, commit bool) {
+	if commit {
+		notice("Going to commit changes this time! No dry run!\n")
+	}
+	if src_dir[len(src_dir)-1] == '/' {
+		log_error("Do not use trailing slash when specifying directories.")
+		return
+	}
+	jobs := make([]job, 0)
+	prepare_upload(src_dir, base, &jobs)
+	order_jobs(jobs)
+	execute_upload(jobs, commit)
+	print_summary()
+	finish_summary(src_dir, base, jobs, commit)
+	if len(stats.failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+func print_summary() {
+	if stats.skipped_empty > 0 {
+		notice("Skipped %d empty files\n", stats.skipped_empty)
+	}
+	if stats.skipped_non_empty > 0 {
+		notice("Skipped %d non-empty files\n", stats.skipped_non_empty)
+	}
+	if stats.skipped_missing > 0 {
+		notice("Skipped %d files missing in the destination\n", stats.skipped_missing)
+	}
+	if stats.skipped_readonly > 0 {
+		notice("Skipped %d read-only destination files\n", stats.skipped_readonly)
+	}
+	if stats.skipped_locked > 0 {
+		notice("Skipped %d destination files open in another process\n", stats.skipped_locked)
+	}
+	if stats.vanished > 0 {
+		notice("Skipped %d source files that vanished\n", stats.vanished)
+	}
+	if stats.skipped_links > 0 {
+		notice("Skipped %d symlinks\n", stats.skipped_links)
+	}
+	if stats.blocked_links > 0 {
+		notice("Blocked %d symlinks pointing outside of the source\n", stats.blocked_links)
+	}
+	if opts.metadata_only || opts.update_metadata {
+		notice("Metadata updates: %d mode, %d owner, %d times, %d xattrs\n",
+			stats.metadata_mode, stats.metadata_owner, stats.metadata_times, stats.metadata_xattrs)
+	}
+	if stats.deduplicated > 0 {
+		notice("Deduplicated %d files into hard links\n", stats.deduplicated)
+	}
+	if index != nil {
+		notice("Destination index: %d hashes reused, %d files hashed\n", stats.index_hits, stats.index_misses)
+	}
+	if stats.chunks_stored+stats.chunks_reused > 0 {
+		notice("Chunk store: %d chunks stored (%d bytes), %d already there\n", stats.chunks_stored, stats.chunk_bytes, stats.chunks_reused)
+	}
+	if len(stats.failed) > 0 {
+		notice("Failed %d jobs:\n", len(stats.failed))
+		for _, e := range stats.failed {
+			notice("  %s\n", e)
+		}
+	}
+	if len(stats.ignored_errors) > 0 {
+		notice("Ignored %d errors:\n", len(stats.ignored_errors))
+		for _, e := range stats.ignored_errors {
+			notice("  %s\n", e)
+		}
+	}
 }
 
 // below code taken from https://stackoverflow.com/a/21067803/1958831
@@ -141,8 +975,17 @@ func CopyFile(src, dst string) (err error) {
 			return
 		}
 	}
-	if err = os.Link(src, dst); err == nil {
-		return
+	if opts.chunk_store != "" {
+		return write_chunk_list(src, dst)
+	}
+	if opts.template_attrs == "" {
+		// a hard link would get the template applied to the source too
+		if err = os.Link(src, dst); err == nil {
+			return
+		}
+	}
+	if opts.partial_dir != "" {
+		return copy_with_partial(src, dst)
 	}
 	err = copyFileContents(src, dst)
 	return
@@ -168,27 +1011,37 @@ func copyFileContents(src, dst string) (err error) {
 			err = cerr
 		}
 	}()
-	if _, err = io.Copy(out, in); err != nil {
+	if opts.sparse {
+		err = copy_sparse(out, in)
+	} else {
+		_, err = copy_data(out, in)
+	}
+	if err != nil {
+		return
+	}
+	if err = out.Sync(); err != nil {
 		return
 	}
-	err = out.Sync()
+	done_with(in, out)
 	return
 }
 
 // taken from https://mrwaggel.be/post/generate-md5-hash-of-a-file-in-golang/
+// (and made to work with any of the hashers)
 
-func hash_file_md5(filePath string) (string, error) {
-	var returnMD5String string
+func hash_file(filePath string, algorithm string) (string, error) {
+	var returnHashString string
 	file, err := os.Open(filePath)
 	if err != nil {
-		return returnMD5String, err
+		return returnHashString, err
 	}
 	defer file.Close()
-	hash := md5.New()
+	hash := hashers[algorithm]()
 	if _, err := io.Copy(hash, file); err != nil {
-		return returnMD5String, err
+		return returnHashString, err
 	}
-	hashInBytes := hash.Sum(nil)[:16]
-	returnMD5String = hex.EncodeToString(hashInBytes)
-	return returnMD5String, nil
+	done_with(file)
+	hashInBytes := hash.Sum(nil)
+	returnHashString = hex.EncodeToString(hashInBytes)
+	return returnHashString, nil
 }
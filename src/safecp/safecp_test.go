@@ -0,0 +1,185 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// The tests run safecp in two ways. Whole runs go through run_safecp, which
+// starts the test binary again with main() as entry point, so os.Exit and
+// the global state of a run can't leak into other tests. Parts that are
+// replaced by something fake (a clock, the load average, ...) are tested in
+// process, after reset() has given every test the default options.
+
+// default_opts are the options before any test changed them.
+var default_opts options
+
+func TestMain(m *testing.M) {
+	default_opts = opts
+	if os.Getenv("SAFECP_TEST_MAIN") == "1" {
+		os.Args = append([]string{"safecp"}, strings.Split(os.Getenv("SAFECP_TEST_ARGS"), "\x1f")...)
+		// commands safecp runs itself are not safecp
+		os.Unsetenv("SAFECP_TEST_MAIN")
+		os.Unsetenv("SAFECP_TEST_ARGS")
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// run_safecp runs safecp with args in dir, and returns what it printed to
+// stdout and stderr and its exit status.
+func run_safecp(t *testing.T, dir string, args ...string) (string, string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "SAFECP_TEST_MAIN=1", "SAFECP_TEST_ARGS="+strings.Join(args, "\x1f"))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return stdout.String(), stderr.String(), exit.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), 0
+}
+
+// must_run is run_safecp for runs that have to succeed.
+func must_run(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	stdout, stderr, status := run_safecp(t, dir, args...)
+	if status != 0 {
+		t.Fatalf("safecp %s: exit status %d\n%s%s", strings.Join(args, " "), status, stdout, stderr)
+	}
+	return stdout
+}
+
+// write_tree creates the files in files below root, keyed by their path
+// relative to root with / as separator. A key ending in / is a directory.
+func write_tree(t testing.TB, root string, files map[string]string) {
+	t.Helper()
+	for rel, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		if strings.HasSuffix(rel, "/") {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// read_tree returns the regular files below root like write_tree takes
+// them, without the directories.
+func read_tree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+		if err != nil || !f.Mode().IsRegular() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		files[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// names returns the sorted keys of files.
+func names(files map[string]string) []string {
+	keys := make([]string, 0, len(files))
+	for rel := range files {
+		keys = append(keys, rel)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func same_names(t *testing.T, files map[string]string, want ...string) {
+	t.Helper()
+	sort.Strings(want)
+	if got := names(files); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got files %q, want %q", got, want)
+	}
+}
+
+// reset gives the test the default options and empty counters, and again
+// when it is done.
+func reset(t testing.TB) {
+	opts = default_opts
+	stats = summary{}
+	t.Cleanup(func() {
+		opts = default_opts
+		stats = summary{}
+	})
+}
+
+func TestExcludeEmptyFiles(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"empty": "", "full": "data", "sub/empty": ""})
+	out := must_run(t, dir, "src", "dst", "--exclude-empty-files", "--commit")
+	same_names(t, read_tree(t, filepath.Join(dir, "dst")), "full")
+	if !strings.Contains(out, "Skipped 2 empty files") {
+		t.Errorf("the summary doesn't count the skipped files:\n%s", out)
+	}
+}
+
+func TestOnlyEmptyFiles(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"empty": "", "full": "data", "sub/empty": ""})
+	must_run(t, dir, "src", "dst", "--only-empty-files", "--commit")
+	same_names(t, read_tree(t, filepath.Join(dir, "dst")), "empty", "sub/empty")
+}
+
+func TestEmptyFileFiltersExcludeEachOther(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"full": "data"})
+	if _, _, status := run_safecp(t, dir, "src", "dst", "--only-empty-files", "--exclude-empty-files"); status == 0 {
+		t.Error("combining --only-empty-files and --exclude-empty-files is accepted")
+	}
+}
+
+func TestPortable(t *testing.T) {
+	reset(t)
+	rel := filepath.Join("a", "b", "c")
+	if got := portable(rel); got != "a/b/c" {
+		t.Errorf("portable(%q) = %q by default", rel, got)
+	}
+	if _, err := parse_args([]string{"--path-separator=native"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := portable(rel); got != rel {
+		t.Errorf("portable(%q) = %q with --path-separator=native", rel, got)
+	}
+	if _, err := parse_args([]string{"--path-separator=backslash"}); err == nil || !strings.Contains(err.Error(), "use slash or native") {
+		t.Errorf("an unknown separator gave %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// With --selinux (Linux) the SELinux security context of the source, its
+// security.selinux xattr, goes to everything safecp writes. A new file gets
+// the default context of its directory, and an overwrite renames a new file
+// into place, so the context is set after all jobs are done, like the
+// inode flags (but before them, an immutable file can't get a context
+// anymore). It is also no longer left out of comparing and copying xattrs,
+// with --update-metadata files with another context are updated. Setting a
+// context mostly requires privileges, without those that is a warning, or
+// an error with --strict.
+const selinux_xattr = "security.selinux"
+
+var deferred_contexts struct {
+	sync.Mutex
+	paths    []string
+	contexts [][]byte
+}
+
+// remember_context reads the context of src so it can be applied to dst at
+// the end of the run.
+func remember_context(src string, dst string) error {
+	if !opts.selinux {
+		return nil
+	}
+	xattrs, err := list_xattrs(src)
+	if err != nil {
+		return err
+	}
+	context, ok := xattrs[selinux_xattr]
+	if !ok {
+		return nil
+	}
+	deferred_contexts.Lock()
+	deferred_contexts.paths = append(deferred_contexts.paths, dst)
+	deferred_contexts.contexts = append(deferred_contexts.contexts, context)
+	deferred_contexts.Unlock()
+	return nil
+}
+
+// remember_deferred remembers what is applied to dst at the end of the run.
+func remember_deferred(src string, dst string) error {
+	if err := remember_context(src, dst); err != nil {
+		return err
+	}
+	return remember_flags(src, dst)
+}
+
+// apply_deferred_contexts sets the remembered contexts.
+func apply_deferred_contexts(commit bool) error {
+	for i, path := range deferred_contexts.paths {
+		context := deferred_contexts.contexts[i]
+		info("Set context: %s (%s)\n", path, strings.TrimRight(string(context), "\x00"))
+		if !commit {
+			continue
+		}
+		if err := set_xattr(path, selinux_xattr, context); err != nil {
+			if opts.strict {
+				return fmt.Errorf("cannot set the SELinux context of %s: %v", path, err)
+			}
+			warning("cannot set the SELinux context of %s: %v", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func forget_contexts(t *testing.T) {
+	t.Cleanup(func() { deferred_contexts.paths, deferred_contexts.contexts = nil, nil })
+}
+
+func TestSelinuxIncludesTheContext(t *testing.T) {
+	reset(t)
+	if !xattr_excluded(selinux_xattr) {
+		t.Error("the SELinux context is copied without --selinux")
+	}
+	if _, err := parse_args([]string{"--selinux"}); err != nil {
+		t.Fatal(err)
+	}
+	if xattr_excluded(selinux_xattr) {
+		t.Error("--selinux still leaves out the SELinux context")
+	}
+	if err := check_options(); (err == nil) != selinux_supported {
+		t.Errorf("check_options with --selinux gave %v", err)
+	}
+}
+
+func TestRememberContext(t *testing.T) {
+	reset(t)
+	forget_contexts(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src": "x"})
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := remember_context(src, dst); err != nil || len(deferred_contexts.paths) != 0 {
+		t.Fatalf("remembered %q (%v) without --selinux", deferred_contexts.paths, err)
+	}
+	opts.selinux = true
+	xattrs, _ := list_xattrs(src)
+	if _, ok := xattrs[selinux_xattr]; !ok {
+		t.Skip("the test directory has no SELinux contexts")
+	}
+	if err := remember_context(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if len(deferred_contexts.paths) != 1 || deferred_contexts.paths[0] != dst || string(deferred_contexts.contexts[0]) != string(xattrs[selinux_xattr]) {
+		t.Errorf("remembered %q %q", deferred_contexts.paths, deferred_contexts.contexts)
+	}
+}
+
+func TestApplyContexts(t *testing.T) {
+	reset(t)
+	forget_contexts(t)
+	missing := filepath.Join(t.TempDir(), "missing")
+	deferred_contexts.paths = []string{missing}
+	deferred_contexts.contexts = [][]byte{[]byte("system_u:object_r:user_home_t:s0\x00")}
+	if err := apply_deferred_contexts(false); err != nil {
+		t.Errorf("a dry run gave %v", err)
+	}
+	if err := apply_deferred_contexts(true); err != nil {
+		t.Errorf("a context that cannot be set is an error without --strict: %v", err)
+	}
+	opts.strict = true
+	if err := apply_deferred_contexts(true); err == nil || !strings.Contains(err.Error(), "cannot set the SELinux context of "+missing) {
+		t.Errorf("a context that cannot be set with --strict gave %v", err)
+	}
+}
+
+func TestSelinuxMove(t *testing.T) {
+	reset(t)
+	forget_contexts(t)
+	opts.selinux = true
+	opts.move = true
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src/a": "a", "src/b": "b"})
+	src, dst := filepath.Join(dir, "src", "a"), filepath.Join(dir, "a")
+	xattrs, _ := list_xattrs(src)
+	context, ok := xattrs[selinux_xattr]
+	if !ok {
+		t.Skip("the test directory has no SELinux contexts")
+	}
+	if err := move_file(src, dst, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(deferred_contexts.paths) != 1 || deferred_contexts.paths[0] != dst || string(deferred_contexts.contexts[0]) != string(context) {
+		t.Errorf("moving remembered %q %q", deferred_contexts.paths, deferred_contexts.contexts)
+	}
+	out := must_run(t, dir, "src", "dst", "--selinux", "--move", "--commit")
+	if !strings.Contains(out, "Set context: ") || !strings.Contains(out, filepath.Join("dst", "b")+" (") {
+		t.Errorf("the moved file got no context:\n%s", out)
+	}
+}
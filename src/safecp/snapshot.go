@@ -0,0 +1,169 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// With --backup-dest=dir|tar the whole destination is copied next to itself
+// before anything is changed, as <target_dir>.backup-YYYYMMDD-HHMMSS (or the
+// same name with .tar appended), so the state from before the run can always
+// be restored. Nothing is made when the destination is empty or there is
+// nothing to do. The copy is a real copy, not hard links, so that changes
+// made to destination files afterwards can't reach it.
+
+// snapshot_destination makes the snapshot and returns its location, or ""
+// when none was needed.
+func snapshot_destination(dest_dir string, kind string) (string, error) {
+	entries, err := os.ReadDir(dest_dir)
+	if os.IsNotExist(err) || (err == nil && len(entries) == 0) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Clean(dest_dir) + ".backup-" + time.Now().Format("20060102-150405")
+	if kind == "tar" {
+		target += ".tar"
+		return target, snapshot_tar(dest_dir, target)
+	}
+	return target, snapshot_dir(dest_dir, target)
+}
+
+func snapshot_dir(dest_dir string, target string) error {
+	return clone_tree(dest_dir, target, nil)
+}
+
+// clone_tree recreates the tree at from as target, which must not exist.
+// Regular files are copied, or hard linked when link returns true for them.
+// Without link other special files are left out with a warning.
+func clone_tree(from string, target string, link func(path string) bool) error {
+	err := filepath.Walk(from, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		to := target + path[len(from):]
+		switch {
+		case f.IsDir():
+			if err := os.Mkdir(to, f.Mode()&mode_bits|0700); err != nil {
+				return err
+			}
+			// the final mode (which might lack the write bit) goes on
+			// once the directory is filled, see below
+			return nil
+		case f.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, to)
+		case f.Mode().IsRegular():
+			if link != nil && link(path) && os.Link(path, to) == nil {
+				return nil
+			}
+			if err := copyFileContents(path, to); err != nil {
+				return err
+			}
+			if err := os.Chmod(to, f.Mode()&mode_bits); err != nil {
+				return err
+			}
+			return os.Chtimes(to, time.Time{}, f.ModTime())
+		default:
+			if link != nil {
+				// nothing can be left out of a staging tree, see swap.go
+				return os.Link(path, to)
+			}
+			warning("not including %s in the snapshot, it is not a regular file", path)
+			return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(from, func(path string, f os.FileInfo, err error) error {
+		if err != nil || !f.IsDir() {
+			return err
+		}
+		return os.Chmod(target+path[len(from):], f.Mode()&mode_bits)
+	})
+}
+
+func snapshot_tar(dest_dir string, target string) (err error) {
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return
+	}
+	defer func() {
+		cerr := out.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	tw := tar.NewWriter(out)
+	err = filepath.Walk(dest_dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		link := ""
+		if f.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else if !f.IsDir() && !f.Mode().IsRegular() {
+			warning("not including %s in the snapshot, it is not a regular file", path)
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(f, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = portable(relative(path[len(dest_dir):]))
+		if hdr.Name == "" {
+			hdr.Name = "."
+		}
+		if f.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !f.Mode().IsRegular() {
+			return nil
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(tw, in)
+		return err
+	})
+	if err != nil {
+		return
+	}
+	if err = tw.Close(); err != nil {
+		return
+	}
+	return out.Sync()
+}
+
+// backup_destination runs the snapshot for --backup-dest, the run is over
+// when that fails.
+func backup_destination(dest_dir string) {
+	where, err := snapshot_destination(dest_dir, opts.backup_dest)
+	if err != nil {
+		log_error("Error: snapshot of the destination failed: %v. Bailing out!\n", err)
+		os.Exit(1)
+	}
+	if where != "" {
+		notice("Snapshot of the destination written to: %s\n", where)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// tar_entries returns the content of the tar file at path by entry name,
+// directories have "/" as content.
+func tar_entries(t *testing.T, path string) map[string]string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	entries := make(map[string]string)
+	r := tar.NewReader(file)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(r)
+		if hdr.Typeflag == tar.TypeDir {
+			data = []byte("/")
+		}
+		entries[hdr.Name] = string(data)
+	}
+}
+
+func TestSnapshotDir(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "dst")
+	write_tree(t, dst, map[string]string{"a": "a", "sub/b": "b"})
+	target, err := snapshot_destination(dst, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(filepath.Base(target), "dst.backup-") {
+		t.Errorf("snapshot is called %s", target)
+	}
+	// a copy, not a hard link
+	os.WriteFile(filepath.Join(dst, "a"), []byte("changed"), 0644)
+	if got := read_tree(t, target); got["a"] != "a" || got["sub/b"] != "b" {
+		t.Errorf("snapshot has %v", got)
+	}
+}
+
+func TestSnapshotTar(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "dst")
+	write_tree(t, dst, map[string]string{"a": "a", "sub/b": "b"})
+	target, err := snapshot_destination(dst, "tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(target, ".tar") {
+		t.Errorf("tar snapshot is called %s", target)
+	}
+	entries := tar_entries(t, target)
+	keys := make([]string, 0)
+	for name := range entries {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, " ") != "./ a sub/ sub/b" || entries["sub/b"] != "b" {
+		t.Errorf("tar has %q", entries)
+	}
+}
+
+func TestNoSnapshotOfAnEmptyDestination(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	if target, err := snapshot_destination(filepath.Join(dir, "missing"), "dir"); target != "" || err != nil {
+		t.Errorf("got snapshot %q (%v) of a missing destination", target, err)
+	}
+	if target, err := snapshot_destination(dir, "tar"); target != "" || err != nil {
+		t.Errorf("got snapshot %q (%v) of an empty destination", target, err)
+	}
+}
+
+func TestBackupDestRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "new"})
+	write_tree(t, filepath.Join(dir, "dst"), map[string]string{"a": "old"})
+	must_run(t, dir, "src", "dst", "--overwrite", "--backup-dest=dir", "--commit")
+	backups, _ := filepath.Glob(filepath.Join(dir, "dst.backup-*"))
+	if len(backups) != 1 {
+		t.Fatalf("got backups %q", backups)
+	}
+	if got := read_tree(t, backups[0]); got["a"] != "old" {
+		t.Errorf("backup has %v", got)
+	}
+	// nothing to do, no backup
+	must_run(t, dir, "src", "dst", "--overwrite", "--backup-dest=dir", "--commit")
+	if again, _ := filepath.Glob(filepath.Join(dir, "dst.backup-*")); len(again) != 1 {
+		t.Errorf("got backups %q after a run without changes", again)
+	}
+}
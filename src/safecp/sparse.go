@@ -0,0 +1,68 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+// With --sparse holes in source files stay holes in their copies. On Linux
+// the data regions of the source are found with SEEK_DATA and SEEK_HOLE and
+// only those are copied, so a copy is allocated exactly like its source,
+// including zero bytes that are stored for real. Where that is not available
+// blocks of sparse_block zero bytes become holes instead. Resumed copies
+// (--partial-dir) and appends are not sparse.
+
+const sparse_block = 4096
+
+// no_extents is returned by copy_extents when the platform or filesystem
+// can't tell where the data is.
+var no_extents = errors.New("data regions can't be listed")
+
+// copy_sparse copies in to out (both at offset 0) without filling holes.
+func copy_sparse(out *os.File, in *os.File) error {
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	err = copy_extents(out, in, fi.Size())
+	if err == no_extents {
+		err = copy_zero_scan(out, in)
+	}
+	if err != nil {
+		return err
+	}
+	return out.Truncate(fi.Size())
+}
+
+// copy_zero_scan copies in to out, seeking over blocks that are all zero.
+func copy_zero_scan(out *os.File, in *os.File) error {
+	r := throttled(in)
+	buf := make([]byte, sparse_block)
+	zero := make([]byte, sparse_block)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if bytes.Equal(buf[:n], zero[:n]) {
+				_, werr := out.Seek(int64(n), io.SeekCurrent)
+				if werr != nil {
+					return werr
+				}
+			} else if _, werr := out.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
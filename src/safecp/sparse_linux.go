@@ -0,0 +1,54 @@
+//go:build linux
+
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// lseek whence values from linux/fs.h
+const (
+	seek_data = 3
+	seek_hole = 4
+)
+
+// copy_extents copies the data regions of in to the same offsets in out.
+func copy_extents(out *os.File, in *os.File, size int64) error {
+	var pos int64
+	for pos < size {
+		data, err := in.Seek(pos, seek_data)
+		if errors.Is(err, syscall.ENXIO) {
+			// only a hole after pos
+			return nil
+		}
+		if errors.Is(err, syscall.EINVAL) && pos == 0 {
+			return no_extents
+		}
+		if err != nil {
+			return err
+		}
+		hole, err := in.Seek(data, seek_hole)
+		if err != nil {
+			return err
+		}
+		if _, err := in.Seek(data, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := out.Seek(data, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := copy_data(out, io.LimitReader(in, hole-data)); err != nil {
+			return err
+		}
+		pos = hole
+	}
+	return nil
+}
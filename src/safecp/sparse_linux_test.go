@@ -0,0 +1,49 @@
+//go:build linux
+
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func allocated(t *testing.T, path string) int64 {
+	t.Helper()
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	return st.Blocks * 512
+}
+
+func TestCopySparseKeepsHoles(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	size := int64(1024 * sparse_block)
+	sparse_source(t, src, size/2, size)
+	if allocated(t, src) >= size/2 {
+		t.Skip("the filesystem of the test directory doesn't make sparse files")
+	}
+	sparse_copy(t, src, dst, copy_sparse)
+	if got := allocated(t, dst); got > allocated(t, src) {
+		t.Errorf("the copy uses %d bytes, the source %d", got, allocated(t, src))
+	}
+	// the zero scan makes holes too, where the platform can't list data
+	sparse_copy(t, src, dst, func(out *os.File, in *os.File) error {
+		if err := copy_zero_scan(out, in); err != nil {
+			return err
+		}
+		return out.Truncate(size)
+	})
+	if got := allocated(t, dst); got > allocated(t, src)+sparse_block {
+		t.Errorf("the zero scan copy uses %d bytes, the source %d", got, allocated(t, src))
+	}
+}
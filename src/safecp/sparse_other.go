@@ -0,0 +1,15 @@
+//go:build !linux
+
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import "os"
+
+// copy_extents always leaves it to the zero scan on this platform.
+func copy_extents(out *os.File, in *os.File, size int64) error {
+	return no_extents
+}
@@ -0,0 +1,92 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sparse_source makes a file of size bytes with data only at the start and
+// at offset hole.
+func sparse_source(t *testing.T, path string, hole int64, size int64) []byte {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.Write([]byte("start"))
+	file.WriteAt([]byte("after the hole"), hole)
+	if err := file.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, size)
+	copy(content, "start")
+	copy(content[hole:], "after the hole")
+	return content
+}
+
+func sparse_copy(t *testing.T, src string, dst string, copier func(out *os.File, in *os.File) error) []byte {
+	t.Helper()
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if err := copier(out, in); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCopySparse(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	// ends in a hole, which only the final truncate makes
+	want := sparse_source(t, src, 64*sparse_block, 128*sparse_block)
+	if got := sparse_copy(t, src, filepath.Join(dir, "dst"), copy_sparse); !bytes.Equal(got, want) {
+		t.Errorf("the copy has %d bytes that differ from the source", len(got))
+	}
+}
+
+func TestCopyZeroScan(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	want := sparse_source(t, src, 3*sparse_block+7, 5*sparse_block+100)
+	copier := func(out *os.File, in *os.File) error {
+		if err := copy_zero_scan(out, in); err != nil {
+			return err
+		}
+		return out.Truncate(int64(len(want)))
+	}
+	if got := sparse_copy(t, src, filepath.Join(dir, "dst"), copier); !bytes.Equal(got, want) {
+		t.Error("the copy differs from the source")
+	}
+}
+
+func TestSparseRun(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "src"), 0755)
+	want := sparse_source(t, filepath.Join(dir, "src", "disk.img"), 16*sparse_block, 32*sparse_block)
+	must_run(t, dir, "src", "dst", "--sparse", "--commit")
+	if got, _ := os.ReadFile(filepath.Join(dir, "dst", "disk.img")); !bytes.Equal(got, want) {
+		t.Error("the copy differs from the source")
+	}
+}
@@ -0,0 +1,79 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// While planning, the same destination path gets stat'ed several times to
+// decide on it (does it exist, is it in the index, is it read-only, does
+// its metadata differ), and the source path once more after the walk
+// already did. That adds up on a network mount, so planning remembers the
+// result for every path it stat'ed. Nothing changes the destination while
+// planning. The cache is dropped once the plan is made, executing the jobs
+// always sees the current state.
+
+type stat_result struct {
+	fi  os.FileInfo
+	err error
+}
+
+var stat_cache struct {
+	sync.Mutex
+	results map[string]stat_result
+}
+
+// stat_path is a variable so that the calls the cache saves can be counted.
+var stat_path = os.Stat
+
+// start_stat_cache turns the cache on, stop_stat_cache drops it.
+func start_stat_cache() {
+	stat_cache.Lock()
+	stat_cache.results = make(map[string]stat_result)
+	stat_cache.Unlock()
+}
+
+func stop_stat_cache() {
+	stat_cache.Lock()
+	stat_cache.results = nil
+	stat_cache.Unlock()
+}
+
+// cached_stat is os.Stat, answered from the cache while planning.
+func cached_stat(path string) (os.FileInfo, error) {
+	stat_cache.Lock()
+	if stat_cache.results == nil {
+		stat_cache.Unlock()
+		return stat_path(path)
+	}
+	r, ok := stat_cache.results[path]
+	stat_cache.Unlock()
+	if ok {
+		return r.fi, r.err
+	}
+	fi, err := stat_path(path)
+	stat_cache.Lock()
+	if stat_cache.results != nil {
+		stat_cache.results[path] = stat_result{fi, err}
+	}
+	stat_cache.Unlock()
+	return fi, err
+}
+
+// remember_stat puts what the walk found for path in the cache, which is
+// what os.Stat gives unless it is a symlink.
+func remember_stat(path string, f os.FileInfo) {
+	if f.Mode()&os.ModeSymlink != 0 {
+		return
+	}
+	stat_cache.Lock()
+	if stat_cache.results != nil {
+		stat_cache.results[path] = stat_result{f, nil}
+	}
+	stat_cache.Unlock()
+}
@@ -0,0 +1,106 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// count_stats makes stat_path count the stats of every path.
+func count_stats(t *testing.T) func(path string) int {
+	var counted struct {
+		sync.Mutex
+		stats map[string]int
+	}
+	counted.stats = make(map[string]int)
+	stat_path = func(path string) (os.FileInfo, error) {
+		counted.Lock()
+		counted.stats[path]++
+		counted.Unlock()
+		return os.Stat(path)
+	}
+	t.Cleanup(func() { stat_path = os.Stat })
+	return func(path string) int {
+		counted.Lock()
+		defer counted.Unlock()
+		return counted.stats[path]
+	}
+}
+
+func TestCachedStat(t *testing.T) {
+	stats_of := count_stats(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"a": "a", "b": "b"})
+	a, missing := filepath.Join(dir, "a"), filepath.Join(dir, "missing")
+	cached_stat(a)
+	cached_stat(a)
+	if stats_of(a) != 2 {
+		t.Errorf("stat'ed %d times outside of planning, want 2", stats_of(a))
+	}
+	start_stat_cache()
+	defer stop_stat_cache()
+	for i := 0; i < 3; i++ {
+		cached_stat(a)
+		if _, err := cached_stat(missing); !os.IsNotExist(err) {
+			t.Errorf("a missing file gave %v", err)
+		}
+	}
+	if stats_of(a) != 3 || stats_of(missing) != 1 {
+		t.Errorf("stat'ed a %d and missing %d times while planning", stats_of(a)-2, stats_of(missing))
+	}
+	// what the walk found needs no stat at all
+	b := filepath.Join(dir, "b")
+	fi, _ := os.Lstat(b)
+	remember_stat(b, fi)
+	if got, err := cached_stat(b); err != nil || got.Size() != 1 || stats_of(b) != 0 {
+		t.Errorf("a remembered stat gave %v (%v) after %d stats", got, err, stats_of(b))
+	}
+	stop_stat_cache()
+	cached_stat(a)
+	if stats_of(a) != 4 {
+		t.Error("the cache is still used after planning")
+	}
+}
+
+func TestRememberStatSkipsSymlinks(t *testing.T) {
+	stats_of := count_stats(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"file": "content"})
+	link := filepath.Join(dir, "link")
+	symlink(t, "file", link)
+	start_stat_cache()
+	defer stop_stat_cache()
+	fi, _ := os.Lstat(link)
+	remember_stat(link, fi)
+	if got, err := cached_stat(link); err != nil || got.Mode()&os.ModeSymlink != 0 || stats_of(link) != 1 {
+		t.Errorf("got %v (%v), want the file the link points to", got, err)
+	}
+}
+
+func TestPlanningStatsEveryPathOnce(t *testing.T) {
+	reset(t)
+	opts.overwrite = true
+	opts.update_metadata = true
+	stats_of := count_stats(t)
+	dir := t.TempDir()
+	tree := map[string]string{"a": "a", "sub/b": "b"}
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	write_tree(t, src, tree)
+	write_tree(t, dst, tree)
+	jobs := make([]job, 0)
+	prepare_merge(src, dst, &jobs)
+	for _, rel := range []string{"a", "sub", filepath.Join("sub", "b")} {
+		if n := stats_of(filepath.Join(dst, rel)); n != 1 {
+			t.Errorf("planning stat'ed %s %d times, want once", filepath.Join("dst", rel), n)
+		}
+		if n := stats_of(filepath.Join(src, rel)); n > 0 {
+			t.Errorf("planning stat'ed %s %d times after the walk", filepath.Join("src", rel), n)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// With --summary-json=FILE the numbers of a run are written to FILE at the
+// end, and with --compare-to=FILE those of an earlier run are read from FILE
+// and the differences printed, so something like a backup that suddenly
+// copies everything stands out. Both can name the same file, it is read
+// before it is written.
+
+type run_summary struct {
+	Time          time.Time      `json:"time"`
+	Source        string         `json:"source"`
+	Destination   string         `json:"destination"`
+	Commit        bool           `json:"commit"`
+	Seconds       float64        `json:"seconds"`
+	SourceFiles   int64          `json:"source_files"`
+	SourceBytes   int64          `json:"source_bytes"`
+	TransferBytes int64          `json:"transfer_bytes"`
+	Jobs          map[string]int `json:"jobs"`
+	Failed        int            `json:"failed"`
+	Ignored       int            `json:"ignored_errors"`
+}
+
+// run_started is when main started, for the duration in the summary.
+var run_started = time.Now()
+
+// count_source adds a walked source file to the summary numbers.
+func count_source(f os.FileInfo) {
+	if !f.Mode().IsRegular() {
+		return
+	}
+	stats.Lock()
+	stats.source_files++
+	stats.source_bytes += f.Size()
+	stats.Unlock()
+}
+
+func make_run_summary(src_dir string, dest_dir string, jobs []job, commit bool) run_summary {
+	s := run_summary{Time: run_started, Source: src_dir, Destination: dest_dir, Commit: commit,
+		Seconds:     time.Since(run_started).Seconds(),
+		SourceFiles: stats.source_files, SourceBytes: stats.source_bytes, Jobs: make(map[string]int),
+		Failed: len(stats.failed), Ignored: len(stats.ignored_errors)}
+	for _, j := range jobs {
+		s.Jobs[j.operation]++
+		if transfers(j) {
+			s.TransferBytes += j.size - j.offset
+		}
+	}
+	return s
+}
+
+func read_run_summary(file string) (run_summary, error) {
+	var s run_summary
+	data, err := os.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(data, &s)
+	}
+	return s, err
+}
+
+func write_run_summary(file string, s run_summary) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(data, '\n'), 0644)
+}
+
+// compare_summaries prints how now differs from an earlier run.
+func compare_summaries(before run_summary, now run_summary) {
+	notice("Compared to the run of %s:\n", before.Time.Format(time.RFC3339))
+	delta := func(name string, a int64, b int64) {
+		if a == b {
+			notice("  %-16s %d (same)\n", name, b)
+			return
+		}
+		line := ""
+		if a > 0 && b > 0 && (b >= 2*a || 2*b <= a) {
+			line = " " + format_ratio(float64(b)/float64(a))
+		}
+		notice("  %-16s %d -> %d (%+d)%s\n", name, a, b, b-a, line)
+	}
+	delta("source files", before.SourceFiles, now.SourceFiles)
+	delta("source bytes", before.SourceBytes, now.SourceBytes)
+	delta("transfer bytes", before.TransferBytes, now.TransferBytes)
+	operations := make([]string, 0)
+	for operation := range before.Jobs {
+		operations = append(operations, operation)
+	}
+	for operation := range now.Jobs {
+		if _, ok := before.Jobs[operation]; !ok {
+			operations = append(operations, operation)
+		}
+	}
+	sort.Strings(operations)
+	for _, operation := range operations {
+		delta(operation+" jobs", int64(before.Jobs[operation]), int64(now.Jobs[operation]))
+	}
+	delta("failed jobs", int64(before.Failed), int64(now.Failed))
+}
+
+func format_ratio(r float64) string {
+	if r >= 1 {
+		return "[" + strconv.FormatFloat(r, 'f', 1, 64) + "x more]"
+	}
+	return "[" + strconv.FormatFloat(1/r, 'f', 1, 64) + "x less]"
+}
+
+// finish_summary takes care of --compare-to and --summary-json.
+func finish_summary(src_dir string, dest_dir string, jobs []job, commit bool) {
+	if opts.summary_json == "" && opts.compare_to == "" {
+		return
+	}
+	now := make_run_summary(src_dir, dest_dir, jobs, commit)
+	if opts.compare_to != "" {
+		before, err := read_run_summary(opts.compare_to)
+		if err != nil {
+			warning("cannot compare to the earlier run: %v", err)
+		} else {
+			compare_summaries(before, now)
+		}
+	}
+	if opts.summary_json != "" {
+		if err := write_run_summary(opts.summary_json, now); err != nil {
+			warning("cannot write the summary: %v", err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormatRatio(t *testing.T) {
+	cases := map[float64]string{2: "[2.0x more]", 10.25: "[10.2x more]", 0.5: "[2.0x less]", 0.1: "[10.0x less]"}
+	for r, want := range cases {
+		if got := format_ratio(r); got != want {
+			t.Errorf("format_ratio(%v) = %s, want %s", r, got, want)
+		}
+	}
+}
+
+func TestSummaryJSONRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "12345", "sub/b": "123"})
+	must_run(t, dir, "src", "dst", "--summary-json=summary.json")
+	s, err := read_run_summary(filepath.Join(dir, "summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Source != "src" || s.Commit || s.SourceFiles != 2 || s.SourceBytes != 8 || s.TransferBytes != 8 {
+		t.Errorf("got summary %+v", s)
+	}
+	if s.Jobs["copy"] != 2 || s.Jobs["mkdir"] != 2 {
+		t.Errorf("got jobs %v, want 2 copies and 2 directories", s.Jobs)
+	}
+}
+
+func TestSummaryJSONMove(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "12345", "sub/b": "123"})
+	must_run(t, dir, "src", "dst", "--move", "--summary-json=summary.json", "--commit")
+	s, err := read_run_summary(filepath.Join(dir, "summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sources are gone by the time the summary is made
+	if s.TransferBytes != 8 {
+		t.Errorf("got %d transfer bytes for a move, want 8", s.TransferBytes)
+	}
+}
+
+func TestCompareTo(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a", "b": "b"})
+	must_run(t, dir, "src", "dst", "--summary-json=summary.json", "--commit")
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"c": "c", "d": "d", "e": "e", "f": "f"})
+	// reads the earlier run before writing this one to the same file
+	out := must_run(t, dir, "src", "dst", "--compare-to=summary.json", "--summary-json=summary.json")
+	for _, line := range []string{
+		"  source files     2 -> 6 (+4) [3.0x more]\n",
+		"  copy jobs        2 -> 4 (+2) [2.0x more]\n",
+		"  mkdir jobs       1 -> 0 (-1)\n",
+		"  failed jobs      0 (same)\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("output has no %q:\n%s", line, out)
+		}
+	}
+	if s, _ := read_run_summary(filepath.Join(dir, "summary.json")); s.SourceFiles != 6 {
+		t.Errorf("the summary wasn't replaced: %+v", s)
+	}
+}
+
+func TestCompareToMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a"})
+	if _, stderr, status := run_safecp(t, dir, "src", "dst", "--compare-to=missing.json"); status != 0 || !strings.Contains(stderr, "cannot compare to the earlier run") {
+		t.Errorf("a missing --compare-to file gave status %d\n%s", status, stderr)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// With --atomic-swap the destination is not touched while the jobs run.
+// They are executed in a staging tree <target_dir>.safecp-staging-<time>
+// instead, which starts out as hard links to everything in the destination
+// (real copies for files whose metadata is updated, that are appended to, or
+// that --on-readonly-dest=chmod makes writable, that would change the live
+// file too). Only when all jobs succeeded the
+// destination is renamed to <target_dir>.safecp-old-<time> and the staging
+// tree is renamed into its place. For a moment in between there is no
+// target_dir, but it is never seen half updated. The old tree is removed
+// afterwards.
+//
+// With --verify-after-swap=sample|full the files the jobs wrote in the now
+// live tree are compared to their sources by hash before that, an evenly
+// spread sample of them or all of them. When anything differs the swap is undone: the
+// new tree is moved to <target_dir>.safecp-failed-<time> and the old one
+// back into place.
+
+// verify_sample is how many files --verify-after-swap=sample checks.
+const verify_sample = 64
+
+// staged returns where path, a path in dest_dir, is in the staging tree.
+func staged(path string, dest_dir string, staging string) string {
+	if path == dest_dir || strings.HasPrefix(path, dest_dir+string(os.PathSeparator)) {
+		return staging + path[len(dest_dir):]
+	}
+	return path
+}
+
+// prepare_staging makes the staging tree for jobs, when the destination
+// doesn't exist yet the mkdir job for it makes the staging tree instead.
+func prepare_staging(dest_dir string, staging string, jobs []job) error {
+	if _, err := os.Lstat(dest_dir); os.IsNotExist(err) {
+		return nil
+	}
+	changed := make(map[string]bool)
+	for _, j := range jobs {
+		if j.operation == "metadata" || j.operation == "append" {
+			changed[j.destination] = true
+		}
+		// overwrite_file makes a read-only file writable before replacing it
+		if j.operation == "overwrite" && opts.on_readonly_dest == "chmod" {
+			if fi, err := os.Stat(j.destination); err == nil && read_only(fi) {
+				changed[j.destination] = true
+			}
+		}
+	}
+	return clone_tree(dest_dir, staging, func(path string) bool {
+		return !changed[path]
+	})
+}
+
+// swap_merge runs execute_merge for --atomic-swap.
+func swap_merge(src_dir string, dest_dir string, jobs *[]job, commit bool) {
+	if !commit || len(*jobs) == 0 {
+		execute_merge(jobs, commit)
+		if len(*jobs) > 0 {
+			info("Swap:      staging tree -> %s\n", dest_dir)
+		}
+		return
+	}
+	stamp := time.Now().Format("20060102-150405")
+	base := filepath.Clean(dest_dir)
+	staging := base + ".safecp-staging-" + stamp
+	old := base + ".safecp-old-" + stamp
+	error_roots = append(error_roots, staging)
+	if err := prepare_staging(dest_dir, staging, *jobs); err != nil {
+		log_error("Error: cannot make the staging tree %s: %v. Bailing out!\n", staging, err)
+		os.Exit(1)
+	}
+	staged_jobs := make([]job, 0, len(*jobs))
+	for _, j := range *jobs {
+		j.destination = staged(j.destination, dest_dir, staging)
+		if j.operation == "link" {
+			j.source = staged(j.source, dest_dir, staging)
+		}
+		staged_jobs = append(staged_jobs, j)
+	}
+	execute_merge(&staged_jobs, true)
+	if len(stats.failed) > 0 {
+		log_error("Error: not swapping after %d failed jobs, the staging tree is left in %s\n", len(stats.failed), staging)
+		return
+	}
+	if _, err := os.Stat(staging); os.IsNotExist(err) {
+		// nothing to do and no destination, so nothing to swap
+		return
+	}
+	_, err := os.Lstat(dest_dir)
+	had_old := err == nil
+	if had_old {
+		if err := os.Rename(dest_dir, old); err != nil {
+			log_error("Error: cannot move %s aside: %v, the staging tree is left in %s\n", dest_dir, err, staging)
+			os.Exit(1)
+		}
+	}
+	if err := os.Rename(staging, dest_dir); err != nil {
+		if had_old {
+			os.Rename(old, dest_dir)
+		}
+		log_error("Error: cannot rename %s into place: %v\n", staging, err)
+		os.Exit(1)
+	}
+	notice("Swapped the staging tree into place as %s\n", dest_dir)
+	if opts.verify_after_swap != "" {
+		if err := verify_tree(*jobs, opts.verify_after_swap == "full"); err != nil {
+			log_error("Error: verification after the swap failed: %v\n", err)
+			if had_old {
+				undo_swap(dest_dir, old, base+".safecp-failed-"+stamp)
+			}
+			os.Exit(1)
+		}
+		notice("Verified the destination against the source after the swap\n")
+	}
+	if had_old {
+		if err := os.RemoveAll(old); err != nil {
+			warning("cannot remove the old tree %s: %v", old, err)
+		}
+	}
+}
+
+// undo_swap puts the old tree back after a failed verification, the new
+// tree is kept as failed for inspection.
+func undo_swap(dest_dir string, old string, failed string) {
+	if err := os.Rename(dest_dir, failed); err != nil {
+		log_error("Error: cannot roll back, the old tree is in %s: %v\n", old, err)
+		return
+	}
+	if err := os.Rename(old, dest_dir); err != nil {
+		log_error("Error: cannot roll back, the old tree is in %s: %v\n", old, err)
+		return
+	}
+	notice("Rolled back to the old tree, the new one is in %s\n", failed)
+}
+
+// verify_tree compares the files the completed jobs wrote with their
+// sources by hash, all of them when full is set or else a sample. Files that
+// were left alone on purpose (skipped, or not part of --apply-subset) are no
+// part of it.
+func verify_tree(jobs []job, full bool) error {
+	files := make([]job, 0)
+	for _, j := range completed_jobs(jobs) {
+		if j.operation == "copy" || j.operation == "overwrite" || j.operation == "append" {
+			files = append(files, j)
+		}
+	}
+	sort.Slice(files, func(a, b int) bool { return files[a].rel < files[b].rel })
+	if !full && len(files) > verify_sample {
+		sample := make([]job, 0, verify_sample)
+		for i := 0; i < verify_sample; i++ {
+			sample = append(sample, files[i*len(files)/verify_sample])
+		}
+		files = sample
+	}
+	bad := make([]string, 0)
+	for _, j := range files {
+		if err := verify_hashes(j.source, j.destination); err != nil {
+			bad = append(bad, j.rel)
+		}
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("%d of %d checked files differ from the source, like %s", len(bad), len(files), bad[0])
+	}
+	return nil
+}
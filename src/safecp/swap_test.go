@@ -0,0 +1,113 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func forget_completed(t *testing.T) {
+	t.Cleanup(func() { completed.jobs = nil })
+}
+
+func TestStaged(t *testing.T) {
+	dst := filepath.Join("data", "dst")
+	staging := dst + ".safecp-staging-1"
+	cases := map[string]string{
+		dst:                                staging,
+		filepath.Join(dst, "a"):            filepath.Join(staging, "a"),
+		filepath.Join("data", "dst-other"): filepath.Join("data", "dst-other"),
+		filepath.Join("data", "src", "a"):  filepath.Join("data", "src", "a"),
+	}
+	for path, want := range cases {
+		if got := staged(path, dst, staging); got != want {
+			t.Errorf("staged(%s) = %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestVerifyTreeChecksCompletedJobs(t *testing.T) {
+	reset(t)
+	forget_completed(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src/a": "a", "src/b": "b", "dst/a": "a", "dst/b": "changed"})
+	jobs := copy_jobs(filepath.Join(dir, "src"), filepath.Join(dir, "dst"), "a", "b")
+	complete(jobs[0])
+	// b didn't run, so it isn't checked
+	if err := verify_tree(jobs, true); err != nil {
+		t.Errorf("verify_tree of the completed job: %v", err)
+	}
+	complete(jobs[1])
+	if err := verify_tree(jobs, true); err == nil || !strings.Contains(err.Error(), "1 of 2") {
+		t.Errorf("verify_tree of a different file gave %v", err)
+	}
+}
+
+func TestVerifyTreeSample(t *testing.T) {
+	reset(t)
+	forget_completed(t)
+	dir := t.TempDir()
+	files := make(map[string]string)
+	rels := make([]string, 0)
+	for i := 0; i < 2*verify_sample; i++ {
+		rel := strings.Repeat("x", i+1)
+		files["src/"+rel], files["dst/"+rel] = rel, rel
+		rels = append(rels, rel)
+	}
+	write_tree(t, dir, files)
+	jobs := copy_jobs(filepath.Join(dir, "src"), filepath.Join(dir, "dst"), rels...)
+	for _, j := range jobs {
+		complete(j)
+	}
+	os.Remove(filepath.Join(dir, "dst", rels[0]))
+	err := verify_tree(jobs, false)
+	if err == nil || !strings.Contains(err.Error(), "of 64 checked") {
+		t.Errorf("the sample gave %v", err)
+	}
+}
+
+func TestAtomicSwapRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a", "sub/b": "b"})
+	write_tree(t, filepath.Join(dir, "dst"), map[string]string{"kept": "kept"})
+	before, _ := os.Stat(filepath.Join(dir, "dst", "kept"))
+	must_run(t, dir, "src", "dst", "--atomic-swap", "--verify-after-swap=full", "--commit")
+	got := read_tree(t, filepath.Join(dir, "dst"))
+	if got["a"] != "a" || got["sub/b"] != "b" || got["kept"] != "kept" {
+		t.Errorf("destination has %v", got)
+	}
+	// unchanged files are hard links of the old ones
+	after, _ := os.Stat(filepath.Join(dir, "dst", "kept"))
+	if !os.SameFile(before, after) {
+		t.Error("an unchanged file was copied into the staging tree")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("staging or old trees were left: %v", entries)
+	}
+}
+
+func TestAtomicSwapDryRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a"})
+	write_tree(t, filepath.Join(dir, "dst"), map[string]string{"kept": "kept"})
+	out := must_run(t, dir, "src", "dst", "--atomic-swap")
+	if !strings.Contains(out, "Swap:") {
+		t.Errorf("the dry run doesn't mention the swap:\n%s", out)
+	}
+	same_names(t, read_tree(t, filepath.Join(dir, "dst")), "kept")
+}
+
+func TestVerifyAfterSwapNeedsSources(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a"})
+	if _, stderr, status := run_safecp(t, dir, "src", "dst", "--atomic-swap", "--verify-after-swap=full", "--move"); status == 0 || !strings.Contains(stderr, "--move") {
+		t.Errorf("--verify-after-swap with --move gave status %d\n%s", status, stderr)
+	}
+}
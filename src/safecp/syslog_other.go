@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import "errors"
+
+func open_syslog(facility string, tag string) (log_sink, error) {
+	return nil, errors.New("syslog is not available on this platform")
+}
@@ -0,0 +1,246 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With --throttle-on-load=THRESHOLD copying pauses whenever the 1 minute
+// load average of the system is above THRESHOLD, and continues once it has
+// dropped below it again. The load is looked at before every file and every
+// load_check_interval while copying data. Both intervals are variables so
+// that they can be made shorter than the real ones.
+var (
+	load_check_interval = 5 * time.Second
+	load_pause_interval = 10 * time.Second
+)
+
+// load_average is a variable so that the pause/resume logic can be driven by
+// something else than the real system load.
+var load_average = read_load_average
+
+var load_throttle struct {
+	sync.Mutex
+	checked time.Time
+}
+
+// wait_for_load blocks for as long as the load is too high. All copies wait on
+// the same lock, so when one of them pauses they all do.
+func wait_for_load() {
+	if opts.throttle_on_load <= 0 {
+		return
+	}
+	load_throttle.Lock()
+	defer load_throttle.Unlock()
+	if time.Since(load_throttle.checked) < load_check_interval {
+		return
+	}
+	paused := false
+	for {
+		load, err := load_average()
+		if err != nil {
+			warning("cannot read the load average: %v", err)
+			break
+		}
+		if load <= opts.throttle_on_load {
+			break
+		}
+		if !paused {
+			notice("Load average %.2f is above %g, pausing\n", load, opts.throttle_on_load)
+			paused = true
+		}
+		time.Sleep(load_pause_interval)
+	}
+	if paused {
+		notice("Load average is back to normal, resuming\n")
+	}
+	load_throttle.checked = time.Now()
+}
+
+// With --bwlimit-schedule=FROM-TO=RATE[,...] all copies together read at
+// most RATE bytes per second between the times of day FROM and TO (HH:MM,
+// local time), like 09:00-17:00=5M,17:00-09:00=unlimited. A range with TO
+// before FROM crosses midnight, the first range that contains the current
+// time applies, and outside all ranges there is no limit. The time is looked
+// at for every block that is read, so a copy speeds up or slows down as soon
+// as the next range starts. RATE takes a K, M or G suffix (powers of 1024,
+// an extra B is allowed).
+
+type bwlimit_range struct {
+	from  int // minutes since midnight
+	to    int
+	limit int64 // bytes per second, 0 for unlimited
+}
+
+// clock is a variable so that the schedule can be driven by another time.
+var clock = time.Now
+
+var bandwidth struct {
+	sync.Mutex
+	next time.Time // when reading may continue at the current rate
+}
+
+func parse_bwlimit_schedule(value string) ([]bwlimit_range, error) {
+	ranges := make([]bwlimit_range, 0)
+	for _, part := range strings.Split(value, ",") {
+		times, rate, ok := strings.Cut(part, "=")
+		from, to, ok2 := strings.Cut(times, "-")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid --bwlimit-schedule range %q, use FROM-TO=RATE", part)
+		}
+		r := bwlimit_range{}
+		var err error
+		if r.from, err = parse_time_of_day(from); err != nil {
+			return nil, err
+		}
+		if r.to, err = parse_time_of_day(to); err != nil {
+			return nil, err
+		}
+		if r.limit, err = parse_rate(rate); err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func parse_time_of_day(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, use HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parse_rate(value string) (int64, error) {
+	if strings.EqualFold(strings.TrimSpace(value), "unlimited") {
+		return 0, nil
+	}
+	rate, err := parse_size(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q, use a number of bytes per second or unlimited", value)
+	}
+	return rate, nil
+}
+
+// parse_size parses a number of bytes above 0, with an optional K, M or G
+// suffix (powers of 1024, an extra B is allowed).
+func parse_size(value string) (int64, error) {
+	number := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	unit := int64(1)
+	if n := len(number); n > 0 {
+		switch number[n-1] {
+		case 'K':
+			unit = 1 << 10
+		case 'M':
+			unit = 1 << 20
+		case 'G':
+			unit = 1 << 30
+		}
+		if unit > 1 {
+			number = number[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return size * unit, nil
+}
+
+// scheduled_limit returns the limit at time t, 0 when there is none.
+func scheduled_limit(t time.Time) int64 {
+	minute := t.Hour()*60 + t.Minute()
+	for _, r := range opts.bwlimit_schedule {
+		var in bool
+		if r.from <= r.to {
+			in = r.from == r.to || (minute >= r.from && minute < r.to)
+		} else {
+			in = minute >= r.from || minute < r.to
+		}
+		if in {
+			return r.limit
+		}
+	}
+	return 0
+}
+
+// wait_for_bandwidth blocks for as long as reading n bytes takes at the
+// current limit, counting from where the reads before left off.
+func wait_for_bandwidth(n int) {
+	if len(opts.bwlimit_schedule) == 0 || n <= 0 {
+		return
+	}
+	t := clock()
+	limit := scheduled_limit(t)
+	if limit == 0 {
+		return
+	}
+	bandwidth.Lock()
+	if bandwidth.next.Before(t) {
+		bandwidth.next = t
+	}
+	bandwidth.next = bandwidth.next.Add(time.Duration(float64(n) / float64(limit) * float64(time.Second)))
+	wait := bandwidth.next.Sub(t)
+	bandwidth.Unlock()
+	time.Sleep(wait)
+}
+
+type throttled_reader struct {
+	r io.Reader
+}
+
+func (t throttled_reader) Read(p []byte) (int, error) {
+	wait_for_load()
+	n, err := t.r.Read(p)
+	wait_for_bandwidth(n)
+	return n, err
+}
+
+// copy_data copies in to out, applying the throttling options. Without any
+// of them in and out are passed to io.Copy as is, so it can still use
+// copy_file_range and friends.
+func copy_data(out io.Writer, in io.Reader) (int64, error) {
+	return io.Copy(out, throttled(in))
+}
+
+// throttled returns in, wrapped to apply the throttling options if any.
+func throttled(in io.Reader) io.Reader {
+	if opts.throttle_on_load > 0 || len(opts.bwlimit_schedule) > 0 {
+		return throttled_reader{in}
+	}
+	return in
+}
+
+// With --drop-cache the pages of every file that was copied or hashed are
+// dropped from the page cache when done with it (posix_fadvise DONTNEED on
+// Linux, nothing elsewhere), so a large run doesn't push the data of
+// everything else running out of the cache. Written pages are only dropped
+// once they are on disk, copies are synced before.
+
+// drop_cache is a variable so that something else can stand in for
+// fadvise_dontneed.
+var drop_cache = fadvise_dontneed
+
+// done_with drops the cached pages of the given files for --drop-cache, a
+// failure doesn't matter enough to stop for.
+func done_with(files ...*os.File) {
+	if !opts.drop_cache {
+		return
+	}
+	for _, file := range files {
+		if err := drop_cache(file); err != nil {
+			warning("cannot drop %s from the page cache: %v", file.Name(), err)
+		}
+	}
+}
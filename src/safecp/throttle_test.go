@@ -0,0 +1,247 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fake_load makes load_average return loads one after the other, repeating
+// the last one, and counts how often it was read.
+func fake_load(t *testing.T, loads ...float64) *int {
+	reads := new(int)
+	load_average = func() (float64, error) {
+		load := loads[min(*reads, len(loads)-1)]
+		*reads++
+		return load, nil
+	}
+	saved_check, saved_pause := load_check_interval, load_pause_interval
+	load_check_interval, load_pause_interval = 0, time.Millisecond
+	load_throttle.checked = time.Time{}
+	t.Cleanup(func() {
+		load_average = read_load_average
+		load_check_interval, load_pause_interval = saved_check, saved_pause
+		load_throttle.checked = time.Time{}
+	})
+	return reads
+}
+
+func TestWaitForLoadPausesWhileTheLoadIsHigh(t *testing.T) {
+	reset(t)
+	opts.throttle_on_load = 2
+	reads := fake_load(t, 5, 4, 3, 1.5)
+	wait_for_load()
+	if *reads != 4 {
+		t.Errorf("read the load %d times, want 4 (until it was below 2)", *reads)
+	}
+}
+
+func TestWaitForLoadDoesntPauseBelowTheThreshold(t *testing.T) {
+	reset(t)
+	opts.throttle_on_load = 2
+	reads := fake_load(t, 1)
+	wait_for_load()
+	if *reads != 1 {
+		t.Errorf("read the load %d times, want 1", *reads)
+	}
+}
+
+func TestWaitForLoadChecksOncePerInterval(t *testing.T) {
+	reset(t)
+	opts.throttle_on_load = 2
+	reads := fake_load(t, 1)
+	load_check_interval = time.Hour
+	wait_for_load()
+	wait_for_load()
+	if *reads != 1 {
+		t.Errorf("read the load %d times within one interval, want 1", *reads)
+	}
+}
+
+func TestWaitForLoadContinuesWithoutLoadAverage(t *testing.T) {
+	reset(t)
+	opts.throttle_on_load = 2
+	fake_load(t, 1)
+	load_average = func() (float64, error) { return 0, errors.New("no load average") }
+	wait_for_load()
+}
+
+func TestThrottledReaderWaitsForLoad(t *testing.T) {
+	reset(t)
+	opts.throttle_on_load = 2
+	reads := fake_load(t, 3, 1)
+	var out bytes.Buffer
+	if _, err := copy_data(&out, strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "data" || *reads < 2 {
+		t.Errorf("copied %q after reading the load %d times", out.String(), *reads)
+	}
+	if _, ok := throttled(strings.NewReader("")).(throttled_reader); !ok {
+		t.Error("copies are not throttled with --throttle-on-load")
+	}
+	opts.throttle_on_load = 0
+	var r io.Reader = strings.NewReader("")
+	if throttled(r) != r {
+		t.Error("copies are throttled without any throttling option")
+	}
+}
+
+// fake_drop_cache records the base names of the files dropped from the
+// page cache, and fails for those in fail.
+func fake_drop_cache(t *testing.T, fail ...string) *[]string {
+	dropped := new([]string)
+	drop_cache = func(file *os.File) error {
+		name := filepath.Base(file.Name())
+		*dropped = append(*dropped, name)
+		for _, f := range fail {
+			if f == name {
+				return errors.New("not now")
+			}
+		}
+		return nil
+	}
+	t.Cleanup(func() { drop_cache = fadvise_dontneed })
+	return dropped
+}
+
+func TestDropCache(t *testing.T) {
+	reset(t)
+	dropped := fake_drop_cache(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src": "x"})
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := copyFileContents(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if len(*dropped) != 0 {
+		t.Errorf("dropped %q without --drop-cache", *dropped)
+	}
+	opts.drop_cache = true
+	if err := copyFileContents(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hash_file(dst, "md5"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(*dropped, " "); got != "src dst dst" {
+		t.Errorf("dropped %s, want both sides of the copy and the hashed file", got)
+	}
+}
+
+func TestDropCacheFailureIsNoError(t *testing.T) {
+	reset(t)
+	opts.drop_cache = true
+	fake_drop_cache(t, "src")
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src": "x"})
+	if _, err := hash_file(filepath.Join(dir, "src"), "md5"); err != nil {
+		t.Errorf("a failing drop gave %v", err)
+	}
+}
+
+// fake_clock makes clock run from the time of day since midnight on.
+func fake_clock(t *testing.T, since_midnight time.Duration) {
+	start, started := time.Date(2024, 5, 6, 0, 0, 0, 0, time.Local).Add(since_midnight), time.Now()
+	clock = func() time.Time { return start.Add(time.Since(started)) }
+	bandwidth.next = time.Time{}
+	t.Cleanup(func() {
+		clock = time.Now
+		bandwidth.next = time.Time{}
+	})
+}
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int64{"1": 1, "512K": 512 << 10, "5M": 5 << 20, "5mb": 5 << 20, "2G": 2 << 30, " 10 ": 10}
+	for value, want := range cases {
+		if got, err := parse_size(value); err != nil || got != want {
+			t.Errorf("parse_size(%q) = %d (%v), want %d", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "0", "-1K", "M", "1T", "1.5M"} {
+		if _, err := parse_size(value); err == nil {
+			t.Errorf("parse_size(%q) gave no error", value)
+		}
+	}
+}
+
+func TestScheduledLimit(t *testing.T) {
+	reset(t)
+	var err error
+	opts.bwlimit_schedule, err = parse_bwlimit_schedule("09:00-17:00=5M,22:30-06:00=1K, 17:00-18:00=unlimited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]int64{"08:59": 0, "09:00": 5 << 20, "16:59": 5 << 20, "17:00": 0, "18:30": 0, "22:30": 1 << 10, "00:00": 1 << 10, "05:59": 1 << 10, "06:00": 0}
+	for at, want := range cases {
+		tod, _ := time.Parse("15:04", at)
+		if got := scheduled_limit(tod); got != want {
+			t.Errorf("the limit at %s is %d, want %d", at, got, want)
+		}
+	}
+	for _, value := range []string{"09:00=5M", "9-17=5M", "09:00-17:00=fast", "25:00-01:00=1M"} {
+		if _, err := parse_bwlimit_schedule(value); err == nil {
+			t.Errorf("parse_bwlimit_schedule(%q) gave no error", value)
+		}
+	}
+}
+
+func TestWaitForBandwidth(t *testing.T) {
+	reset(t)
+	opts.bwlimit_schedule, _ = parse_bwlimit_schedule("09:00-17:00=1M")
+	fake_clock(t, 10*time.Hour)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		wait_for_bandwidth(10 << 10)
+	}
+	// 50K at 1M per second
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond || elapsed > time.Second {
+		t.Errorf("reading 50K at 1M/s took %v", elapsed)
+	}
+	// outside of the range the reads don't wait
+	fake_clock(t, 20*time.Hour)
+	start = time.Now()
+	wait_for_bandwidth(100 << 20)
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("an unlimited read waited %v", elapsed)
+	}
+}
+
+func TestThrottledReaderFollowsTheSchedule(t *testing.T) {
+	reset(t)
+	opts.bwlimit_schedule, _ = parse_bwlimit_schedule("00:00-12:00=100K")
+	fake_clock(t, 11*time.Hour+59*time.Minute)
+	var out bytes.Buffer
+	start := time.Now()
+	if _, err := copy_data(&out, bytes.NewReader(make([]byte, 10<<10))); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond || out.Len() != 10<<10 {
+		t.Errorf("copying 10K at 100K/s took %v", elapsed)
+	}
+}
+
+func TestBandwidthFollowsTheNextRangeRightAway(t *testing.T) {
+	reset(t)
+	opts.bwlimit_schedule, _ = parse_bwlimit_schedule("00:00-12:00=100K")
+	// a tenth of a second before the limit ends
+	fake_clock(t, 12*time.Hour-100*time.Millisecond)
+	start := time.Now()
+	// 10 seconds worth at 100K/s, most of it read after noon
+	for i := 0; i < 100; i++ {
+		wait_for_bandwidth(10 << 10)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("reading after the limit ended still waited, took %v", elapsed)
+	}
+}
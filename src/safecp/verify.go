@@ -0,0 +1,172 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With --verify every file that was copied, overwritten or appended to is
+// hashed again once all jobs are done, and compared with its source. This
+// runs --verify-jobs files at a time (default 4), and all failures are
+// reported, not just the first. They count as failed jobs, so the exit
+// status is 1.
+//
+// With --verify-cmd=CMD the same files are also handed to an external
+// command in that pass, as CMD SOURCE DESTINATION, for checks that know
+// more about the content than its bytes (an image that has to decode, a
+// database that has to pass its integrity check). CMD is split on spaces and
+// run without a shell. An exit status other than 0, or running longer than
+// --verify-cmd-timeout (default 1m), is a failed verification.
+//
+// With --verify-links every hard link the plan made (for --dedupe) is
+// checked to really be the same file as the copy it links to, and not an
+// independent copy of it. Files that merely happen to be hard links of their
+// source (safecp links instead of copying when it can) are no part of this.
+
+// verify_destination runs the --verify pass over the jobs that completed.
+func verify_destination(jobs []job) {
+	n := opts.verify_jobs
+	if n < 1 {
+		n = 4
+	}
+	targets := make([]job, 0)
+	for _, j := range jobs {
+		if j.operation == "copy" || j.operation == "overwrite" || j.operation == "append" {
+			targets = append(targets, j)
+		}
+	}
+	problems := make([]error, len(targets))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				problems[i] = verify_file(targets[i].source, targets[i].destination)
+			}
+		}()
+	}
+	for i := range targets {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	bad := 0
+	for _, err := range problems {
+		if err != nil {
+			bad++
+			log_error("Verification failed: %v\n", err)
+			stats.Lock()
+			stats.failed = append(stats.failed, err.Error())
+			stats.Unlock()
+		}
+	}
+	notice("Verified %d files, %d failed\n", len(targets), bad)
+}
+
+// verify_links runs the --verify-links pass over the jobs that completed.
+func verify_links(jobs []job) {
+	checked, bad := 0, 0
+	for _, j := range jobs {
+		if j.operation != "link" {
+			continue
+		}
+		checked++
+		if err := verify_link(j.source, j.destination); err != nil {
+			bad++
+			log_error("Verification failed: %v\n", err)
+			stats.Lock()
+			stats.failed = append(stats.failed, err.Error())
+			stats.Unlock()
+		}
+	}
+	notice("Verified %d hard links, %d are not linked\n", checked, bad)
+}
+
+// verify_link checks that destination is a hard link of canonical.
+func verify_link(canonical string, destination string) error {
+	cfi, err := os.Stat(canonical)
+	if err != nil {
+		return err
+	}
+	dfi, err := os.Stat(destination)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(cfi, dfi) {
+		return fmt.Errorf("%s should be a hard link of %s, but is a separate file", destination, canonical)
+	}
+	return nil
+}
+
+// default_verify_cmd_timeout is how long --verify-cmd may take per file.
+const default_verify_cmd_timeout = time.Minute
+
+// verify_file compares the hashes of source and destination, and runs the
+// --verify-cmd for them.
+func verify_file(source string, destination string) error {
+	if opts.verify {
+		if err := verify_hashes(source, destination); err != nil {
+			return err
+		}
+	}
+	if opts.verify_cmd != "" {
+		return run_verify_cmd(source, destination)
+	}
+	return nil
+}
+
+func run_verify_cmd(source string, destination string) error {
+	timeout := opts.verify_cmd_timeout
+	if timeout <= 0 {
+		timeout = default_verify_cmd_timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	args := append(strings.Fields(opts.verify_cmd), source, destination)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// children of CMD can keep the output open after it is killed
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("--verify-cmd for %s took longer than %v", destination, timeout)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(output.String()); msg != "" {
+			return fmt.Errorf("--verify-cmd for %s failed: %v: %s", destination, err, msg)
+		}
+		return fmt.Errorf("--verify-cmd for %s failed: %v", destination, err)
+	}
+	return nil
+}
+
+func verify_hashes(source string, destination string) error {
+	algorithm := hash_algorithm_for(source)
+	hash_src, err := hash_file(source, algorithm)
+	if err != nil {
+		return err
+	}
+	hash_dst, err := hash_dest_file(destination, algorithm)
+	if err != nil {
+		return err
+	}
+	if hash_src != hash_dst {
+		return fmt.Errorf("%s has %s %s, its source %s has %s", destination, algorithm, hash_dst, source, hash_src)
+	}
+	return nil
+}
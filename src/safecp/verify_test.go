@@ -0,0 +1,163 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyDestination(t *testing.T) {
+	reset(t)
+	opts.verify = true
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src/a": "a", "src/b": "b", "src/c": "c", "dst/a": "a", "dst/b": "bad", "dst/c": "bad"})
+	jobs := copy_jobs(filepath.Join(dir, "src"), filepath.Join(dir, "dst"), "a", "b", "c")
+	verify_destination(jobs)
+	if len(stats.failed) != 2 || !strings.Contains(stats.failed[0]+stats.failed[1], filepath.Join("dst", "b")) {
+		t.Errorf("got failures %q, want b and c", stats.failed)
+	}
+}
+
+func TestVerifyOnlyCompletedJobs(t *testing.T) {
+	reset(t)
+	forget_completed(t)
+	opts.verify = true
+	dir := t.TempDir()
+	// b was skipped (or vanished) and never written
+	write_tree(t, dir, map[string]string{"src/a": "a", "src/b": "b", "dst/a": "a"})
+	jobs := copy_jobs(filepath.Join(dir, "src"), filepath.Join(dir, "dst"), "a", "b")
+	complete(jobs[0])
+	verify_destination(completed_jobs(jobs))
+	if len(stats.failed) != 0 {
+		t.Errorf("a job that didn't run failed verification: %q", stats.failed)
+	}
+}
+
+func TestVerifyRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a", "sub/b": "b"})
+	out := must_run(t, dir, "src", "dst", "--verify", "--verify-jobs=2", "--commit")
+	if !strings.Contains(out, "Verified 2 files, 0 failed") {
+		t.Errorf("--verify printed:\n%s", out)
+	}
+}
+
+func TestVerifyLink(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"canonical": "x", "copy": "x"})
+	canonical := filepath.Join(dir, "canonical")
+	if err := os.Link(canonical, filepath.Join(dir, "link")); err != nil {
+		t.Skip("cannot make hard links:", err)
+	}
+	if err := verify_link(canonical, filepath.Join(dir, "link")); err != nil {
+		t.Error(err)
+	}
+	if err := verify_link(canonical, filepath.Join(dir, "copy")); err == nil || !strings.Contains(err.Error(), "is a separate file") {
+		t.Errorf("a copy gave %v", err)
+	}
+}
+
+func TestVerifyLinksOnlyChecksLinkJobs(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src/a": "x", "dst/a": "x", "dst/b": "x"})
+	jobs := copy_jobs(filepath.Join(dir, "src"), filepath.Join(dir, "dst"), "a")
+	jobs = append(jobs, job{operation: "link", source: filepath.Join(dir, "dst", "a"), destination: filepath.Join(dir, "dst", "b"), rel: "b", target: "a"})
+	verify_links(jobs)
+	if len(stats.failed) != 1 || !strings.Contains(stats.failed[0], "should be a hard link") {
+		t.Errorf("got failures %q", stats.failed)
+	}
+}
+
+func TestVerifyLinksRun(t *testing.T) {
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "same", "b": "same", "c": "other"})
+	out := must_run(t, dir, "src", "dst", "--dedupe", "--verify-links", "--commit")
+	if !strings.Contains(out, "Verified 1 hard links, 0 are not linked") {
+		t.Errorf("--verify-links printed:\n%s", out)
+	}
+}
+
+// TestVerifyCmdHelper is the --verify-cmd of the tests below, in the test
+// binary: SAFECP_VERIFY_HELPER says what it does with SOURCE DESTINATION.
+func TestVerifyCmdHelper(t *testing.T) {
+	mode := os.Getenv("SAFECP_VERIFY_HELPER")
+	if mode == "" {
+		return
+	}
+	args := flag.Args()
+	switch mode {
+	case "compare":
+		a, _ := os.ReadFile(args[0])
+		b, _ := os.ReadFile(args[1])
+		if string(a) != string(b) {
+			fmt.Println("content differs")
+			os.Exit(1)
+		}
+	case "fail":
+		fmt.Println("refused")
+		os.Exit(1)
+	case "hang":
+		time.Sleep(time.Minute)
+	}
+	os.Exit(0)
+}
+
+func use_verify_helper(t *testing.T, mode string) {
+	t.Setenv("SAFECP_VERIFY_HELPER", mode)
+	opts.verify_cmd = os.Args[0] + " -test.run=^TestVerifyCmdHelper$"
+}
+
+func TestVerifyCmd(t *testing.T) {
+	reset(t)
+	use_verify_helper(t, "compare")
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src": "x", "same": "x", "other": "y"})
+	if err := verify_file(filepath.Join(dir, "src"), filepath.Join(dir, "same")); err != nil {
+		t.Error(err)
+	}
+	err := verify_file(filepath.Join(dir, "src"), filepath.Join(dir, "other"))
+	if err == nil || !strings.Contains(err.Error(), "exit status 1: content differs") {
+		t.Errorf("a failing --verify-cmd gave %v", err)
+	}
+}
+
+func TestVerifyCmdTimeout(t *testing.T) {
+	reset(t)
+	use_verify_helper(t, "hang")
+	opts.verify_cmd_timeout = 100 * time.Millisecond
+	dir := t.TempDir()
+	write_tree(t, dir, map[string]string{"src": "x", "dst": "x"})
+	start := time.Now()
+	err := verify_file(filepath.Join(dir, "src"), filepath.Join(dir, "dst"))
+	if err == nil || !strings.Contains(err.Error(), "took longer than 100ms") {
+		t.Errorf("a hanging --verify-cmd gave %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("the hanging command was waited for %v", elapsed)
+	}
+}
+
+func TestVerifyCmdRun(t *testing.T) {
+	t.Setenv("SAFECP_VERIFY_HELPER", "compare")
+	dir := t.TempDir()
+	write_tree(t, filepath.Join(dir, "src"), map[string]string{"a": "a", "sub/b": "b"})
+	verify_cmd := "--verify-cmd=" + os.Args[0] + " -test.run=^TestVerifyCmdHelper$"
+	if out := must_run(t, dir, "src", "dst", verify_cmd, "--commit"); !strings.Contains(out, "Verified 2 files, 0 failed") {
+		t.Errorf("no verification in the output:\n%s", out)
+	}
+	t.Setenv("SAFECP_VERIFY_HELPER", "fail")
+	stdout, stderr, status := run_safecp(t, dir, "src", "dst2", verify_cmd, "--commit")
+	if status == 0 || !strings.Contains(stdout+stderr, "Verified 2 files, 2 failed") || !strings.Contains(stderr, "refused") {
+		t.Errorf("a failing --verify-cmd gave status %d\n%s%s", status, stdout, stderr)
+	}
+}
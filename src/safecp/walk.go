@@ -0,0 +1,74 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// walk_parallel makes the same plan as a sequential filepath.Walk over
+// src_dir, but walks the top level entries of src_dir concurrently, at most
+// n at a time. Every top level entry gets its own job list. os.ReadDir
+// returns the entries sorted by name, which is also the order in which
+// filepath.Walk visits them, so appending the lists in entry order gives
+// exactly the plan the sequential walker would have made.
+//
+// When an entry fails (e.g. a hash mismatch) the entries after it stop
+// walking, while the ones before it finish, so the error that is returned is
+// always the one the sequential walker would have run into first.
+func walk_parallel(src_dir string, jobs *[]job, plan planner, n int) error {
+	root, err := os.Lstat(src_dir)
+	if err != nil {
+		return err
+	}
+	if err := plan(src_dir, root, nil, jobs); err != nil || !root.IsDir() {
+		return err
+	}
+	entries, err := os.ReadDir(src_dir)
+	if err != nil {
+		return err
+	}
+	plans := make([][]job, len(entries))
+	errs := make([]error, len(entries))
+	var first_failed atomic.Int64
+	first_failed.Store(int64(len(entries)))
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, n)
+	for i, entry := range entries {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, root string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			errs[i] = filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+				if int64(i) > first_failed.Load() {
+					return filepath.SkipAll
+				}
+				err = plan(path, f, err, &plans[i])
+				if err != nil {
+					for {
+						failed := first_failed.Load()
+						if int64(i) >= failed || first_failed.CompareAndSwap(failed, int64(i)) {
+							break
+						}
+					}
+				}
+				return err
+			})
+		}(i, filepath.Join(src_dir, entry.Name()))
+	}
+	wg.Wait()
+	for i := range entries {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		*jobs = append(*jobs, plans[i]...)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// path_planner plans a "copy" job for every path, to see in which order
+// paths were planned.
+func path_planner(path string, f os.FileInfo, err error, jobs *[]job) error {
+	if err != nil {
+		return err
+	}
+	*jobs = append(*jobs, job{operation: "copy", source: path})
+	return nil
+}
+
+func planned_sources(jobs []job) string {
+	sources := make([]string, 0, len(jobs))
+	for _, j := range jobs {
+		sources = append(sources, j.source)
+	}
+	return strings.Join(sources, "\n")
+}
+
+func TestWalkParallelPlansInWalkOrder(t *testing.T) {
+	src := t.TempDir()
+	files := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("d%02d/sub/f%d", i, i)] = "x"
+		files[fmt.Sprintf("f%02d", i)] = "x"
+	}
+	write_tree(t, src, files)
+	sequential := make([]job, 0)
+	if err := filepath.Walk(src, func(path string, f os.FileInfo, err error) error {
+		return path_planner(path, f, err, &sequential)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	parallel := make([]job, 0)
+	if err := walk_parallel(src, &parallel, path_planner, 4); err != nil {
+		t.Fatal(err)
+	}
+	if planned_sources(parallel) != planned_sources(sequential) {
+		t.Errorf("--walk-jobs planned\n%s\ninstead of\n%s", planned_sources(parallel), planned_sources(sequential))
+	}
+}
+
+func TestWalkParallelReturnsTheFirstError(t *testing.T) {
+	src := t.TempDir()
+	write_tree(t, src, map[string]string{"a/1": "", "b/bad": "", "c/bad": "", "d/1": ""})
+	plan := func(path string, f os.FileInfo, err error, jobs *[]job) error {
+		if filepath.Base(path) == "bad" {
+			return errors.New(path)
+		}
+		return path_planner(path, f, err, jobs)
+	}
+	jobs := make([]job, 0)
+	err := walk_parallel(src, &jobs, plan, 4)
+	if err == nil || err.Error() != filepath.Join(src, "b", "bad") {
+		t.Errorf("got error %v, want the one for b/bad", err)
+	}
+}
+
+func TestWalkJobsMakesTheSamePlan(t *testing.T) {
+	dir := t.TempDir()
+	files := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		files[fmt.Sprintf("d%d/f", i)] = fmt.Sprint(i)
+	}
+	write_tree(t, filepath.Join(dir, "src"), files)
+	sequential := must_run(t, dir, "src", "dst")
+	if parallel := must_run(t, dir, "src", "dst", "--walk-jobs=3"); parallel != sequential {
+		t.Errorf("--walk-jobs=3 printed\n%s\ninstead of\n%s", parallel, sequential)
+	}
+}
+
+// wide_tree has dirs directories of files files each, like a mail spool or
+// a cache.
+func wide_tree(dirs int, files int) map[string]string {
+	tree := make(map[string]string, dirs*files)
+	for d := 0; d < dirs; d++ {
+		for f := 0; f < files; f++ {
+			tree[fmt.Sprintf("d%03d/f%03d", d, f)] = "x"
+		}
+	}
+	return tree
+}
+
+func BenchmarkWalkSource(b *testing.B) {
+	src := b.TempDir()
+	write_tree(b, src, wide_tree(100, 50))
+	dst := filepath.Join(b.TempDir(), "dst")
+	for _, walk_jobs := range []int{1, 8} {
+		b.Run(fmt.Sprintf("walk-jobs=%d", walk_jobs), func(b *testing.B) {
+			reset(b)
+			opts.walk_jobs = walk_jobs
+			for i := 0; i < b.N; i++ {
+				jobs := make([]job, 0)
+				prepare_merge(src, dst, &jobs)
+			}
+		})
+	}
+}
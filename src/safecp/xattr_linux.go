@@ -0,0 +1,56 @@
+//go:build linux
+
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import (
+	"strings"
+	"syscall"
+)
+
+const selinux_supported = true
+
+// list_xattrs returns all extended attributes of path, a filesystem without
+// xattr support simply has none.
+func list_xattrs(path string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		n, err := syscall.Getxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, n)
+		if n > 0 {
+			n, err = syscall.Getxattr(path, name, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		xattrs[name] = value[:n]
+	}
+	return xattrs, nil
+}
+
+func set_xattr(path string, name string, value []byte) error {
+	return syscall.Setxattr(path, name, value, 0)
+}
+
+func remove_xattr(path string, name string) error {
+	return syscall.Removexattr(path, name)
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+/*
+  This Source Code Form is subject to the terms of the Mozilla Public
+  License, v. 2.0. If a copy of the MPL was not distributed with this
+  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+*/
+package main
+
+import "errors"
+
+// Extended attributes are only supported on Linux, elsewhere files are
+// treated as having none.
+
+const selinux_supported = false
+
+func list_xattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func set_xattr(path string, name string, value []byte) error {
+	return errors.ErrUnsupported
+}
+
+func remove_xattr(path string, name string) error {
+	return errors.ErrUnsupported
+}